@@ -0,0 +1,348 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"gophr.com/email"
+	"gophr.com/models"
+	"gophr.com/storage"
+)
+
+const (
+	// EnvDev is the environment used while developing, the defaults are good enough here
+	EnvDev = "dev"
+
+	// EnvProd is the environment used when serving real users, it refuses to run with the default secrets
+	EnvProd = "prod"
+
+	// DefaultPepper is the password pepper used when none is configured. It must stay
+	// the same as long as there are password hashes that were made with it.
+	DefaultPepper = "secret-random-string"
+
+	// DefaultHMACKey is the key remember and reset tokens are hashed with when none is configured
+	DefaultHMACKey = "secret-hmac-key"
+
+	// ThrottleStoreDatabase keeps the failed login counters in the database, shared by every server
+	ThrottleStoreDatabase = "database"
+
+	// ThrottleStoreMemory keeps the failed login counters in memory, they are lost on restart
+	ThrottleStoreMemory = "memory"
+
+	// DefaultPath is the config file read when no -config flag is given, it is fine for it to be missing
+	DefaultPath = ".config.json"
+
+	// DefaultMaxImageBytes is the size of the largest image that can be uploaded when none is configured
+	DefaultMaxImageBytes = 20 << 20 // 20 megabytes
+
+	// DefaultMaxUploadBytes is the size of the largest upload request when none is configured
+	DefaultMaxUploadBytes = 100 << 20 // 100 megabytes
+)
+
+var (
+	// ErrDefaultSecret is returned when the production environment is configured with a default or missing secret
+	ErrDefaultSecret = errors.New("config: the default pepper, HMAC key or CSRF key is still in use, set your own before running in production")
+
+	// ErrEnvInvalid is returned when the environment is neither dev nor prod
+	ErrEnvInvalid = errors.New("config: env must be dev or prod")
+
+	// ErrDialectInvalid is returned when the database dialect is not one we support
+	ErrDialectInvalid = errors.New("config: database dialect must be postgres or sqlite3")
+
+	// ErrCSRFKeyTooShort is returned when the CSRF key is too short to be safe
+	ErrCSRFKeyTooShort = errors.New("config: csrf_key must be at least 32 bytes long")
+
+	// ErrThrottleStoreInvalid is returned when the failed login counters are to be kept somewhere we do not support
+	ErrThrottleStoreInvalid = errors.New("config: throttle_store must be database or memory")
+
+	// ErrSiteURLRequired is returned when the production environment is not told the address it is served at
+	ErrSiteURLRequired = errors.New("config: site_url must be set in production, it is used to build the links sent in emails")
+
+	// ErrSiteURLInvalid is returned when the site URL is not an absolute http or https URL
+	ErrSiteURLInvalid = errors.New("config: site_url must be an http or https URL like https://gophr.com")
+
+	// ErrUploadLimitInvalid is returned when the upload limits are not positive or an image cannot fit in an upload
+	ErrUploadLimitInvalid = errors.New("config: max_image_bytes and max_upload_bytes must be positive and max_upload_bytes at least max_image_bytes")
+)
+
+// Config holds every setting the server needs to run
+type Config struct {
+	Env  string `json:"env"`
+	Port int    `json:"port"`
+	// SiteURL is the address the site is served at, links sent in emails start with it.
+	// Outside of production it defaults to localhost on the configured port.
+	SiteURL string `json:"site_url"`
+
+	// Pepper is added to every password before it is hashed
+	Pepper string `json:"pepper"`
+	// HMACKey is used to hash remember, verification and reset tokens before they are stored
+	HMACKey string `json:"hmac_key"`
+	// CSRFKey signs the CSRF cookie. When empty a random key is made at startup,
+	// which signs everyone's forms out of date on every restart.
+	CSRFKey string `json:"csrf_key"`
+	// ThrottleStore is where failed logins are counted, database or memory
+	ThrottleStore string `json:"throttle_store"`
+	// MaxImageBytes is the size of the largest image that can be uploaded
+	MaxImageBytes int64 `json:"max_image_bytes"`
+	// MaxUploadBytes is the size of the largest upload request, which can carry several images
+	MaxUploadBytes int64 `json:"max_upload_bytes"`
+
+	Database DatabaseConfig `json:"database"`
+	Storage  storage.Config `json:"storage"`
+	Mail     email.Config   `json:"mail"`
+}
+
+// DatabaseConfig holds the settings used to connect to the database. Dialect is
+// either postgres or sqlite3, Path is only used by sqlite3 and the rest only by postgres.
+type DatabaseConfig struct {
+	// Dialect needs Postgres 9.5 or SQLite 3.24 at least, the login throttle counts
+	// failures with INSERT ... ON CONFLICT DO NOTHING which older versions don't have
+	Dialect  string `json:"dialect"`
+	Path     string `json:"path"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Name     string `json:"name"`
+}
+
+// ConnectionInfo returns the connection string gorm opens the database with
+func (c DatabaseConfig) ConnectionInfo() string {
+	if c.Dialect == models.DialectSQLite {
+		// wait for the lock instead of failing when another process is writing
+		return c.Path + "?_busy_timeout=5000"
+	}
+	if c.Password == "" {
+		return fmt.Sprintf("host=%s port=%d user=%s dbname=%s sslmode=disable",
+			connValue(c.Host), c.Port, connValue(c.User), connValue(c.Name))
+	}
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+		connValue(c.Host), c.Port, connValue(c.User), connValue(c.Password), connValue(c.Name))
+}
+
+// connValue quotes a value of a postgres connection string, so spaces, quotes
+// and backslashes in a password can't break it apart
+func connValue(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
+// Default returns the config used for development on a local machine
+func Default() Config {
+	return Config{
+		Env:            EnvDev,
+		Port:           8080,
+		Pepper:         DefaultPepper,
+		HMACKey:        DefaultHMACKey,
+		ThrottleStore:  ThrottleStoreDatabase,
+		MaxImageBytes:  DefaultMaxImageBytes,
+		MaxUploadBytes: DefaultMaxUploadBytes,
+		Database: DatabaseConfig{
+			Dialect: models.DialectPostgres,
+			Path:    "gophr.db",
+			Host:    "localhost",
+			Port:    5432,
+			User:    "postgres",
+			Name:    "gophr",
+		},
+		Storage: storage.DefaultConfig(),
+		Mail:    email.DefaultConfig(),
+	}
+}
+
+// IsProd reports whether the server is running in production
+func (c Config) IsProd() bool {
+	return c.Env == EnvProd
+}
+
+// Addr returns the address the HTTP server listens on
+func (c Config) Addr() string {
+	return ":" + strconv.Itoa(c.Port)
+}
+
+// Validate makes sure the config is safe to run with
+func (c Config) Validate() error {
+	if c.Env != EnvDev && c.Env != EnvProd {
+		return ErrEnvInvalid
+	}
+	if c.Database.Dialect != models.DialectPostgres && c.Database.Dialect != models.DialectSQLite {
+		return ErrDialectInvalid
+	}
+	if c.ThrottleStore != ThrottleStoreDatabase && c.ThrottleStore != ThrottleStoreMemory {
+		return ErrThrottleStoreInvalid
+	}
+	if c.MaxImageBytes <= 0 || c.MaxUploadBytes < c.MaxImageBytes {
+		return ErrUploadLimitInvalid
+	}
+	if c.IsProd() && c.SiteURL == "" {
+		return ErrSiteURLRequired
+	}
+	if c.SiteURL != "" {
+		u, err := url.Parse(c.SiteURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return ErrSiteURLInvalid
+		}
+	}
+	if c.IsProd() && (c.Pepper == DefaultPepper || c.HMACKey == DefaultHMACKey || c.CSRFKey == "") {
+		return ErrDefaultSecret
+	}
+	if c.CSRFKey != "" && len(c.CSRFKey) < 32 {
+		return ErrCSRFKeyTooShort
+	}
+	return nil
+}
+
+// LoadFile overrides the settings in c with the ones in a JSON file. Settings missing from the file are left alone.
+func (c *Config) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("config: reading %s: %v", path, err)
+	}
+	return nil
+}
+
+// LoadEnv overrides the settings in c with any GOPHR_* environment variables that are set
+func (c *Config) LoadEnv() error {
+	setFromEnv(&c.Env, "GOPHR_ENV")
+	setFromEnv(&c.SiteURL, "GOPHR_SITE_URL")
+	setFromEnv(&c.Pepper, "GOPHR_PEPPER")
+	setFromEnv(&c.HMACKey, "GOPHR_HMAC_KEY")
+	setFromEnv(&c.CSRFKey, "GOPHR_CSRF_KEY")
+	setFromEnv(&c.ThrottleStore, "GOPHR_THROTTLE_STORE")
+	setFromEnv(&c.Database.Dialect, "GOPHR_DB_DIALECT")
+	setFromEnv(&c.Database.Path, "GOPHR_DB_PATH")
+	setFromEnv(&c.Database.Host, "GOPHR_DB_HOST")
+	setFromEnv(&c.Database.User, "GOPHR_DB_USER")
+	setFromEnv(&c.Database.Password, "GOPHR_DB_PASSWORD")
+	setFromEnv(&c.Database.Name, "GOPHR_DB_NAME")
+	if err := setIntFromEnv(&c.Port, "GOPHR_PORT"); err != nil {
+		return err
+	}
+	if err := setIntFromEnv(&c.Database.Port, "GOPHR_DB_PORT"); err != nil {
+		return err
+	}
+	if err := setInt64FromEnv(&c.MaxImageBytes, "GOPHR_MAX_IMAGE_BYTES"); err != nil {
+		return err
+	}
+	if err := setInt64FromEnv(&c.MaxUploadBytes, "GOPHR_MAX_UPLOAD_BYTES"); err != nil {
+		return err
+	}
+	c.Storage.LoadEnv()
+	return c.Mail.LoadEnv()
+}
+
+func setFromEnv(dst *string, name string) {
+	if v, ok := os.LookupEnv(name); ok {
+		*dst = v
+	}
+}
+
+func setIntFromEnv(dst *int, name string) error {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("config: %s must be a number", name)
+	}
+	*dst = n
+	return nil
+}
+
+func setInt64FromEnv(dst *int64, name string) error {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return fmt.Errorf("config: %s must be a number", name)
+	}
+	*dst = n
+	return nil
+}
+
+// Loader builds a Config from every source. Defaults are overridden by the config
+// file, which is overridden by environment variables, which are overridden by flags.
+type Loader struct {
+	fs   *flag.FlagSet
+	path string
+	// flags holds the values given on the command line, only the ones actually set are applied
+	flags Config
+}
+
+// NewLoader registers the config flags on fs. Secrets have no flags since
+// command lines can be read by every user of the machine.
+func NewLoader(fs *flag.FlagSet) *Loader {
+	l := &Loader{fs: fs}
+	fs.StringVar(&l.path, "config", DefaultPath, "path of the JSON config file")
+	fs.StringVar(&l.flags.Env, "env", EnvDev, "environment to run in, dev or prod")
+	fs.IntVar(&l.flags.Port, "port", 8080, "port the HTTP server listens on")
+	fs.StringVar(&l.flags.SiteURL, "site-url", "", "address the site is served at, used for the links in emails")
+	fs.StringVar(&l.flags.Database.Dialect, "db-dialect", models.DialectPostgres, "database to use, postgres or sqlite3")
+	fs.StringVar(&l.flags.Database.Path, "db-path", "gophr.db", "file of the sqlite3 database")
+	fs.StringVar(&l.flags.Database.Host, "db-host", "localhost", "host of the postgres server")
+	fs.IntVar(&l.flags.Database.Port, "db-port", 5432, "port of the postgres server")
+	fs.StringVar(&l.flags.Database.User, "db-user", "postgres", "user to connect to postgres as")
+	fs.StringVar(&l.flags.Database.Name, "db-name", "gophr", "name of the postgres database")
+	return l
+}
+
+// Load builds the config once the flags have been parsed, and validates it
+func (l *Loader) Load() (*Config, error) {
+	c := Default()
+	pathSet := false
+	l.fs.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			pathSet = true
+		}
+	})
+	// the default file is optional, one asked for on the command line is not
+	if err := c.LoadFile(l.path); err != nil && (pathSet || !os.IsNotExist(err)) {
+		return nil, err
+	}
+	if err := c.LoadEnv(); err != nil {
+		return nil, err
+	}
+	l.fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "env":
+			c.Env = l.flags.Env
+		case "port":
+			c.Port = l.flags.Port
+		case "site-url":
+			c.SiteURL = l.flags.SiteURL
+		case "db-dialect":
+			c.Database.Dialect = l.flags.Database.Dialect
+		case "db-path":
+			c.Database.Path = l.flags.Database.Path
+		case "db-host":
+			c.Database.Host = l.flags.Database.Host
+		case "db-port":
+			c.Database.Port = l.flags.Database.Port
+		case "db-user":
+			c.Database.User = l.flags.Database.User
+		case "db-name":
+			c.Database.Name = l.flags.Database.Name
+		}
+	})
+	if c.SiteURL == "" && !c.IsProd() {
+		c.SiteURL = "http://localhost" + c.Addr()
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
@@ -0,0 +1,236 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gophr.com/models"
+)
+
+// prodConfig returns a config that is valid in production
+func prodConfig() Config {
+	c := Default()
+	c.Env = EnvProd
+	c.Pepper = "a pepper nobody else uses"
+	c.HMACKey = "an HMAC key nobody else uses"
+	c.CSRFKey = "a CSRF key that is long enough to be safe"
+	c.SiteURL = "https://gophr.com"
+	return c
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   error
+	}{
+		{"prod", func(c *Config) {}, nil},
+		{"dev defaults", func(c *Config) { *c = Default() }, nil},
+		{"sqlite", func(c *Config) { c.Database.Dialect = models.DialectSQLite }, nil},
+		{"memory throttle", func(c *Config) { c.ThrottleStore = ThrottleStoreMemory }, nil},
+		{"unknown env", func(c *Config) { c.Env = "staging" }, ErrEnvInvalid},
+		{"unknown dialect", func(c *Config) { c.Database.Dialect = "mysql" }, ErrDialectInvalid},
+		{"unknown throttle store", func(c *Config) { c.ThrottleStore = "redis" }, ErrThrottleStoreInvalid},
+		{"no image size", func(c *Config) { c.MaxImageBytes = 0 }, ErrUploadLimitInvalid},
+		{"image bigger than an upload", func(c *Config) { c.MaxUploadBytes = c.MaxImageBytes - 1 }, ErrUploadLimitInvalid},
+		{"image as big as an upload", func(c *Config) { c.MaxUploadBytes = c.MaxImageBytes }, nil},
+		{"default pepper", func(c *Config) { c.Pepper = DefaultPepper }, ErrDefaultSecret},
+		{"default HMAC key", func(c *Config) { c.HMACKey = DefaultHMACKey }, ErrDefaultSecret},
+		{"no CSRF key", func(c *Config) { c.CSRFKey = "" }, ErrDefaultSecret},
+		{"no CSRF key in dev", func(c *Config) { c.Env = EnvDev; c.CSRFKey = "" }, nil},
+		{"short CSRF key", func(c *Config) { c.CSRFKey = strings.Repeat("k", 31) }, ErrCSRFKeyTooShort},
+		{"short CSRF key in dev", func(c *Config) { c.Env = EnvDev; c.CSRFKey = "short" }, ErrCSRFKeyTooShort},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := prodConfig()
+			tt.change(&c)
+			if err := c.Validate(); err != tt.want {
+				t.Errorf("Validate() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectionInfo(t *testing.T) {
+	tests := []struct {
+		name string
+		db   DatabaseConfig
+		want string
+	}{
+		{"sqlite", DatabaseConfig{Dialect: models.DialectSQLite, Path: "gophr.db"}, "gophr.db?_busy_timeout=5000"},
+		{"postgres", DatabaseConfig{Dialect: models.DialectPostgres, Host: "db", Port: 5432, User: "gophr", Name: "photos"},
+			"host='db' port=5432 user='gophr' dbname='photos' sslmode=disable"},
+		{"postgres with a password", DatabaseConfig{Dialect: models.DialectPostgres, Host: "db", Port: 5432, User: "gophr", Password: "pw", Name: "photos"},
+			"host='db' port=5432 user='gophr' password='pw' dbname='photos' sslmode=disable"},
+		{"postgres with a password to quote", DatabaseConfig{Dialect: models.DialectPostgres, Host: "db", Port: 5432, User: "gophr", Password: `it's a \ pw`, Name: "photos"},
+			`host='db' port=5432 user='gophr' password='it\'s a \\ pw' dbname='photos' sslmode=disable`},
+	}
+	for _, tt := range tests {
+		if got := tt.db.ConnectionInfo(); got != tt.want {
+			t.Errorf("%s: ConnectionInfo() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// writeConfig writes a config file for a test and returns its path
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// load runs a Loader with the given command line
+func load(t *testing.T, args ...string) (*Config, error) {
+	t.Helper()
+	fs := flag.NewFlagSet("gophr", flag.ContinueOnError)
+	l := NewLoader(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return l.Load()
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, `{"port": 3000, "pepper": "file pepper", "database": {"name": "file", "user": "file"}, "throttle_store": "memory"}`)
+	t.Setenv("GOPHR_PEPPER", "env pepper")
+	t.Setenv("GOPHR_DB_NAME", "env")
+	c, err := load(t, "-config", path, "-db-name", "flag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		setting   string
+		got, want interface{}
+	}{
+		{"port from the file", c.Port, 3000},
+		{"throttle store from the file", c.ThrottleStore, ThrottleStoreMemory},
+		{"database user from the file", c.Database.User, "file"},
+		{"pepper from the environment", c.Pepper, "env pepper"},
+		{"database name from the flag", c.Database.Name, "flag"},
+		{"host left at its default", c.Database.Host, "localhost"},
+		// a flag that was not given does not put its default back over the file
+		{"dialect left at its default", c.Database.Dialect, models.DialectPostgres},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.setting, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		want    error
+		wantMsg string
+	}{
+		{name: "unknown setting in the file", file: `{"pepers": "typo"}`, wantMsg: "unknown field"},
+		{name: "broken file", file: `{"port": `, wantMsg: "config: reading"},
+		{name: "port that is not a number", env: map[string]string{"GOPHR_PORT": "eighty"}, wantMsg: "GOPHR_PORT must be a number"},
+		{name: "upload limit that is not a number", env: map[string]string{"GOPHR_MAX_UPLOAD_BYTES": "1MB"}, wantMsg: "GOPHR_MAX_UPLOAD_BYTES must be a number"},
+		{name: "SMTP port that is not a number", env: map[string]string{"GOPHR_SMTP_PORT": "smtp"}, wantMsg: "GOPHR_SMTP_PORT must be a number"},
+		{name: "prod with the default secrets", env: map[string]string{"GOPHR_ENV": EnvProd, "GOPHR_SITE_URL": "https://gophr.com"}, want: ErrDefaultSecret},
+		{name: "invalid setting", env: map[string]string{"GOPHR_THROTTLE_STORE": "redis"}, want: ErrThrottleStoreInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			var args []string
+			if tt.file != "" {
+				args = []string{"-config", writeConfig(t, tt.file)}
+			}
+			c, err := load(t, args...)
+			if err == nil {
+				t.Fatalf("Load() = %+v, want an error", c)
+			}
+			if tt.want != nil && err != tt.want {
+				t.Errorf("Load() error = %v, want %v", err, tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.wantMsg) {
+				t.Errorf("Load() error = %v, want it to mention %q", err, tt.wantMsg)
+			}
+		})
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.json")
+	if _, err := load(t, "-config", missing); !os.IsNotExist(err) {
+		t.Errorf("Load() with a missing -config file error = %v, want it not found", err)
+	}
+}
+
+func TestValidateSiteURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string
+		siteURL string
+		want    error
+	}{
+		{"prod", EnvProd, "https://gophr.com", nil},
+		{"prod with a port and path", EnvProd, "https://gophr.com:8443/photos/", nil},
+		{"prod without", EnvProd, "", ErrSiteURLRequired},
+		{"dev without", EnvDev, "", nil},
+		{"dev over http", EnvDev, "http://localhost:8080", nil},
+		{"no scheme", EnvProd, "gophr.com", ErrSiteURLInvalid},
+		{"other scheme", EnvProd, "ftp://gophr.com", ErrSiteURLInvalid},
+		{"no host", EnvProd, "https://", ErrSiteURLInvalid},
+		{"unparsable", EnvDev, "http://gophr.com:port", ErrSiteURLInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := prodConfig()
+			c.Env = tt.env
+			c.SiteURL = tt.siteURL
+			if err := c.Validate(); err != tt.want {
+				t.Errorf("Validate() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadSiteURL(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{name: "dev default", want: "http://localhost:8080"},
+		{name: "dev default follows the port", args: []string{"-port", "3000"}, want: "http://localhost:3000"},
+		{name: "flag", args: []string{"-site-url", "https://gophr.com"}, want: "https://gophr.com"},
+		{name: "environment", env: map[string]string{"GOPHR_SITE_URL": "https://photos.gophr.com"}, want: "https://photos.gophr.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			fs := flag.NewFlagSet("gophr", flag.ContinueOnError)
+			l := NewLoader(fs)
+			// there is no config file next to the tests, and the default one is optional
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			c, err := l.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.SiteURL != tt.want {
+				t.Errorf("SiteURL = %q, want %q", c.SiteURL, tt.want)
+			}
+		})
+	}
+}
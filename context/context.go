@@ -0,0 +1,59 @@
+package context
+
+import (
+	"context"
+
+	"gophr.com/models"
+)
+
+// privateKey keeps other packages from reading or overwriting our values in a context
+type privateKey string
+
+const (
+	userKey      privateKey = "user"
+	sessionKey   privateKey = "session"
+	requestIDKey privateKey = "request_id"
+)
+
+// WithUser returns a copy of ctx that carries the logged in user
+func WithUser(ctx context.Context, user *models.User) context.Context {
+	return context.WithValue(ctx, userKey, user)
+}
+
+// User returns the logged in user stored in ctx, or nil if there is none
+func User(ctx context.Context) *models.User {
+	if temp := ctx.Value(userKey); temp != nil {
+		if user, ok := temp.(*models.User); ok {
+			return user
+		}
+	}
+	return nil
+}
+
+// WithSession returns a copy of ctx that carries the session the request was made with
+func WithSession(ctx context.Context, session *models.Session) context.Context {
+	return context.WithValue(ctx, sessionKey, session)
+}
+
+// Session returns the session stored in ctx, or nil if there is none
+func Session(ctx context.Context) *models.Session {
+	if temp := ctx.Value(sessionKey); temp != nil {
+		if session, ok := temp.(*models.Session); ok {
+			return session
+		}
+	}
+	return nil
+}
+
+// WithRequestID returns a copy of ctx that carries the id of the request it belongs to
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the request id stored in ctx, or "" if there is none
+func RequestID(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIDKey).(string); ok {
+		return id
+	}
+	return ""
+}
@@ -0,0 +1,178 @@
+package controllers
+
+import (
+	"os"
+	"testing"
+
+	"gophr.com/email"
+	"gophr.com/models"
+	"gophr.com/views"
+)
+
+func TestMain(m *testing.M) {
+	// the templates are found relative to the root of the repository
+	views.LayoutDir = "../" + views.LayoutDir
+	views.TemplateDir = "../" + views.TemplateDir
+	email.TemplateDir = "../" + email.TemplateDir
+	os.Exit(m.Run())
+}
+
+// fakeUsers is a UserService that knows the users by their id and email, and the users
+// with a password reset or a two-factor login under way by its token
+type fakeUsers struct {
+	models.UserService
+	byID    map[uint]*models.User
+	byEmail map[string]*models.User
+	byReset map[string]*models.User
+	byLogin map[string]*models.User
+}
+
+func (f *fakeUsers) ByID(id uint) (*models.User, error) {
+	if user, ok := f.byID[id]; ok {
+		return user, nil
+	}
+	return nil, models.ErrNotFound
+}
+
+func (f *fakeUsers) ByEmail(email string) (*models.User, error) {
+	if user, ok := f.byEmail[email]; ok {
+		return user, nil
+	}
+	return nil, models.ErrNotFound
+}
+
+// Authenticate compares the plain text password the fake keeps in Password
+func (f *fakeUsers) Authenticate(email, password string) (*models.User, error) {
+	user, err := f.ByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	if user.Password != password {
+		return nil, models.ErrPasswordIncorrect
+	}
+	return user, nil
+}
+
+// CompleteReset uses up the token, like the real one
+func (f *fakeUsers) CompleteReset(token, newPw string) (*models.User, error) {
+	user, ok := f.byReset[token]
+	if !ok {
+		return nil, models.ErrTokenInvalid
+	}
+	if newPw == "" {
+		return nil, models.ErrPasswordRequired
+	}
+	delete(f.byReset, token)
+	user.Password = newPw
+	return user, nil
+}
+
+func (f *fakeUsers) CancelDeletion(user *models.User) error {
+	user.DeletionDueAt = nil
+	return nil
+}
+
+func (f *fakeUsers) StartTwoFactorLogin(user *models.User) (string, error) {
+	token := "login-token-" + user.Email
+	f.byLogin[token] = user
+	return token, nil
+}
+
+func (f *fakeUsers) TwoFactorLogin(token string) (*models.User, error) {
+	if user, ok := f.byLogin[token]; ok {
+		return user, nil
+	}
+	return nil, models.ErrTokenInvalid
+}
+
+// CompleteTwoFactorLogin accepts the code 123456 and ends every login of the user under way
+func (f *fakeUsers) CompleteTwoFactorLogin(user *models.User, code string) error {
+	if code != "123456" {
+		return models.ErrTwoFactorCodeInvalid
+	}
+	for token, u := range f.byLogin {
+		if u == user {
+			delete(f.byLogin, token)
+		}
+	}
+	return nil
+}
+
+// startSessions signs each of the users in and returns the tokens of their sessions by name
+func startSessions(t *testing.T, ss models.SessionService, users map[string]*models.User) map[string]string {
+	t.Helper()
+	tokens := make(map[string]string)
+	for name, user := range users {
+		session, err := ss.Start(user.ID, "test", "192.0.2.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[name] = session.Token
+	}
+	return tokens
+}
+
+// sessionToken returns the token of the session started for name, or name itself when no
+// session was, so tests can send cookies that belong to nobody
+func sessionToken(tokens map[string]string, name string) string {
+	if token, ok := tokens[name]; ok {
+		return token
+	}
+	return name
+}
+
+// fakeGalleries is a GalleryService keeping the galleries in a map
+type fakeGalleries struct {
+	models.GalleryService
+	galleries map[uint]*models.Gallery
+}
+
+func (f *fakeGalleries) ByID(id uint) (*models.Gallery, error) {
+	gallery, ok := f.galleries[id]
+	if !ok {
+		return nil, models.ErrNotFound
+	}
+	g := *gallery
+	return &g, nil
+}
+
+func (f *fakeGalleries) Update(gallery *models.Gallery) error {
+	g := *gallery
+	f.galleries[gallery.ID] = &g
+	return nil
+}
+
+func (f *fakeGalleries) Delete(id uint) error {
+	delete(f.galleries, id)
+	return nil
+}
+
+// fakeImages is an ImageService keeping the images of galleries in a map, without any files
+type fakeImages struct {
+	models.ImageService
+	images map[string]*models.Image
+}
+
+func (f *fakeImages) ByGalleryID(galleryID uint) ([]models.Image, error) {
+	var images []models.Image
+	for _, image := range f.images {
+		if image.GalleryID == galleryID {
+			images = append(images, *image)
+		}
+	}
+	return images, nil
+}
+
+func (f *fakeImages) ByFilename(galleryID uint, filename string) (*models.Image, error) {
+	image, ok := f.images[filename]
+	if !ok || image.GalleryID != galleryID {
+		return nil, models.ErrNotFound
+	}
+	i := *image
+	return &i, nil
+}
+
+func (f *fakeImages) Remove(image *models.Image) error {
+	delete(f.images, image.Filename)
+	return nil
+}
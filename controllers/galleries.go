@@ -0,0 +1,472 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"gophr.com/context"
+	"gophr.com/logging"
+	"gophr.com/models"
+	"gophr.com/storage"
+	"gophr.com/views"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	errNotOwner     = errors.New("controllers: gallery does not belong to the user")
+	errNotPublished = errors.New("controllers: gallery has not been published")
+)
+
+const (
+	// ShowGallery is the name of the route used to display a single gallery
+	ShowGallery = "show_gallery"
+
+	// EditGallery is the name of the route used to edit a single gallery
+	EditGallery = "edit_gallery"
+
+	// maxMultipartMem is the amount of an image upload that is kept in memory, the rest is spooled to disk
+	maxMultipartMem = 1 << 20 // 1 megabyte
+)
+
+// NewGalleries parses the templates related to galleries and stores them in Galleries struct
+func NewGalleries(gs models.GalleryService, is models.ImageService, us models.UserService, r *mux.Router) *Galleries {
+	return &Galleries{
+		New:       views.NewView("base", "galleries/new"),
+		ShowView:  views.NewView("base", "galleries/show"),
+		EditView:  views.NewView("base", "galleries/edit"),
+		IndexView: views.NewView("base", "galleries/index"),
+		ImageView: views.NewView("base", "galleries/image"),
+		gs:        gs,
+		is:        is,
+		us:        us,
+		r:         r,
+	}
+}
+
+// Index is used to list the galleries owned by the logged in user
+func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	galleries, err := g.gs.ByUserID(user.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error(err)
+		http.Error(w, views.AlertMsgGeneric, http.StatusInternalServerError)
+		return
+	}
+	var vd views.Data
+	vd.Yield = galleries
+	g.IndexView.Render(w, r, vd)
+}
+
+// NewGallery is used to render the form for creating a new gallery
+func (g *Galleries) NewGallery(w http.ResponseWriter, r *http.Request) {
+	if err := g.New.Render(w, r, nil); err != nil {
+		panic(err)
+	}
+}
+
+// Create will parse the new gallery form and create a gallery owned by the logged in user
+func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	var form GalleryForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.New.Render(w, r, vd)
+		return
+	}
+	gallery := models.Gallery{
+		Title:  form.Title,
+		UserID: user.ID,
+	}
+	if err := g.gs.Create(&gallery); err != nil {
+		vd.SetAlert(err)
+		g.New.Render(w, r, vd)
+		return
+	}
+	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, url.Path, http.StatusFound)
+}
+
+// Show is used to display a single gallery
+func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.visibleGallery(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	vd.Yield = gallery
+	g.ShowView.Render(w, r, vd)
+}
+
+// Edit is used to render the edit form of a gallery to its owner
+func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.ownedGallery(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	vd.Yield = gallery
+	g.EditView.Render(w, r, vd)
+}
+
+// Update will parse the edit gallery form and save the changes made by the owner
+func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.ownedGallery(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	vd.Yield = gallery
+	var form GalleryForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	gallery.Title = form.Title
+	if err := g.gs.Update(gallery); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Gallery successfully updated!",
+	}
+	g.EditView.Render(w, r, vd)
+}
+
+// Delete is used to delete a gallery on behalf of its owner
+func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.ownedGallery(w, r)
+	if err != nil {
+		return
+	}
+	for i := range gallery.Images {
+		if err := g.is.Remove(&gallery.Images[i]); err != nil {
+			logging.FromContext(r.Context()).Error(err)
+		}
+	}
+	if err := g.gs.Delete(gallery.ID); err != nil {
+		var vd views.Data
+		vd.Yield = gallery
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+// Publish makes a gallery visible to everyone. Only users who have verified
+// their email address can publish.
+func (g *Galleries) Publish(w http.ResponseWriter, r *http.Request) {
+	g.setPublished(w, r, true)
+}
+
+// Unpublish hides a gallery from everyone but its owner
+func (g *Galleries) Unpublish(w http.ResponseWriter, r *http.Request) {
+	g.setPublished(w, r, false)
+}
+
+func (g *Galleries) setPublished(w http.ResponseWriter, r *http.Request, published bool) {
+	gallery, err := g.ownedGallery(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	vd.Yield = gallery
+	if published && !context.User(r.Context()).EmailVerified {
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLvlWarning,
+			Message: "Please verify your email address before publishing galleries. You can ask for a new verification link on your account page.",
+		}
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	gallery.Published = published
+	if err := g.gs.Update(gallery); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, url.Path, http.StatusFound)
+}
+
+// ImageUpload stores the images attached to the edit gallery form
+func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.ownedGallery(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	vd.Yield = gallery
+	if err := r.ParseMultipartForm(maxMultipartMem); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	for _, fh := range r.MultipartForm.File["images"] {
+		file, err := fh.Open()
+		if err != nil {
+			vd.SetAlert(err)
+			g.EditView.Render(w, r, vd)
+			return
+		}
+		_, err = g.is.Upload(gallery.ID, fh.Filename, file)
+		file.Close()
+		if err != nil {
+			vd.SetAlert(err)
+			vd.Alert.Message = fh.Filename + ": " + vd.Alert.Message
+			status := http.StatusOK
+			if err == models.ErrImageTooLarge {
+				status = http.StatusRequestEntityTooLarge
+			}
+			g.renderEdit(w, r, vd, status)
+			return
+		}
+	}
+	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, url.Path, http.StatusFound)
+}
+
+// ImageDelete removes a single image from a gallery on behalf of its owner
+func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.ownedGallery(w, r)
+	if err != nil {
+		return
+	}
+	image, err := g.is.ByFilename(gallery.ID, mux.Vars(r)["filename"])
+	if err != nil {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	if err := g.is.Remove(image); err != nil {
+		var vd views.Data
+		vd.Yield = gallery
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, url.Path, http.StatusFound)
+}
+
+// ImageServe writes the stored file of an image to the response
+func (g *Galleries) ImageServe(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	galleryID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	gallery, err := g.gs.ByID(uint(galleryID))
+	if err != nil || !canView(r, gallery) {
+		http.NotFound(w, r)
+		return
+	}
+	image, err := g.is.ByFilename(gallery.ID, vars["filename"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	f, contentType, err := g.openImage(gallery, image, r.URL.Query().Get("size"))
+	if err != nil {
+		logging.FromContext(r.Context()).Error(err)
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", contentType)
+	// local files can be seeked which gives us range and conditional requests for free
+	if rs, ok := f.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, image.Filename, image.UpdatedAt, rs)
+		return
+	}
+	w.Header().Set("Last-Modified", image.UpdatedAt.UTC().Format(http.TimeFormat))
+	if _, err := io.Copy(w, f); err != nil {
+		logging.FromContext(r.Context()).Error(err)
+	}
+}
+
+// ImageInfo renders the page showing an image along with its EXIF metadata
+func (g *Galleries) ImageInfo(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.visibleGallery(w, r)
+	if err != nil {
+		return
+	}
+	image, err := g.is.ByFilename(gallery.ID, mux.Vars(r)["filename"])
+	if err != nil {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	info := ImageDetails{
+		Gallery: gallery,
+		Image:   image,
+	}
+	// owners always see where their photos were taken, everyone else only when the owner opted in
+	if image.HasLocation {
+		if user := context.User(r.Context()); user != nil && user.ID == gallery.UserID {
+			info.ShowLocation = true
+		} else {
+			info.ShowLocation = g.ownerKeepsLocation(gallery)
+		}
+	}
+	var vd views.Data
+	vd.Yield = info
+	g.ImageView.Render(w, r, vd)
+}
+
+// openImage opens the requested variant of an image, falling back to the
+// original when no variant is asked for or it has not been generated
+func (g *Galleries) openImage(gallery *models.Gallery, image *models.Image, variant string) (io.ReadCloser, string, error) {
+	if variant != "" {
+		f, err := g.is.OpenVariant(image, variant)
+		if err == nil {
+			return f, image.VariantContentType(), nil
+		}
+		if err != storage.ErrNotExist {
+			return nil, "", err
+		}
+	}
+	// the owner's choice only matters for photos that have a location to keep
+	f, err := g.is.OpenPublic(image, image.HasLocation && g.ownerKeepsLocation(gallery))
+	if err != nil {
+		return nil, "", err
+	}
+	return f, image.ContentType, nil
+}
+
+// ownerKeepsLocation reports whether the owner of a gallery has chosen to publish the
+// GPS coordinates of their photos. Location is stripped whenever we cannot tell.
+func (g *Galleries) ownerKeepsLocation(gallery *models.Gallery) bool {
+	owner, err := g.us.ByID(gallery.UserID)
+	if err != nil {
+		return false
+	}
+	return owner.KeepPhotoLocation
+}
+
+// galleryByID looks up the gallery whose id is in the request path
+// and writes an error response if it cannot be found
+func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid gallery ID", http.StatusNotFound)
+		return nil, err
+	}
+	gallery, err := g.gs.ByID(uint(id))
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+		default:
+			logging.FromContext(r.Context()).Error(err)
+			http.Error(w, views.AlertMsgGeneric, http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	images, err := g.is.ByGalleryID(gallery.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error(err)
+		http.Error(w, views.AlertMsgGeneric, http.StatusInternalServerError)
+		return nil, err
+	}
+	gallery.Images = images
+	return gallery, nil
+}
+
+// visibleGallery looks up the gallery in the request path and makes sure the visitor
+// may see it. Unpublished galleries are reported as missing to everyone but their owner.
+func (g *Galleries) visibleGallery(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return nil, err
+	}
+	if !canView(r, gallery) {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return nil, errNotPublished
+	}
+	return gallery, nil
+}
+
+// canView reports whether the visitor making the request may see the gallery
+func canView(r *http.Request, gallery *models.Gallery) bool {
+	if gallery.Published {
+		return true
+	}
+	user := context.User(r.Context())
+	return user != nil && user.ID == gallery.UserID
+}
+
+// renderEdit renders the edit page with status, for failures that need one other than 200
+func (g *Galleries) renderEdit(w http.ResponseWriter, r *http.Request, vd views.Data, status int) {
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(status)
+	if err := g.EditView.Render(w, r, vd); err != nil {
+		logging.FromContext(r.Context()).Error(err)
+	}
+}
+
+// ownedGallery looks up the gallery in the request path and makes sure
+// that it belongs to the logged in user
+func (g *Galleries) ownedGallery(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
+	user := context.User(r.Context())
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return nil, err
+	}
+	if gallery.UserID != user.ID {
+		http.Error(w, "You do not have permission to edit this gallery", http.StatusForbidden)
+		return nil, errNotOwner
+	}
+	return gallery, nil
+}
+
+// Galleries will hold processed templates related to gallery operations
+type Galleries struct {
+	New       *views.View
+	ShowView  *views.View
+	EditView  *views.View
+	IndexView *views.View
+	ImageView *views.View
+	gs        models.GalleryService
+	is        models.ImageService
+	us        models.UserService
+	r         *mux.Router
+}
+
+// ImageDetails is what the image details page is rendered with
+type ImageDetails struct {
+	Gallery      *models.Gallery
+	Image        *models.Image
+	ShowLocation bool
+}
+
+// GalleryForm contains the details entered by the user in the new and edit gallery forms
+type GalleryForm struct {
+	Title string `schema:"title"`
+}
@@ -0,0 +1,151 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"gophr.com/middleware"
+	"gophr.com/models"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// galleryRouter routes the gallery pages that are checked for who may see or change them, behind the
+// middleware main puts in front of them
+func galleryRouter(g *Galleries, r *mux.Router, us models.UserService, ss models.SessionService) http.Handler {
+	userMw := middleware.User{UserService: us, SessionService: ss}
+	requireUserMw := middleware.RequireUser{}
+	r.HandleFunc("/galleries/{id:[0-9]+}", g.Show).Methods("GET").Name(ShowGallery)
+	r.HandleFunc("/galleries/{id:[0-9]+}/edit", requireUserMw.ApplyFn(g.Edit)).Methods("GET").Name(EditGallery)
+	r.HandleFunc("/galleries/{id:[0-9]+}/update", requireUserMw.ApplyFn(g.Update)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/delete", requireUserMw.ApplyFn(g.Delete)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/publish", requireUserMw.ApplyFn(g.Publish)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete", requireUserMw.ApplyFn(g.ImageDelete)).Methods("POST")
+	return userMw.Apply(r)
+}
+
+func TestGalleryOwnership(t *testing.T) {
+	owner := &models.User{Name: "Jon"}
+	owner.ID = 1
+	other := &models.User{Name: "Jane"}
+	other.ID = 2
+	us := &fakeUsers{byID: map[uint]*models.User{owner.ID: owner, other.ID: other}}
+	ss := models.NewMemSessionService("test-hmac-key")
+	tokens := startSessions(t, ss, map[string]*models.User{"owner": owner, "other": other})
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		cookie     string
+		wantStatus int
+		// wantTitle is the title the gallery is left with, empty when it is deleted
+		wantTitle string
+		wantImage bool
+	}{
+		{"owner edits", "GET", "/galleries/1/edit", "owner", http.StatusOK, "Holiday", true},
+		{"owner updates", "POST", "/galleries/1/update", "owner", http.StatusOK, "Renamed", true},
+		{"owner deletes", "POST", "/galleries/1/delete", "owner", http.StatusFound, "", false},
+		{"owner deletes an image", "POST", "/galleries/1/images/a.png/delete", "owner", http.StatusFound, "Holiday", false},
+		{"other user edits", "GET", "/galleries/1/edit", "other", http.StatusForbidden, "Holiday", true},
+		{"other user updates", "POST", "/galleries/1/update", "other", http.StatusForbidden, "Holiday", true},
+		{"other user deletes", "POST", "/galleries/1/delete", "other", http.StatusForbidden, "Holiday", true},
+		{"other user deletes an image", "POST", "/galleries/1/images/a.png/delete", "other", http.StatusForbidden, "Holiday", true},
+		{"logged out updates", "POST", "/galleries/1/update", "", http.StatusFound, "Holiday", true},
+		{"unknown session deletes", "POST", "/galleries/1/delete", "forged", http.StatusFound, "Holiday", true},
+		{"missing gallery", "POST", "/galleries/9/delete", "owner", http.StatusNotFound, "Holiday", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs := &fakeGalleries{galleries: map[uint]*models.Gallery{
+				1: {Model: gorm.Model{ID: 1}, UserID: owner.ID, Title: "Holiday"},
+			}}
+			is := &fakeImages{images: map[string]*models.Image{
+				"a.png": {GalleryID: 1, Filename: "a.png"},
+			}}
+			r := mux.NewRouter()
+			h := galleryRouter(NewGalleries(gs, is, us, r), r, us, ss)
+
+			form := url.Values{"title": {"Renamed"}}
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "remember_token", Value: sessionToken(tokens, tt.cookie)})
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			gallery, ok := gs.galleries[1]
+			switch {
+			case tt.wantTitle == "" && ok:
+				t.Error("the gallery was not deleted")
+			case tt.wantTitle != "" && !ok:
+				t.Error("the gallery was deleted")
+			case ok && gallery.Title != tt.wantTitle:
+				t.Errorf("title = %q, want %q", gallery.Title, tt.wantTitle)
+			}
+			if _, ok := is.images["a.png"]; ok != tt.wantImage {
+				t.Errorf("image kept = %v, want %v", ok, tt.wantImage)
+			}
+		})
+	}
+}
+
+func TestGalleryVisibility(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		cookie        string
+		ownerVerified bool
+		published     bool
+		wantStatus    int
+		wantPublished bool
+	}{
+		{"owner sees a draft", "GET", "/galleries/1", "owner", false, false, http.StatusOK, false},
+		{"other user looks for a draft", "GET", "/galleries/1", "other", false, false, http.StatusNotFound, false},
+		{"visitor looks for a draft", "GET", "/galleries/1", "", false, false, http.StatusNotFound, false},
+		{"visitor sees a published gallery", "GET", "/galleries/1", "", false, true, http.StatusOK, true},
+		{"verified owner publishes", "POST", "/galleries/1/publish", "owner", true, false, http.StatusFound, true},
+		{"unverified owner publishes", "POST", "/galleries/1/publish", "owner", false, false, http.StatusOK, false},
+		{"other user publishes", "POST", "/galleries/1/publish", "other", false, false, http.StatusForbidden, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			owner := &models.User{Name: "Jon", EmailVerified: tt.ownerVerified}
+			owner.ID = 1
+			other := &models.User{Name: "Jane", EmailVerified: true}
+			other.ID = 2
+			us := &fakeUsers{byID: map[uint]*models.User{owner.ID: owner, other.ID: other}}
+			ss := models.NewMemSessionService("test-hmac-key")
+			tokens := startSessions(t, ss, map[string]*models.User{"owner": owner, "other": other})
+			gs := &fakeGalleries{galleries: map[uint]*models.Gallery{
+				1: {Model: gorm.Model{ID: 1}, UserID: owner.ID, Title: "Holiday", Published: tt.published},
+			}}
+			is := &fakeImages{images: map[string]*models.Image{}}
+			r := mux.NewRouter()
+			h := galleryRouter(NewGalleries(gs, is, us, r), r, us, ss)
+
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "remember_token", Value: sessionToken(tokens, tt.cookie)})
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := gs.galleries[1].Published; got != tt.wantPublished {
+				t.Errorf("published = %v, want %v", got, tt.wantPublished)
+			}
+		})
+	}
+}
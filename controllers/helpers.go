@@ -1,18 +1,79 @@
 package controllers
 
 import (
+	"net"
 	"net/http"
+	"strings"
+
+	"gophr.com/models"
+	"gophr.com/views"
 
 	"github.com/gorilla/schema"
 )
 
+// parseForm decodes the posted form into data. A malformed body or a value that does
+// not fit its field, like text posted for a checkbox, is returned as an error.
 func parseForm(r *http.Request, data interface{}) error {
 	if err := r.ParseForm(); err != nil {
-		panic(err)
+		return err
 	}
 	dec := schema.NewDecoder()
-	if err := dec.Decode(data, r.PostForm); err != nil {
-		panic(err)
+	// forms carry fields that are not part of the struct, like the CSRF token
+	dec.IgnoreUnknownKeys(true)
+	return dec.Decode(data, r.PostForm)
+}
+
+// FieldErrors holds the messages shown next to the inputs of a form, keyed by the name of the input
+type FieldErrors map[string]string
+
+// fieldErrors returns the problems of a *models.ValidationError keyed by the names of the
+// inputs they are about, or nil when err is not one. renames maps the names of model fields
+// to the names of the inputs where a form calls them something else.
+func fieldErrors(err error, renames map[string]string) FieldErrors {
+	verr, ok := err.(*models.ValidationError)
+	if !ok {
+		return nil
+	}
+	errs := make(FieldErrors, len(verr.Fields))
+	for field, ferr := range verr.Fields {
+		if name, ok := renames[field]; ok {
+			field = name
+		}
+		errs[field] = views.AlertMsgGeneric
+		if pErr, ok := ferr.(models.PublicError); ok {
+			errs[field] = pErr.Public()
+		}
+	}
+	return errs
+}
+
+// safeReturnTo only lets through paths on this site so a crafted login link
+// cannot send users somewhere else after they sign in
+func safeReturnTo(returnTo string) string {
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.Contains(returnTo, "\\") {
+		return ""
+	}
+	// browsers drop tabs and newlines from URLs, which could turn "/\t/evil.com" into "//evil.com"
+	for _, c := range returnTo {
+		if c < ' ' || c == 0x7f {
+			return ""
+		}
 	}
-	return nil
+	return returnTo
+}
+
+// clientIP returns the address the request came from, without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// siteURL turns a path on this site into an absolute link that can be put in an email.
+// base is the configured address of the site, the Host header of a request can't be
+// trusted to build links that are sent to users.
+func siteURL(base, path string) string {
+	return strings.TrimSuffix(base, "/") + path
 }
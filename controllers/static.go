@@ -1,7 +1,13 @@
 package controllers
 
 import (
+	"net/http"
+
+	"gophr.com/context"
+	"gophr.com/logging"
 	"gophr.com/views"
+
+	"github.com/gorilla/csrf"
 )
 
 // NewStatic processes templates of static pages and assigns them to a Static type
@@ -11,6 +17,9 @@ func NewStatic() *Static {
 		Contact:  views.NewView("base", "static/contact"),
 		Faq:      views.NewView("base", "static/faq"),
 		Error404: views.NewView("base", "static/error404"),
+		Error403: views.NewView("base", "static/error403"),
+		Error413: views.NewView("base", "static/error413"),
+		Error500: views.NewView("base", "static/error500"),
 	}
 }
 
@@ -20,4 +29,36 @@ type Static struct {
 	Contact  *views.View
 	Faq      *views.View
 	Error404 *views.View
+	Error403 *views.View
+	Error413 *views.View
+	Error500 *views.View
+}
+
+// InvalidCSRF renders the error page for state-changing requests that failed the CSRF check
+func (s *Static) InvalidCSRF(w http.ResponseWriter, r *http.Request) {
+	logging.FromContext(r.Context()).Error(csrf.FailureReason(r))
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusForbidden)
+	if err := s.Error403.Render(w, r, nil); err != nil {
+		logging.FromContext(r.Context()).Error(err)
+	}
+}
+
+// RequestTooLarge renders the error page for requests with a body over the upload limit
+func (s *Static) RequestTooLarge(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	if err := s.Error413.Render(w, r, nil); err != nil {
+		logging.FromContext(r.Context()).Error(err)
+	}
+}
+
+// InternalError renders the error page for requests that failed on the server, along with
+// the id of the request so it can be mentioned when contacting us
+func (s *Static) InternalError(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusInternalServerError)
+	if err := s.Error500.Render(w, r, context.RequestID(r.Context())); err != nil {
+		logging.FromContext(r.Context()).Error(err)
+	}
 }
@@ -1,27 +1,65 @@
 package controllers
 
 import (
-	"fmt"
-	"log"
+	"encoding/base64"
+	"html/template"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
+	"gophr.com/context"
+	"gophr.com/email"
+	"gophr.com/logging"
 	"gophr.com/models"
-	"gophr.com/rand"
+	"gophr.com/totp"
 	"gophr.com/views"
+
+	"github.com/gorilla/mux"
 )
 
-// NewUsers parses the templates related to the user and stores them in Users struct
-func NewUsers(us models.UserService) *Users {
+const (
+	// twoFactorCookie carries the login token between the password and the code steps of a login
+	twoFactorCookie = "two_factor_token"
+
+	// twoFactorIssuer is the name authenticator apps show next to the user's codes
+	twoFactorIssuer = "Gophr"
+)
+
+// NewUsers parses the templates related to the user and stores them in Users struct. Links
+// sent in emails start with siteURL, the address the site is served at.
+func NewUsers(us models.UserService, ss models.SessionService, throttle models.LoginThrottle, mailer email.Mailer, siteURL string) *Users {
 	return &Users{
-		NewView:   views.NewView("base", "users/new"),
-		LogInView: views.NewView("base", "users/login"),
-		us:        us,
+		NewView:      views.NewView("base", "users/new"),
+		LogInView:    views.NewView("base", "users/login"),
+		AccountView:  views.NewView("base", "users/account"),
+		ForgotPwView: views.NewView("base", "users/forgot_pw"),
+		ResetPwView:  views.NewView("base", "users/reset_pw"),
+		VerifyView:   views.NewView("base", "users/verify"),
+		SessionsView: views.NewView("base", "users/sessions"),
+		SettingsView: views.NewView("base", "users/settings"),
+
+		TwoFactorSetupView: views.NewView("base", "users/two_factor_setup"),
+		RecoveryCodesView:  views.NewView("base", "users/recovery_codes"),
+		TwoFactorLoginView: views.NewView("base", "users/two_factor_login"),
+
+		DeletionScheduledView: views.NewView("base", "users/deletion_scheduled"),
+
+		us:           us,
+		ss:           ss,
+		throttle:     throttle,
+		mailer:       mailer,
+		siteURL:      siteURL,
+		welcomeEmail: email.NewTemplate("welcome"),
+		resetPwEmail: email.NewTemplate("reset_pw"),
+		verifyEmail:  email.NewTemplate("verify_email"),
+		unlockEmail:  email.NewTemplate("unlock_account"),
 	}
 }
 
 // New function is used to render the signup form (for creating a new user)
 func (u *Users) New(w http.ResponseWriter, r *http.Request) {
-	if err := u.NewView.Render(w, nil); err != nil {
+	if err := u.NewView.Render(w, r, &SignupForm{}); err != nil {
 		panic(err)
 	}
 }
@@ -30,119 +68,985 @@ func (u *Users) New(w http.ResponseWriter, r *http.Request) {
 func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 	var vd views.Data
 	var form SignupForm
-	if err := parseForm(r, &form); err != nil {
-		log.Println(err)
-		vd.Alert = &views.Alert{
-			Level:   views.AlertLvlError,
-			Message: views.AlertMsgGeneric,
-		}
-		u.NewView.Render(w, vd)
+	vd.Yield = &form
+	err := parseForm(r, &form)
+	// the password is never rendered back into the form
+	password := form.Password
+	form.Password = ""
+	if err != nil {
+		vd.SetAlert(err)
+		u.NewView.Render(w, r, vd)
 		return
 	}
 	user := models.User{
 		Name:     form.Name,
 		Email:    form.Email,
-		Password: form.Password,
+		Password: password,
 	}
 
 	if err := u.us.Create(&user); err != nil {
-		vd.Alert = &views.Alert{
-			Level:   views.AlertLvlError,
-			Message: err.Error(),
+		if form.Errors = fieldErrors(err, nil); form.Errors == nil {
+			vd.SetAlert(err)
 		}
-		u.NewView.Render(w, vd)
+		u.NewView.Render(w, r, vd)
 		return
 	}
 
-	err := u.signIn(w, &user)
+	err = u.signIn(w, r, &user)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Error(err)
+		http.Redirect(w, r, "/login", http.StatusFound)
 		return
 	}
-	http.Redirect(w, r, "/cookietest", http.StatusFound)
+	// the account exists at this point, so a welcome email that fails to go out is only logged
+	data := EmailData{
+		Name: user.Name,
+		URL:  siteURL(u.siteURL, "/galleries"),
+	}
+	if token, err := u.us.StartVerification(&user); err != nil {
+		logging.FromContext(r.Context()).Error(err)
+	} else {
+		data.VerifyURL = verifyURL(u.siteURL, token)
+	}
+	u.sendEmail(r, u.welcomeEmail, user.Email, data)
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+// LogIn is used to render the login form, carrying along the page to return to afterwards
+func (u *Users) LogIn(w http.ResponseWriter, r *http.Request) {
+	form := LoginForm{
+		ReturnTo: safeReturnTo(r.URL.Query().Get("return_to")),
+	}
+	if err := u.LogInView.Render(w, r, form); err != nil {
+		panic(err)
+	}
 }
 
-// Login will parse the login form and authenticate users
+// Login will parse the login form and authenticate users. Failed attempts are counted
+// per account and per client address, and logins are refused while they are throttled.
 func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
 	form := LoginForm{}
-	if err := parseForm(r, &form); err != nil {
+	vd.Yield = &form
+	err := parseForm(r, &form)
+	// the password is never rendered back into the form
+	password := form.Password
+	form.Password = ""
+	if err != nil {
+		vd.SetAlert(err)
+		u.LogInView.Render(w, r, vd)
+		return
+	}
+	ip := clientIP(r)
+
+	if err := u.throttle.Check(form.Email, ip); err != nil {
+		switch err {
+		case models.ErrLoginThrottled, models.ErrAccountLocked:
+			vd.SetWarning(err)
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			vd.SetAlert(err)
+		}
+		u.LogInView.Render(w, r, vd)
+		return
+	}
+
+	user, err := u.us.Authenticate(form.Email, password)
+	switch err {
+	case nil:
+	case models.ErrNotFound, models.ErrPasswordIncorrect:
+		// both get the same message so the form cannot be used to find out who is signed up
+		u.loginFailed(r, form.Email, ip)
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLvlError,
+			Message: "Invalid email address or password.",
+		}
+		u.LogInView.Render(w, r, vd)
+		return
+	default:
+		vd.SetAlert(err)
+		u.LogInView.Render(w, r, vd)
+		return
+	}
+	if user.TwoFactorEnabled {
+		// the failed logins are only forgotten once the second factor is right too
+		u.startTwoFactorLogin(w, r, user, form.ReturnTo)
+		return
+	}
+	if err := u.throttle.Succeeded(form.Email); err != nil {
+		logging.FromContext(r.Context()).Error(err)
+	}
+	u.finishLogin(w, r, user, form.ReturnTo)
+}
+
+// startTwoFactorLogin remembers that the password was right in a short lived cookie and
+// sends the user on to enter the code from their authenticator app
+func (u *Users) startTwoFactorLogin(w http.ResponseWriter, r *http.Request, user *models.User, returnTo string) {
+	token, err := u.us.StartTwoFactorLogin(user)
+	if err != nil {
+		vd := views.Data{Yield: &LoginForm{ReturnTo: returnTo}}
+		vd.SetAlert(err)
+		u.LogInView.Render(w, r, vd)
+		return
+	}
+	cookie := http.Cookie{
+		Name:     twoFactorCookie,
+		Value:    token,
+		Path:     "/login/two-factor",
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &cookie)
+	path := "/login/two-factor"
+	if returnTo = safeReturnTo(returnTo); returnTo != "" {
+		v := url.Values{}
+		v.Set("return_to", returnTo)
+		path += "?" + v.Encode()
+	}
+	http.Redirect(w, r, path, http.StatusFound)
+}
+
+// TwoFactorLogIn is used to render the form asking for the code of the second login step
+func (u *Users) TwoFactorLogIn(w http.ResponseWriter, r *http.Request) {
+	form := TwoFactorForm{
+		ReturnTo: safeReturnTo(r.URL.Query().Get("return_to")),
+	}
+	if err := u.TwoFactorLoginView.Render(w, r, form); err != nil {
 		panic(err)
 	}
+}
 
-	user, err := u.us.Authenticate(form.Email, form.Password)
+// TwoFactorLogin will parse the code form of the second login step and sign the user in when
+// the code is right. Wrong codes count as failed logins just like wrong passwords.
+func (u *Users) TwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form TwoFactorForm
+	vd.Yield = &form
+	err := parseForm(r, &form)
+	code := form.Code
+	form.Code = ""
 	if err != nil {
+		vd.SetAlert(err)
+		u.TwoFactorLoginView.Render(w, r, vd)
+		return
+	}
+
+	var token string
+	if cookie, err := r.Cookie(twoFactorCookie); err == nil {
+		token = cookie.Value
+	}
+	user, err := u.us.TwoFactorLogin(token)
+	switch err {
+	case nil:
+	case models.ErrTokenInvalid:
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLvlWarning,
+			Message: "Your login has expired, please enter your email address and password again.",
+		}
+		vd.Yield = &LoginForm{ReturnTo: form.ReturnTo}
+		u.LogInView.Render(w, r, vd)
+		return
+	default:
+		vd.SetAlert(err)
+		u.TwoFactorLoginView.Render(w, r, vd)
+		return
+	}
+
+	ip := clientIP(r)
+	if err := u.throttle.Check(user.Email, ip); err != nil {
 		switch err {
-		case models.ErrNotFound:
-			fmt.Fprintln(w, "Invalid Email address")
-		case models.ErrPasswordIncorrect:
-			fmt.Fprintln(w, "Invalid Password Provided")
-		case nil:
-			fmt.Fprintln(w, user)
+		case models.ErrLoginThrottled, models.ErrAccountLocked:
+			vd.SetWarning(err)
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusTooManyRequests)
 		default:
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			vd.SetAlert(err)
 		}
+		u.TwoFactorLoginView.Render(w, r, vd)
 		return
 	}
-	err = u.signIn(w, user)
-	if err != nil {
+
+	switch err := u.us.CompleteTwoFactorLogin(user, code); err {
+	case nil:
+	case models.ErrTwoFactorCodeInvalid:
+		u.loginFailed(r, user.Email, ip)
+		vd.SetAlert(err)
+		u.TwoFactorLoginView.Render(w, r, vd)
+		return
+	default:
+		vd.SetAlert(err)
+		u.TwoFactorLoginView.Render(w, r, vd)
+		return
+	}
+	if err := u.throttle.Succeeded(user.Email); err != nil {
+		logging.FromContext(r.Context()).Error(err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     twoFactorCookie,
+		Value:    "",
+		Path:     "/login/two-factor",
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	u.finishLogin(w, r, user, form.ReturnTo)
+}
+
+// finishLogin signs in a user who got through every step of logging in. Logging in is how
+// users take back an account they deleted, so a scheduled deletion is cancelled and they
+// land on their account page to be told about it.
+func (u *Users) finishLogin(w http.ResponseWriter, r *http.Request, user *models.User, returnTo string) {
+	cancelled := user.DeletionScheduled()
+	if err := u.us.CancelDeletion(user); err != nil {
+		logging.FromContext(r.Context()).Error(err)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	if err := u.signIn(w, r, user); err != nil {
 		http.Redirect(w, r, "/login", http.StatusFound)
 		return
 	}
-	http.Redirect(w, r, "/cookietest", http.StatusFound)
+	if cancelled {
+		r = r.WithContext(context.WithUser(r.Context(), user))
+		u.AccountView.Render(w, r, views.Data{
+			Alert: &views.Alert{
+				Level:   views.AlertLvlSuccess,
+				Message: "Welcome back! Your account is no longer scheduled for deletion.",
+			},
+			Yield: user,
+		})
+		return
+	}
+	returnTo = safeReturnTo(returnTo)
+	if returnTo == "" {
+		returnTo = "/galleries"
+	}
+	http.Redirect(w, r, returnTo, http.StatusFound)
+}
+
+// loginFailed counts a failed login and, when it locks the account, emails the owner a link to unlock it
+func (u *Users) loginFailed(r *http.Request, email, ip string) {
+	token, err := u.throttle.Failed(email, ip)
+	if err != nil {
+		logging.FromContext(r.Context()).Error(err)
+		return
+	}
+	if token == "" {
+		return
+	}
+	// accounts that do not exist get locked as well, so locking gives nothing away, but there is no one to tell
+	user, err := u.us.ByEmail(email)
+	if err != nil {
+		if err != models.ErrNotFound {
+			logging.FromContext(r.Context()).Error(err)
+		}
+		return
+	}
+	u.sendEmail(r, u.unlockEmail, user.Email, EmailData{
+		Name: user.Name,
+		URL:  unlockURL(u.siteURL, token),
+	})
+}
+
+// Unlock lifts the lock from the account the unlock link was sent for
+func (u *Users) Unlock(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	vd.Yield = &LoginForm{}
+	err := u.throttle.Unlock(r.URL.Query().Get("token"))
+	switch err {
+	case nil:
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLvlSuccess,
+			Message: "Your account has been unlocked, you can log in again.",
+		}
+	case models.ErrTokenInvalid:
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLvlError,
+			Message: "This unlock link is not valid anymore. The account may already be unlocked, try logging in.",
+		}
+	default:
+		vd.SetAlert(err)
+	}
+	u.LogInView.Render(w, r, vd)
+}
+
+// Account renders the account page of the logged in user
+func (u *Users) Account(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	vd.Yield = user
+	u.AccountView.Render(w, r, vd)
+}
+
+// UpdatePrivacy will parse the photo privacy form on the account page and save the choice
+func (u *Users) UpdatePrivacy(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	vd.Yield = user
+	var form PrivacyForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	user.KeepPhotoLocation = form.KeepPhotoLocation
+	if err := u.us.Update(user); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your privacy settings have been saved.",
+	}
+	u.AccountView.Render(w, r, vd)
+}
+
+// SetupTwoFactor makes a new secret for the logged in user and shows it as a QR code to scan
+// with an authenticator app, along with the form to confirm it with a first code
+func (u *Users) SetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	vd.Yield = user
+	if _, err := u.us.StartTwoFactor(user); err != nil {
+		if err == models.ErrTwoFactorEnabled {
+			vd.SetWarning(err)
+		} else {
+			vd.SetAlert(err)
+		}
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	u.renderTwoFactorSetup(w, r, user, nil)
+}
+
+// EnableTwoFactor will parse the code entered on the setup page and turn two-factor
+// authentication on when it is right, showing the recovery codes once
+func (u *Users) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	vd.Yield = user
+	var form TwoFactorForm
+	if err := parseForm(r, &form); err != nil {
+		logging.FromContext(r.Context()).Error(err)
+		u.renderTwoFactorSetup(w, r, user, &views.Alert{
+			Level:   views.AlertLvlError,
+			Message: views.AlertMsgGeneric,
+		})
+		return
+	}
+	codes, err := u.us.EnableTwoFactor(user, form.Code)
+	switch err {
+	case nil:
+	case models.ErrTwoFactorCodeInvalid:
+		u.renderTwoFactorSetup(w, r, user, &views.Alert{
+			Level:   views.AlertLvlError,
+			Message: "That code did not match, check the clock of your phone and try the next code.",
+		})
+		return
+	case models.ErrTwoFactorEnabled, models.ErrTwoFactorNotStarted:
+		vd.SetWarning(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	default:
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Two-factor authentication is on.",
+	}
+	vd.Yield = codes
+	u.RecoveryCodesView.Render(w, r, vd)
+}
+
+// DisableTwoFactor will parse the password entered on the account page and turn
+// two-factor authentication off when it is right
+func (u *Users) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	vd.Yield = user
+	var form PasswordForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	switch err := u.us.DisableTwoFactor(user, form.Password); err {
+	case nil:
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLvlSuccess,
+			Message: "Two-factor authentication is off.",
+		}
+	default:
+		vd.SetAlert(err)
+	}
+	u.AccountView.Render(w, r, vd)
+}
+
+// DeleteAccount schedules the account of the logged in user for deletion once they confirm
+// their password, and signs them out everywhere. Logging in again before the deletion is
+// due cancels it.
+func (u *Users) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	vd.Yield = user
+	var form PasswordForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	if err := u.us.ScheduleDeletion(user, form.Password); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	if err := u.ss.DeleteByUserID(user.ID); err != nil {
+		logging.FromContext(r.Context()).Error(err)
+	}
+	u.signOut(w)
+	r = r.WithContext(context.WithUser(r.Context(), nil))
+	u.DeletionScheduledView.Render(w, r, vd)
+}
+
+// renderTwoFactorSetup shows the secret of the user as a QR code, a link and plain text
+func (u *Users) renderTwoFactorSetup(w http.ResponseWriter, r *http.Request, user *models.User, alert *views.Alert) {
+	vd := views.Data{Alert: alert}
+	uri := totp.URI(user.TOTPSecret, twoFactorIssuer, user.Email)
+	png, err := totp.QRCode(uri, 256)
+	if err != nil {
+		vd.SetAlert(err)
+		vd.Yield = user
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	// both are made here rather than taken from the user, so they are safe to put in the page as is
+	vd.Yield = TwoFactorSetup{
+		Secret: user.TOTPSecret,
+		URI:    template.URL(uri),
+		QRCode: template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)),
+	}
+	u.TwoFactorSetupView.Render(w, r, vd)
+}
+
+// Settings renders the forms for changing the name, email address and password of the logged in user
+func (u *Users) Settings(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	u.SettingsView.Render(w, r, newSettingsForm(user))
+}
+
+// UpdateName will parse the name form on the settings page and save the new name
+func (u *Users) UpdateName(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	form := newSettingsForm(user)
+	var vd views.Data
+	vd.Yield = form
+	if err := parseForm(r, form); err != nil {
+		vd.SetAlert(err)
+		u.SettingsView.Render(w, r, vd)
+		return
+	}
+	// changes are made on a copy so a rejected one does not show up elsewhere on the page
+	changed := *user
+	changed.Name = form.Name
+	if err := u.us.Update(&changed); err != nil {
+		u.renderSettingsError(w, r, form, err)
+		return
+	}
+	*user = changed
+	form.Name = user.Name
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your name has been saved.",
+	}
+	u.SettingsView.Render(w, r, vd)
+}
+
+// UpdateEmail will parse the email form on the settings page, change the email address
+// and send a verification link to the new one
+func (u *Users) UpdateEmail(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	form := newSettingsForm(user)
+	var vd views.Data
+	vd.Yield = form
+	if err := parseForm(r, form); err != nil {
+		vd.SetAlert(err)
+		u.SettingsView.Render(w, r, vd)
+		return
+	}
+	oldEmail := user.Email
+	changed := *user
+	if err := u.us.ChangeEmail(&changed, form.Email); err != nil {
+		u.renderSettingsError(w, r, form, err)
+		return
+	}
+	*user = changed
+	form.Email = user.Email
+	if user.Email == oldEmail {
+		u.SettingsView.Render(w, r, vd)
+		return
+	}
+	token, err := u.us.StartVerification(user)
+	if err != nil {
+		// the address has changed at this point, a new link can be asked for from the account page
+		logging.FromContext(r.Context()).Error(err)
+	} else {
+		u.sendEmail(r, u.verifyEmail, user.Email, EmailData{
+			Name:      user.Name,
+			VerifyURL: verifyURL(u.siteURL, token),
+		})
+	}
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your email address has been changed. Follow the link we sent to " + user.Email + " to verify it.",
+	}
+	u.SettingsView.Render(w, r, vd)
 }
 
-// CookieTest is used to check whether cookie is set or not
-func (u *Users) CookieTest(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("remember_token")
+// UpdatePassword will parse the password form on the settings page and set the new password
+// once the current one is confirmed. Every other device is logged out.
+func (u *Users) UpdatePassword(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	form := newSettingsForm(user)
+	var vd views.Data
+	vd.Yield = form
+	err := parseForm(r, form)
+	// passwords are never rendered back into the form
+	current, newPw := form.CurrentPassword, form.NewPassword
+	form.CurrentPassword, form.NewPassword = "", ""
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		vd.SetAlert(err)
+		u.SettingsView.Render(w, r, vd)
 		return
 	}
-	user, err := u.us.ByRemember(cookie.Value)
+	changed := *user
+	if err := u.us.ChangePassword(&changed, current, newPw); err != nil {
+		u.renderSettingsError(w, r, form, err)
+		return
+	}
+	*user = changed
+	u.endOtherSessions(r)
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your password has been changed and your other devices have been logged out.",
+	}
+	u.SettingsView.Render(w, r, vd)
+}
+
+// renderSettingsError shows the errors next to the fields they are about, or as an alert when it is not about a field
+func (u *Users) renderSettingsError(w http.ResponseWriter, r *http.Request, form *SettingsForm, err error) {
+	var vd views.Data
+	vd.Yield = form
+	// the password field of the user is the new password on this page
+	switch errs := fieldErrors(err, map[string]string{"password": "new_password"}); {
+	case errs != nil:
+		form.Errors = errs
+	case err == models.ErrPasswordIncorrect:
+		form.Errors["current_password"] = err.(models.PublicError).Public()
+	default:
+		vd.SetAlert(err)
+	}
+	u.SettingsView.Render(w, r, vd)
+}
+
+// endOtherSessions logs the user out of every device but the one the request came from
+func (u *Users) endOtherSessions(r *http.Request) {
+	user := context.User(r.Context())
+	current := context.Session(r.Context())
+	sessions, err := u.ss.ByUserID(user.ID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Error(err)
 		return
 	}
-	fmt.Fprintln(w, user)
+	for _, session := range sessions {
+		if current != nil && session.ID == current.ID {
+			continue
+		}
+		if err := u.ss.Delete(session.ID); err != nil {
+			logging.FromContext(r.Context()).Error(err)
+		}
+	}
 }
 
-func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
-	if user.Remember == "" {
-		token, err := rand.RememberToken()
-		if err != nil {
-			return err
+// Logout expires the remember_token cookie and ends the session of this device, so a
+// copy of the cookie stops working too. Other devices stay logged in.
+func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
+	u.signOut(w)
+	if session := context.Session(r.Context()); session != nil {
+		if err := u.ss.Delete(session.ID); err != nil {
+			logging.FromContext(r.Context()).Error(err)
 		}
-		user.Remember = token
-		err = u.us.Update(user)
-		if err != nil {
-			return err
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// Sessions lists the devices the logged in user is logged in on
+func (u *Users) Sessions(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	u.renderSessions(w, r, vd)
+}
+
+// RevokeSession logs the user out of one of their devices. Revoking the session of
+// this device logs out like Logout does.
+func (u *Users) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var vd views.Data
+	session, err := u.ss.ByID(uint(id))
+	switch {
+	// other users' sessions are reported missing rather than forbidden, their ids are nobody's business
+	case err == models.ErrNotFound, err == nil && session.UserID != user.ID:
+		http.NotFound(w, r)
+		return
+	case err == nil:
+		err = u.ss.Delete(session.ID)
+	}
+	if err != nil {
+		vd.SetAlert(err)
+		u.renderSessions(w, r, vd)
+		return
+	}
+	if current := context.Session(r.Context()); current != nil && current.ID == session.ID {
+		u.signOut(w)
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "The device has been logged out.",
+	}
+	u.renderSessions(w, r, vd)
+}
+
+// SignOutEverywhere ends every session of the logged in user, on this device and every other
+func (u *Users) SignOutEverywhere(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if err := u.ss.DeleteByUserID(user.ID); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		u.renderSessions(w, r, vd)
+		return
+	}
+	u.signOut(w)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// renderSessions shows the sessions page with the current sessions of the logged in user
+func (u *Users) renderSessions(w http.ResponseWriter, r *http.Request, vd views.Data) {
+	user := context.User(r.Context())
+	sessions, err := u.ss.ByUserID(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	list := SessionList{Sessions: sessions}
+	if current := context.Session(r.Context()); current != nil {
+		list.CurrentID = current.ID
+	}
+	vd.Yield = list
+	u.SessionsView.Render(w, r, vd)
+}
+
+// Verify marks the email address of the user the verification link was sent to as verified
+func (u *Users) Verify(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	_, err := u.us.Verify(r.URL.Query().Get("token"))
+	switch err {
+	case nil:
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLvlSuccess,
+			Message: "Thanks, your email address has been verified.",
+		}
+	case models.ErrTokenInvalid:
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLvlError,
+			Message: "This verification link is not valid anymore. You can ask for a new one on your account page.",
+		}
+	default:
+		vd.SetAlert(err)
+	}
+	u.VerifyView.Render(w, r, vd)
+}
+
+// ResendVerification sends a new verification link to the logged in user
+func (u *Users) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	vd.Yield = user
+	token, err := u.us.StartVerification(user)
+	switch err {
+	case nil:
+		u.sendEmail(r, u.verifyEmail, user.Email, EmailData{
+			Name:      user.Name,
+			VerifyURL: verifyURL(u.siteURL, token),
+		})
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLvlSuccess,
+			Message: "A new verification link is on its way to " + user.Email + ".",
+		}
+	case models.ErrVerifyThrottled, models.ErrEmailAlreadyVerified:
+		vd.SetWarning(err)
+	default:
+		vd.SetAlert(err)
+	}
+	u.AccountView.Render(w, r, vd)
+}
+
+// ForgotPassword renders the form used to ask for a password reset link
+func (u *Users) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	if err := u.ForgotPwView.Render(w, r, ResetPwForm{}); err != nil {
+		panic(err)
+	}
+}
+
+// InitiateReset will parse the forgot password form and send a reset link to the address given.
+// The same message is shown whether or not an account exists so the form cannot be used to find out who is signed up.
+func (u *Users) InitiateReset(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form ResetPwForm
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.ForgotPwView.Render(w, r, vd)
+		return
+	}
+
+	token, err := u.us.InitiateReset(form.Email)
+	switch err {
+	case nil:
+		u.sendEmail(r, u.resetPwEmail, form.Email, EmailData{
+			URL: resetURL(u.siteURL, token),
+		})
+	case models.ErrNotFound, models.ErrEmailNotVerified:
+	default:
+		vd.SetAlert(err)
+		u.ForgotPwView.Render(w, r, vd)
+		return
+	}
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "If an account exists for that address, a link to reset its password is on its way.",
+	}
+	u.ForgotPwView.Render(w, r, vd)
+}
+
+// ResetPassword renders the form for choosing a new password, with the token from the emailed link filled in
+func (u *Users) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	form := ResetPwForm{
+		Token: r.URL.Query().Get("token"),
+	}
+	if err := u.ResetPwView.Render(w, r, form); err != nil {
+		panic(err)
+	}
+}
+
+// CompleteReset will parse the reset password form, set the new password and sign the user in,
+// after the code from their authenticator app when they have two-factor authentication on
+func (u *Users) CompleteReset(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form ResetPwForm
+	vd.Yield = &form
+	err := parseForm(r, &form)
+	password := form.Password
+	form.Password = ""
+	if err != nil {
+		vd.SetAlert(err)
+		u.ResetPwView.Render(w, r, vd)
+		return
+	}
+
+	user, err := u.us.CompleteReset(form.Token, password)
+	if err != nil {
+		if form.Errors = fieldErrors(err, nil); form.Errors == nil {
+			vd.SetAlert(err)
 		}
+		u.ResetPwView.Render(w, r, vd)
+		return
+	}
+	// whoever knew the old password may be logged in somewhere, so every session is ended
+	if err := u.ss.DeleteByUserID(user.ID); err != nil {
+		logging.FromContext(r.Context()).Error(err)
+	}
+	// the reset link only stands in for the password, the second factor is still asked for
+	if user.TwoFactorEnabled {
+		u.startTwoFactorLogin(w, r, user, "")
+		return
+	}
+	u.finishLogin(w, r, user, "")
+}
+
+// resetURL builds the link a user follows to reset their password
+func resetURL(base, token string) string {
+	v := url.Values{}
+	v.Set("token", token)
+	return siteURL(base, "/reset?"+v.Encode())
+}
+
+// verifyURL builds the link a user follows to verify their email address
+func verifyURL(base, token string) string {
+	v := url.Values{}
+	v.Set("token", token)
+	return siteURL(base, "/verify?"+v.Encode())
+}
+
+// unlockURL builds the link a user follows to unlock their account after too many failed logins
+func unlockURL(base, token string) string {
+	v := url.Values{}
+	v.Set("token", token)
+	return siteURL(base, "/unlock?"+v.Encode())
+}
+
+// sendEmail renders an email for the recipient and sends it, logging any failure with the request it was for
+func (u *Users) sendEmail(r *http.Request, tpl *email.Template, to string, data EmailData) {
+	msg, err := tpl.Message(to, data)
+	if err != nil {
+		logging.FromContext(r.Context()).Error(err)
+		return
+	}
+	if err := u.mailer.Send(msg); err != nil {
+		logging.FromContext(r.Context()).Error(err)
+	}
+}
+
+// signIn starts a new session for the user on the device the request came from
+func (u *Users) signIn(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	session, err := u.ss.Start(user.ID, r.UserAgent(), clientIP(r))
+	if err != nil {
+		return err
 	}
 	cookie := http.Cookie{
 		Name:     "remember_token",
-		Value:    user.Remember,
+		Value:    session.Token,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
 		HttpOnly: true,
 	}
 	http.SetCookie(w, &cookie)
 	return nil
 }
 
+// signOut expires the remember_token cookie
+func (u *Users) signOut(w http.ResponseWriter) {
+	cookie := http.Cookie{
+		Name:     "remember_token",
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &cookie)
+}
+
 // Users will hold processed templates related to user operations
 type Users struct {
-	NewView   *views.View
-	LogInView *views.View
-	us        models.UserService
+	NewView      *views.View
+	LogInView    *views.View
+	AccountView  *views.View
+	ForgotPwView *views.View
+	ResetPwView  *views.View
+	VerifyView   *views.View
+	SessionsView *views.View
+	SettingsView *views.View
+
+	TwoFactorSetupView *views.View
+	RecoveryCodesView  *views.View
+	TwoFactorLoginView *views.View
+
+	DeletionScheduledView *views.View
+
+	us           models.UserService
+	ss           models.SessionService
+	throttle     models.LoginThrottle
+	mailer       email.Mailer
+	siteURL      string
+	welcomeEmail *email.Template
+	resetPwEmail *email.Template
+	verifyEmail  *email.Template
+	unlockEmail  *email.Template
 }
 
-// SignupForm contains the details entered by the user in the signup form
+// SignupForm contains the details entered by the user in the signup form, Errors holds
+// the messages shown next to the fields they are about
 type SignupForm struct {
-	Name     string `schema:"name"`
-	Email    string `schema:"email"`
-	Password string `schema:"password"`
+	Name     string      `schema:"name"`
+	Email    string      `schema:"email"`
+	Password string      `schema:"password"`
+	Errors   FieldErrors `schema:"-"`
+}
+
+// PrivacyForm contains the photo privacy choices made on the account page
+type PrivacyForm struct {
+	KeepPhotoLocation bool `schema:"keep_photo_location"`
 }
 
 // LoginForm contains the details entered by the user in the login form
 type LoginForm struct {
 	Email    string `schema:"email"`
 	Password string `schema:"password"`
+	ReturnTo string `schema:"return_to"`
+}
+
+// TwoFactorForm contains the code entered to set up two-factor authentication or to log in with it
+type TwoFactorForm struct {
+	Code     string `schema:"code"`
+	ReturnTo string `schema:"return_to"`
+}
+
+// SettingsForm contains the details entered on the settings page, each of its forms only
+// sends its own fields. Errors holds the messages shown next to the fields they are about.
+type SettingsForm struct {
+	Name            string      `schema:"name"`
+	Email           string      `schema:"email"`
+	CurrentPassword string      `schema:"current_password"`
+	NewPassword     string      `schema:"new_password"`
+	Errors          FieldErrors `schema:"-"`
+}
+
+// newSettingsForm returns the settings form filled in with the user's current details
+func newSettingsForm(user *models.User) *SettingsForm {
+	return &SettingsForm{
+		Name:   user.Name,
+		Email:  user.Email,
+		Errors: make(FieldErrors),
+	}
+}
+
+// PasswordForm contains the password entered to confirm a change to the account
+type PasswordForm struct {
+	Password string `schema:"password"`
+}
+
+// TwoFactorSetup is what the two-factor setup page is rendered with
+type TwoFactorSetup struct {
+	Secret string
+	URI    template.URL
+	QRCode template.URL
+}
+
+// ResetPwForm contains the details entered in the forgot password and reset password forms,
+// Errors holds the messages shown next to the fields they are about
+type ResetPwForm struct {
+	Email    string      `schema:"email"`
+	Token    string      `schema:"token"`
+	Password string      `schema:"password"`
+	Errors   FieldErrors `schema:"-"`
+}
+
+// SessionList is what the sessions page is rendered with, CurrentID is the session of the device viewing it
+type SessionList struct {
+	Sessions  []models.Session
+	CurrentID uint
+}
+
+// EmailData is what the email templates sent to users are rendered with
+type EmailData struct {
+	Name      string
+	URL       string
+	VerifyURL string
 }
@@ -0,0 +1,347 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gophr.com/email"
+	"gophr.com/middleware"
+	"gophr.com/models"
+
+	"github.com/gorilla/mux"
+)
+
+// postForm sends form to h as a browser would and returns the response
+func postForm(h http.HandlerFunc, target string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+// responseCookie returns the cookie the response sets with name, or nil if it sets none
+func responseCookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// sessionUser returns the id of the user whose session the cookie holds, or 0 when it holds none
+func sessionUser(ss models.SessionService, c *http.Cookie) uint {
+	if c == nil {
+		return 0
+	}
+	session, err := ss.Lookup(c.Value)
+	if err != nil {
+		return 0
+	}
+	return session.UserID
+}
+
+func TestCompleteReset(t *testing.T) {
+	tests := []struct {
+		name         string
+		token        string
+		password     string
+		twoFactor    bool
+		wantLocation string
+	}{
+		{"valid token", "reset-token", "a new password", false, "/galleries"},
+		{"valid token with two-factor on", "reset-token", "a new password", true, "/login/two-factor"},
+		{"unknown token", "forged", "a new password", false, ""},
+		{"no password", "reset-token", "", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := &models.User{Email: "jon@example.com", Password: "old password", TwoFactorEnabled: tt.twoFactor}
+			user.ID = 1
+			us := &fakeUsers{
+				byReset: map[string]*models.User{"reset-token": user},
+				byLogin: map[string]*models.User{},
+			}
+			ss := models.NewMemSessionService("test-hmac-key")
+			old := startSessions(t, ss, map[string]*models.User{"old": user})
+			u := NewUsers(us, ss, models.NewMemLoginThrottle("test-hmac-key"), &email.Memory{}, "https://gophr.com")
+			form := url.Values{"token": {tt.token}, "password": {tt.password}}
+			w := postForm(u.CompleteReset, "/reset", form)
+
+			if tt.wantLocation == "" {
+				if w.Code != http.StatusOK {
+					t.Errorf("status = %d, want the form shown again", w.Code)
+				}
+				if c := responseCookie(w, "remember_token"); c != nil {
+					t.Error("a failed reset signed the user in")
+				}
+				if user.Password != "old password" {
+					t.Error("a failed reset changed the password")
+				}
+				if _, err := ss.Lookup(old["old"]); err != nil {
+					t.Error("a failed reset logged the user out")
+				}
+				return
+			}
+			if got := w.Header().Get("Location"); w.Code != http.StatusFound || got != tt.wantLocation {
+				t.Errorf("response = %d to %q, want a redirect to %q", w.Code, got, tt.wantLocation)
+			}
+			signedIn := sessionUser(ss, responseCookie(w, "remember_token")) == user.ID
+			switch {
+			case tt.twoFactor && signedIn:
+				t.Error("the reset link signed the user in without the second factor")
+			case tt.twoFactor && responseCookie(w, twoFactorCookie) == nil:
+				t.Error("the login token for the second factor was not set")
+			case !tt.twoFactor && !signedIn:
+				t.Error("the user was not signed in after the reset")
+			}
+			// whoever knew the old password is logged out
+			if _, err := ss.Lookup(old["old"]); err != models.ErrNotFound {
+				t.Errorf("looking up the session from before the reset returned %v, want %v", err, models.ErrNotFound)
+			}
+			// the link only works once
+			w = postForm(u.CompleteReset, "/reset", form)
+			if w.Code != http.StatusOK || responseCookie(w, "remember_token") != nil {
+				t.Errorf("second use of the token got %d, want the form shown again", w.Code)
+			}
+		})
+	}
+}
+
+// signedUpUsers returns a fakeUsers knowing a single user, jon@example.com with the password "password"
+func signedUpUsers() (*fakeUsers, *models.User) {
+	user := &models.User{Name: "Jon", Email: "jon@example.com", Password: "password"}
+	user.ID = 1
+	return &fakeUsers{
+		byID:    map[uint]*models.User{user.ID: user},
+		byEmail: map[string]*models.User{user.Email: user},
+		byLogin: map[string]*models.User{},
+	}, user
+}
+
+func TestLogin(t *testing.T) {
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		failures int
+		wantCode int
+	}{
+		{"right password", "jon@example.com", "password", 0, http.StatusFound},
+		{"wrong password", "jon@example.com", "guess", 0, http.StatusOK},
+		{"unknown email", "nobody@example.com", "password", 0, http.StatusOK},
+		{"right password after a few failures", "jon@example.com", "password", 2, http.StatusFound},
+		{"right password after too many failures", "jon@example.com", "password", 3, http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			us, user := signedUpUsers()
+			ss := models.NewMemSessionService("test-hmac-key")
+			u := NewUsers(us, ss, models.NewMemLoginThrottle("test-hmac-key"), &email.Memory{}, "https://gophr.com")
+			for i := 0; i < tt.failures; i++ {
+				postForm(u.Login, "/login", url.Values{"email": {tt.email}, "password": {"guess"}})
+			}
+			w := postForm(u.Login, "/login", url.Values{"email": {tt.email}, "password": {tt.password}})
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+			c := responseCookie(w, "remember_token")
+			if tt.wantCode != http.StatusFound {
+				if c != nil {
+					t.Error("a failed login signed the user in")
+				}
+				return
+			}
+			if got := w.Header().Get("Location"); got != "/galleries" {
+				t.Errorf("redirected to %q, want /galleries", got)
+			}
+			if sessionUser(ss, c) != user.ID {
+				t.Error("the user was not signed in")
+			}
+		})
+	}
+}
+
+func TestLoginCancelsDeletion(t *testing.T) {
+	us, user := signedUpUsers()
+	due := time.Now().Add(time.Hour)
+	user.DeletionDueAt = &due
+	ss := models.NewMemSessionService("test-hmac-key")
+	u := NewUsers(us, ss, models.NewMemLoginThrottle("test-hmac-key"), &email.Memory{}, "https://gophr.com")
+
+	w := postForm(u.Login, "/login", url.Values{"email": {user.Email}, "password": {"password"}})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "no longer scheduled for deletion") {
+		t.Errorf("status = %d, want the account page telling the user their account is kept", w.Code)
+	}
+	if user.DeletionScheduled() {
+		t.Error("logging in did not cancel the deletion")
+	}
+	if sessionUser(ss, responseCookie(w, "remember_token")) != user.ID {
+		t.Error("the user was not signed in")
+	}
+}
+
+// testMailer keeps the messages it sends like email.Memory, with the sender filled in as the configured mailer does
+type testMailer struct {
+	email.Memory
+}
+
+func (m *testMailer) Send(msg *email.Message) error {
+	msg.From = "support@gophr.com"
+	return m.Memory.Send(msg)
+}
+
+// lockingThrottle is a LoginThrottle that lets every login through and locks the account on the first failure
+type lockingThrottle struct {
+	models.LoginThrottle
+}
+
+func (lockingThrottle) Check(email, ip string) error { return nil }
+
+func (lockingThrottle) Failed(email, ip string) (string, error) { return "unlock-token", nil }
+
+func TestLoginLocksAccount(t *testing.T) {
+	us, _ := signedUpUsers()
+	mailer := &testMailer{}
+	u := NewUsers(us, models.NewMemSessionService("test-hmac-key"), lockingThrottle{}, mailer, "https://gophr.com")
+
+	postForm(u.Login, "/login", url.Values{"email": {"nobody@example.com"}, "password": {"guess"}})
+	if n := len(mailer.Messages()); n != 0 {
+		t.Fatalf("locking an account nobody has sent %d emails, want none", n)
+	}
+	postForm(u.Login, "/login", url.Values{"email": {"jon@example.com"}, "password": {"guess"}})
+	msgs := mailer.Messages()
+	if len(msgs) != 1 || msgs[0].To[0] != "jon@example.com" {
+		t.Fatalf("sent %+v, want one email to jon@example.com", msgs)
+	}
+	if !strings.Contains(msgs[0].Text, "https://gophr.com/unlock?token=unlock-token") {
+		t.Errorf("the email does not link to the unlock token on the site:\n%s", msgs[0].Text)
+	}
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    string
+		code     string
+		signedIn bool
+	}{
+		{"right code", "", "123456", true},
+		{"wrong code", "", "654321", false},
+		{"unknown login", "forged", "123456", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			us, user := signedUpUsers()
+			user.TwoFactorEnabled = true
+			ss := models.NewMemSessionService("test-hmac-key")
+			u := NewUsers(us, ss, models.NewMemLoginThrottle("test-hmac-key"), &email.Memory{}, "https://gophr.com")
+
+			w := postForm(u.Login, "/login", url.Values{"email": {user.Email}, "password": {"password"}})
+			if got := w.Header().Get("Location"); w.Code != http.StatusFound || got != "/login/two-factor" {
+				t.Fatalf("response = %d to %q, want a redirect to the code form", w.Code, got)
+			}
+			if responseCookie(w, "remember_token") != nil {
+				t.Fatal("the password alone signed the user in")
+			}
+			c := responseCookie(w, twoFactorCookie)
+			if c == nil {
+				t.Fatal("the login token was not set")
+			}
+			if tt.token != "" {
+				c.Value = tt.token
+			}
+
+			w = postForm(u.TwoFactorLogin, "/login/two-factor", url.Values{"code": {tt.code}}, c)
+			if !tt.signedIn {
+				if w.Code != http.StatusOK || responseCookie(w, "remember_token") != nil {
+					t.Errorf("response = %d, want the form shown again without signing in", w.Code)
+				}
+				return
+			}
+			if got := w.Header().Get("Location"); w.Code != http.StatusFound || got != "/galleries" {
+				t.Errorf("response = %d to %q, want a redirect to /galleries", w.Code, got)
+			}
+			if sessionUser(ss, responseCookie(w, "remember_token")) != user.ID {
+				t.Error("the user was not signed in")
+			}
+			if tc := responseCookie(w, twoFactorCookie); tc == nil || tc.MaxAge >= 0 {
+				t.Error("the login token cookie was not cleared")
+			}
+			// the login token is used up
+			w = postForm(u.TwoFactorLogin, "/login/two-factor", url.Values{"code": {tt.code}}, c)
+			if responseCookie(w, "remember_token") != nil {
+				t.Error("the login token signed the user in twice")
+			}
+		})
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	tests := []struct {
+		name         string
+		revoke       string
+		wantStatus   int
+		wantLoggedIn bool
+	}{
+		{"another device", "phone", http.StatusOK, true},
+		{"this device", "laptop", http.StatusFound, false},
+		{"another user's session", "other", http.StatusNotFound, true},
+		{"missing session", "", http.StatusNotFound, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			us, user := signedUpUsers()
+			other := &models.User{Name: "Jane", Email: "jane@example.com"}
+			other.ID = 2
+			us.byID[other.ID] = other
+			ss := models.NewMemSessionService("test-hmac-key")
+			tokens := startSessions(t, ss, map[string]*models.User{"laptop": user, "phone": user, "other": other})
+			id := uint(999)
+			if tt.revoke != "" {
+				session, err := ss.Lookup(tokens[tt.revoke])
+				if err != nil {
+					t.Fatal(err)
+				}
+				id = session.ID
+			}
+
+			u := NewUsers(us, ss, models.NewMemLoginThrottle("test-hmac-key"), &email.Memory{}, "https://gophr.com")
+			userMw := middleware.User{UserService: us, SessionService: ss}
+			requireUserMw := middleware.RequireUser{}
+			r := mux.NewRouter()
+			r.HandleFunc("/account/sessions/{id:[0-9]+}/revoke", requireUserMw.ApplyFn(u.RevokeSession)).Methods("POST")
+			req := httptest.NewRequest("POST", fmt.Sprintf("/account/sessions/%d/revoke", id), nil)
+			req.AddCookie(&http.Cookie{Name: "remember_token", Value: tokens["laptop"]})
+			w := httptest.NewRecorder()
+			userMw.Apply(r).ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.revoke != "" {
+				_, err := ss.Lookup(tokens[tt.revoke])
+				if revoked := err == models.ErrNotFound; revoked != (tt.wantStatus != http.StatusNotFound) {
+					t.Errorf("session revoked = %v, want %v", revoked, !revoked)
+				}
+			}
+			_, err := ss.Lookup(tokens["laptop"])
+			if loggedIn := err == nil; loggedIn != tt.wantLoggedIn {
+				t.Errorf("this device logged in = %v, want %v", loggedIn, tt.wantLoggedIn)
+			}
+			if c := responseCookie(w, "remember_token"); (c != nil && c.MaxAge < 0) == tt.wantLoggedIn {
+				t.Errorf("remember_token cookie = %v, want it cleared only when this device is logged out", c)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package email
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNoRecipients is returned when a message is sent without anyone to send it to
+	ErrNoRecipients = errors.New("email: message has no recipients")
+
+	// ErrAddressInvalid is returned when the sender or a recipient is not a valid email address
+	ErrAddressInvalid = errors.New("email: address is not valid")
+)
+
+const (
+	// TransportSMTP delivers mail through an SMTP server
+	TransportSMTP = "smtp"
+
+	// TransportFile writes every message to a .eml file in a directory, for development
+	TransportFile = "file"
+
+	// TransportMemory keeps sent messages in memory, for tests
+	TransportMemory = "memory"
+)
+
+// Message is a single email. Text is required, HTML is sent as an alternative
+// version of the same content when it is set.
+type Message struct {
+	From    string
+	To      []string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer sends email messages
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+// Config holds the settings used to pick and set up a Mailer
+type Config struct {
+	Transport string     `json:"transport"`
+	From      string     `json:"from"`
+	Dir       string     `json:"dir"`
+	SMTP      SMTPConfig `json:"smtp"`
+}
+
+// DefaultConfig returns a config writing mail as files under mail/ on the local disk
+func DefaultConfig() Config {
+	return Config{
+		Transport: TransportFile,
+		From:      "Gophr <support@gophr.com>",
+		Dir:       "mail/",
+		SMTP: SMTPConfig{
+			Port: 587,
+		},
+	}
+}
+
+// LoadEnv overrides the settings in c with any GOPHR_MAIL_* and GOPHR_SMTP_* environment variables that are set
+func (c *Config) LoadEnv() error {
+	setFromEnv(&c.Transport, "GOPHR_MAIL_TRANSPORT")
+	setFromEnv(&c.From, "GOPHR_MAIL_FROM")
+	setFromEnv(&c.Dir, "GOPHR_MAIL_DIR")
+	setFromEnv(&c.SMTP.Host, "GOPHR_SMTP_HOST")
+	setFromEnv(&c.SMTP.Username, "GOPHR_SMTP_USERNAME")
+	setFromEnv(&c.SMTP.Password, "GOPHR_SMTP_PASSWORD")
+	if v, ok := os.LookupEnv("GOPHR_SMTP_PORT"); ok {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return errors.New("email: GOPHR_SMTP_PORT must be a number")
+		}
+		c.SMTP.Port = port
+	}
+	return nil
+}
+
+func setFromEnv(dst *string, name string) {
+	if v, ok := os.LookupEnv(name); ok {
+		*dst = v
+	}
+}
+
+// New creates the Mailer selected by the config. Messages sent without a From
+// address are sent from the configured one.
+func New(c Config) (Mailer, error) {
+	var m Mailer
+	switch c.Transport {
+	case TransportFile, "":
+		fd, err := NewFileDrop(c.Dir)
+		if err != nil {
+			return nil, err
+		}
+		m = fd
+	case TransportSMTP:
+		m = NewSMTP(c.SMTP)
+	case TransportMemory:
+		m = &Memory{}
+	default:
+		return nil, fmt.Errorf("email: unknown transport %q", c.Transport)
+	}
+	return &defaultFrom{
+		Mailer: m,
+		from:   c.From,
+	}, nil
+}
+
+type defaultFrom struct {
+	Mailer
+	from string
+}
+
+func (df *defaultFrom) Send(msg *Message) error {
+	if msg.From == "" {
+		m := *msg
+		m.From = df.from
+		msg = &m
+	}
+	return df.Mailer.Send(msg)
+}
+
+// envelope returns the bare sender and recipient addresses used to deliver the message
+func (msg *Message) envelope() (string, []string, error) {
+	if len(msg.To) == 0 {
+		return "", nil, ErrNoRecipients
+	}
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return "", nil, ErrAddressInvalid
+	}
+	to := make([]string, 0, len(msg.To))
+	for _, addr := range msg.To {
+		a, err := mail.ParseAddress(addr)
+		if err != nil {
+			return "", nil, ErrAddressInvalid
+		}
+		to = append(to, a.Address)
+	}
+	return from.Address, to, nil
+}
+
+// Bytes formats the message as a MIME email ready to be handed to an SMTP server or saved as a .eml file
+func (msg *Message) Bytes() ([]byte, error) {
+	if _, _, err := msg.envelope(); err != nil {
+		return nil, err
+	}
+	// the addresses are re-formatted after parsing so that nothing a user typed can add headers
+	from, _ := mail.ParseAddress(msg.From)
+	to := make([]string, 0, len(msg.To))
+	for _, addr := range msg.To {
+		a, _ := mail.ParseAddress(addr)
+		to = append(to, a.String())
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from.String())
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+
+	if msg.HTML == "" {
+		fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n")
+		fmt.Fprintf(&buf, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		if err := writeQuotedPrintable(&buf, msg.Text); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", mw.Boundary())
+	parts := []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	}
+	for _, p := range parts {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(w, p.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, body string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
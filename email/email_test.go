@@ -0,0 +1,318 @@
+package email
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMessageBytes(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     Message
+		wantErr error
+		// wantHeaders are checked against the parsed message
+		wantHeaders map[string]string
+		// wantText has the CRLF line endings mail is sent with
+		wantText string
+		wantHTML string
+	}{
+		{
+			name: "plain text",
+			msg:  Message{From: "Gophr <support@gophr.com>", To: []string{"jon@example.com"}, Subject: "Hello", Text: "Hi Jon\n"},
+			wantHeaders: map[string]string{
+				"From":         `"Gophr" <support@gophr.com>`,
+				"To":           "<jon@example.com>",
+				"Subject":      "Hello",
+				"Content-Type": "text/plain; charset=utf-8",
+			},
+			wantText: "Hi Jon\r\n",
+		},
+		{
+			name:        "html alternative",
+			msg:         Message{From: "support@gophr.com", To: []string{"jon@example.com"}, Subject: "Hello", Text: "Hi Jon\n", HTML: "<p>Hi Jon</p>"},
+			wantHeaders: map[string]string{"Subject": "Hello"},
+			wantText:    "Hi Jon\r\n",
+			wantHTML:    "<p>Hi Jon</p>",
+		},
+		{
+			name:        "non-ASCII subject",
+			msg:         Message{From: "support@gophr.com", To: []string{"jon@example.com"}, Subject: "Grüße", Text: "Hallo\n"},
+			wantHeaders: map[string]string{"Subject": "Grüße"},
+			wantText:    "Hallo\r\n",
+		},
+		{
+			name:        "header injection in the subject",
+			msg:         Message{From: "support@gophr.com", To: []string{"jon@example.com"}, Subject: "Hi\r\nBcc: eve@example.com", Text: "Hi\n"},
+			wantHeaders: map[string]string{"Bcc": ""},
+			wantText:    "Hi\r\n",
+		},
+		{
+			name:    "header injection in an address",
+			msg:     Message{From: "support@gophr.com", To: []string{"jon@example.com\r\nBcc: eve@example.com"}, Text: "Hi\n"},
+			wantErr: ErrAddressInvalid,
+		},
+		{
+			name:    "no recipients",
+			msg:     Message{From: "support@gophr.com", Text: "Hi\n"},
+			wantErr: ErrNoRecipients,
+		},
+		{
+			name:    "invalid sender",
+			msg:     Message{From: "gophr", To: []string{"jon@example.com"}, Text: "Hi\n"},
+			wantErr: ErrAddressInvalid,
+		},
+	}
+	dec := new(mime.WordDecoder)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.msg.Bytes()
+			if err != tt.wantErr {
+				t.Fatalf("Bytes() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			m, err := mail.ReadMessage(bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tt.wantHeaders {
+				got, err := dec.DecodeHeader(m.Header.Get(name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != want {
+					t.Errorf("%s header = %q, want %q", name, got, want)
+				}
+			}
+			text, html := readBodies(t, m)
+			if text != tt.wantText {
+				t.Errorf("text = %q, want %q", text, tt.wantText)
+			}
+			if html != tt.wantHTML {
+				t.Errorf("html = %q, want %q", html, tt.wantHTML)
+			}
+		})
+	}
+}
+
+// readBodies returns the decoded text and html versions of a message
+func readBodies(t *testing.T, m *mail.Message) (string, string) {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType == "text/plain" {
+		return readQuotedPrintable(t, m.Body), ""
+	}
+	var text, html string
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return text, html
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the multipart reader already undoes the quoted-printable encoding
+		b, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(p.Header.Get("Content-Type"), "text/html") {
+			html = string(b)
+		} else {
+			text = string(b)
+		}
+	}
+}
+
+func readQuotedPrintable(t *testing.T, r io.Reader) string {
+	t.Helper()
+	b, err := ioutil.ReadAll(quotedprintable.NewReader(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		want    Mailer
+		wantErr bool
+	}{
+		{name: "file", config: Config{Transport: TransportFile, Dir: t.TempDir()}, want: &FileDrop{}},
+		{name: "default", config: Config{Dir: t.TempDir()}, want: &FileDrop{}},
+		{name: "smtp", config: Config{Transport: TransportSMTP, SMTP: SMTPConfig{Host: "localhost", Port: 25}}, want: &SMTP{}},
+		{name: "memory", config: Config{Transport: TransportMemory}, want: &Memory{}},
+		{name: "unknown", config: Config{Transport: "pigeon"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := New(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, want an error: %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := m.(*defaultFrom).Mailer; reflect.TypeOf(got) != reflect.TypeOf(tt.want) {
+				t.Errorf("New() = %T, want %T", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultFrom(t *testing.T) {
+	m, err := New(Config{Transport: TransportMemory, From: "Gophr <support@gophr.com>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := []*Message{
+		{To: []string{"jon@example.com"}, Text: "Hi\n"},
+		{From: "other@gophr.com", To: []string{"jon@example.com"}, Text: "Hi\n"},
+	}
+	for _, msg := range msgs {
+		if err := m.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if msgs[0].From != "" {
+		t.Error("Send() changed the message it was given")
+	}
+	sent := m.(*defaultFrom).Mailer.(*Memory).Messages()
+	if sent[0].From != "Gophr <support@gophr.com>" || sent[1].From != "other@gophr.com" {
+		t.Errorf("sent from %q and %q, want the default only when none was given", sent[0].From, sent[1].From)
+	}
+}
+
+func TestFileDrop(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	fd, err := NewFileDrop(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &Message{From: "support@gophr.com", To: []string{"jon@example.com"}, Subject: "Hello", Text: "Hi\n"}
+	for i := 0; i < 2; i++ {
+		if err := fd.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fd.Send(&Message{From: "support@gophr.com", Text: "Hi\n"}); err != ErrNoRecipients {
+		t.Errorf("Send() without recipients error = %v, want %v", err, ErrNoRecipients)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("%d files written, want 2", len(files))
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	m, err := mail.ReadMessage(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Header.Get("Subject"); got != "Hello" {
+		t.Errorf("Subject = %q, want %q", got, "Hello")
+	}
+}
+
+func TestMemory(t *testing.T) {
+	var m Memory
+	msg := &Message{From: "support@gophr.com", To: []string{"jon@example.com"}, Text: "Hi\n"}
+	if err := m.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+	msg.To[0] = "eve@example.com"
+	if err := m.Send(&Message{From: "support@gophr.com", Text: "Hi\n"}); err != ErrNoRecipients {
+		t.Errorf("Send() without recipients error = %v, want %v", err, ErrNoRecipients)
+	}
+	sent := m.Messages()
+	if len(sent) != 1 || sent[0].To[0] != "jon@example.com" {
+		t.Errorf("Messages() = %+v, want a copy of the one message sent", sent)
+	}
+	m.Reset()
+	if len(m.Messages()) != 0 {
+		t.Error("Messages() after Reset() is not empty")
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"plain" + TextExt: `{{define "subject"}}Hello {{.Name}}{{end}}{{define "text"}}
+Hi {{.Name}}, follow {{.URL}}
+{{end}}`,
+		"rich" + TextExt: `{{define "subject"}}Hello {{.Name}}{{end}}{{define "text"}}Hi {{.Name}}{{end}}`,
+		"rich" + HTMLExt: `{{define "html"}}<p>Hi {{.Name}}</p>{{end}}`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(old string) { TemplateDir = old }(TemplateDir)
+	TemplateDir = dir + "/"
+
+	data := struct{ Name, URL string }{"<Jon>", "https://gophr.com/reset?token=a&b"}
+	tests := []struct {
+		name string
+		want Message
+	}{
+		{"plain", Message{Subject: "Hello <Jon>", Text: "Hi <Jon>, follow https://gophr.com/reset?token=a&b\n"}},
+		// only the html version escapes what it is given
+		{"rich", Message{Subject: "Hello <Jon>", Text: "Hi <Jon>\n", HTML: "<p>Hi &lt;Jon&gt;</p>"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewTemplate(tt.name).Message("jon@example.com", data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got.To) != 1 || got.To[0] != "jon@example.com" {
+				t.Errorf("To = %q, want the recipient", got.To)
+			}
+			if got.Subject != tt.want.Subject || got.Text != tt.want.Text || got.HTML != tt.want.HTML {
+				t.Errorf("Message() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+// TestTemplates parses every email the site sends, so a broken template fails here rather than at startup
+func TestTemplates(t *testing.T) {
+	defer func(old string) { TemplateDir = old }(TemplateDir)
+	TemplateDir = "../" + TemplateDir
+	files, err := filepath.Glob(TemplateDir + "*" + TextExt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no email templates found")
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), TextExt)
+		t.Run(name, func(t *testing.T) {
+			NewTemplate(name)
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package email
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"gophr.com/rand"
+)
+
+// FileDrop is a Mailer that writes every message to a .eml file instead of
+// delivering it, so mail can be read with any mail client during development
+type FileDrop struct {
+	dir string
+}
+
+// NewFileDrop creates a Mailer writing into dir, creating the directory if needed
+func NewFileDrop(dir string) (*FileDrop, error) {
+	if dir == "" {
+		dir = DefaultConfig().Dir
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileDrop{
+		dir: dir,
+	}, nil
+}
+
+// Send writes the message to a new file named after the time it was sent
+func (fd *FileDrop) Send(msg *Message) error {
+	b, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	suffix, err := rand.String(6)
+	if err != nil {
+		return err
+	}
+	name := time.Now().Format("20060102-150405.000000") + "-" + suffix + ".eml"
+	f, err := os.OpenFile(filepath.Join(fd.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+var _ Mailer = &FileDrop{}
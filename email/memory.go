@@ -0,0 +1,41 @@
+package email
+
+import (
+	"sync"
+)
+
+// Memory is a Mailer that keeps every message it is asked to send, for tests
+// that need to look at the mail an action produced
+type Memory struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+// Send checks that the message could be delivered and records a copy of it
+func (m *Memory) Send(msg *Message) error {
+	if _, err := msg.Bytes(); err != nil {
+		return err
+	}
+	sent := *msg
+	sent.To = append([]string(nil), msg.To...)
+	m.mu.Lock()
+	m.messages = append(m.messages, sent)
+	m.mu.Unlock()
+	return nil
+}
+
+// Messages returns the messages sent so far, oldest first
+func (m *Memory) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+// Reset forgets every message sent so far
+func (m *Memory) Reset() {
+	m.mu.Lock()
+	m.messages = nil
+	m.mu.Unlock()
+}
+
+var _ Mailer = &Memory{}
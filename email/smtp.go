@@ -0,0 +1,111 @@
+package email
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+// smtpTimeout bounds a whole delivery, from dialing the server to its answer to QUIT.
+// Mail is sent while a request is being handled, so a server that stops answering
+// must not hold on to it.
+const smtpTimeout = 30 * time.Second
+
+// ErrAuthUnsupported is returned when credentials are configured but the SMTP server offers no way to use them
+var ErrAuthUnsupported = errors.New("email: SMTP server doesn't support AUTH")
+
+// SMTPConfig holds the settings of the SMTP transport
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// SMTP is a Mailer that hands messages to an SMTP server. STARTTLS is used
+// whenever the server offers it.
+type SMTP struct {
+	host    string
+	addr    string
+	auth    smtp.Auth
+	timeout time.Duration
+}
+
+// NewSMTP creates a Mailer delivering through the server in the config. No
+// authentication is attempted when the username is empty.
+func NewSMTP(c SMTPConfig) *SMTP {
+	s := &SMTP{
+		host:    c.Host,
+		addr:    net.JoinHostPort(c.Host, strconv.Itoa(c.Port)),
+		timeout: smtpTimeout,
+	}
+	if c.Username != "" {
+		s.auth = smtp.PlainAuth("", c.Username, c.Password, c.Host)
+	}
+	return s
+}
+
+// Send delivers the message to the SMTP server. It does what smtp.SendMail does, on a
+// connection with a deadline.
+func (s *SMTP) Send(msg *Message) error {
+	from, to, err := msg.envelope()
+	if err != nil {
+		return err
+	}
+	b, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", s.addr, s.timeout)
+	if err != nil {
+		return err
+	}
+	// the deadline carries over to the TLS connection STARTTLS wraps conn in
+	if err := conn.SetDeadline(time.Now().Add(s.timeout)); err != nil {
+		conn.Close()
+		return err
+	}
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+			return err
+		}
+	}
+	if s.auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return ErrAuthUnsupported
+		}
+		if err := c.Auth(s.auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+var _ Mailer = &SMTP{}
@@ -0,0 +1,181 @@
+package email
+
+import (
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is an SMTP server that understands just enough of the protocol to take a message
+type fakeSMTP struct {
+	ln net.Listener
+	// reply overrides the reply to a command, keyed by its verb
+	reply map[string]string
+	// stall makes the server accept connections and never say anything
+	stall bool
+
+	done     chan struct{}
+	from     string
+	rcpts    []string
+	data     string
+	commands []string
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return &fakeSMTP{ln: ln, reply: map[string]string{}, done: make(chan struct{})}
+}
+
+// config returns the settings to reach the server with
+func (f *fakeSMTP) config() SMTPConfig {
+	host, port, _ := net.SplitHostPort(f.ln.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return SMTPConfig{Host: host, Port: p}
+}
+
+// serve handles a single connection
+func (f *fakeSMTP) serve() {
+	defer close(f.done)
+	conn, err := f.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if f.stall {
+		// hold the connection open until the client gives up
+		conn.Read(make([]byte, 1))
+		return
+	}
+	tc := textproto.NewConn(conn)
+	tc.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.Fields(line + " ")[0])
+		f.commands = append(f.commands, verb)
+		if reply, ok := f.reply[verb]; ok {
+			tc.PrintfLine("%s", reply)
+			continue
+		}
+		switch verb {
+		case "EHLO":
+			tc.PrintfLine("250-localhost")
+			tc.PrintfLine("250 8BITMIME")
+		case "MAIL":
+			f.from = angleAddr(line)
+			tc.PrintfLine("250 OK")
+		case "RCPT":
+			f.rcpts = append(f.rcpts, angleAddr(line))
+			tc.PrintfLine("250 OK")
+		case "DATA":
+			tc.PrintfLine("354 go ahead")
+			lines, err := tc.ReadDotLines()
+			if err != nil {
+				return
+			}
+			f.data = strings.Join(lines, "\n")
+			tc.PrintfLine("250 OK")
+		case "QUIT":
+			tc.PrintfLine("221 bye")
+			return
+		default:
+			tc.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+// angleAddr returns the address between the angle brackets of a MAIL or RCPT command
+func angleAddr(line string) string {
+	start, end := strings.Index(line, "<"), strings.Index(line, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	return line[start+1 : end]
+}
+
+func TestSMTPSend(t *testing.T) {
+	msg := &Message{
+		From:    "Gophr <support@gophr.com>",
+		To:      []string{"Jon <jon@example.com>", "jane@example.com"},
+		Subject: "Hello",
+		Text:    "Hi there\n",
+	}
+	tests := []struct {
+		name     string
+		reply    map[string]string
+		username string
+		wantErr  bool
+		// wantAuthErr is set when the credentials can't be used with the server
+		wantAuthErr bool
+	}{
+		{name: "delivered"},
+		{name: "recipient rejected", reply: map[string]string{"RCPT": "550 no such user"}, wantErr: true},
+		{name: "message rejected", reply: map[string]string{"DATA": "554 no thanks"}, wantErr: true},
+		{name: "no AUTH offered", username: "gophr", wantErr: true, wantAuthErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeSMTP(t)
+			if tt.reply != nil {
+				f.reply = tt.reply
+			}
+			go f.serve()
+			c := f.config()
+			c.Username = tt.username
+			err := NewSMTP(c).Send(msg)
+			<-f.done
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Send() error = %v, want an error: %v", err, tt.wantErr)
+			}
+			if tt.wantAuthErr && err != ErrAuthUnsupported {
+				t.Errorf("Send() error = %v, want %v", err, ErrAuthUnsupported)
+			}
+			if err != nil {
+				return
+			}
+			if f.from != "support@gophr.com" {
+				t.Errorf("MAIL FROM %q, want the bare sender address", f.from)
+			}
+			if strings.Join(f.rcpts, ",") != "jon@example.com,jane@example.com" {
+				t.Errorf("RCPT TO %q, want the bare recipient addresses", f.rcpts)
+			}
+			if !strings.Contains(f.data, "Subject: Hello") || !strings.Contains(f.data, "Hi there") {
+				t.Errorf("DATA = %q, want the formatted message", f.data)
+			}
+			if last := f.commands[len(f.commands)-1]; last != "QUIT" {
+				t.Errorf("last command %s, want QUIT", last)
+			}
+		})
+	}
+}
+
+func TestSMTPSendStalledServer(t *testing.T) {
+	f := newFakeSMTP(t)
+	f.stall = true
+	go f.serve()
+	s := NewSMTP(f.config())
+	s.timeout = 100 * time.Millisecond
+
+	start := time.Now()
+	err := s.Send(&Message{From: "support@gophr.com", To: []string{"jon@example.com"}, Text: "Hi"})
+	if err == nil {
+		t.Fatal("Send() to a server that never answers succeeded")
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Send() error = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Send() took %v to give up", elapsed)
+	}
+	f.ln.Close()
+}
@@ -0,0 +1,68 @@
+package email
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"os"
+	"strings"
+	texttemplate "text/template"
+)
+
+var (
+	// TemplateDir has the path to the directory containing the email templates
+	TemplateDir = "views/emails/"
+
+	// TextExt has the extension of the plain text email templates
+	TextExt = ".gotxt"
+
+	// HTMLExt has the extension of the html email templates
+	HTMLExt = ".gohtml"
+)
+
+// Template holds the processed templates of one kind of email. The text file
+// defines a "subject" and a "text" template, the optional html file defines "html".
+type Template struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// NewTemplate processes the text and html templates of an email, name is the file name without extension
+func NewTemplate(name string) *Template {
+	text, err := texttemplate.ParseFiles(TemplateDir + name + TextExt)
+	if err != nil {
+		panic(err)
+	}
+	t := &Template{
+		text: text,
+	}
+	htmlFile := TemplateDir + name + HTMLExt
+	if _, err := os.Stat(htmlFile); err == nil {
+		t.html, err = htmltemplate.ParseFiles(htmlFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return t
+}
+
+// Message executes the templates with data and returns an email addressed to the recipient
+func (t *Template) Message(to string, data interface{}) (*Message, error) {
+	var subject, text, html bytes.Buffer
+	if err := t.text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err := t.text.ExecuteTemplate(&text, "text", data); err != nil {
+		return nil, err
+	}
+	if t.html != nil {
+		if err := t.html.ExecuteTemplate(&html, "html", data); err != nil {
+			return nil, err
+		}
+	}
+	return &Message{
+		To:      []string{to},
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    strings.TrimSpace(text.String()) + "\n",
+		HTML:    html.String(),
+	}, nil
+}
@@ -0,0 +1,49 @@
+package hash
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestHMACHash(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   string
+		input string
+		want  string
+	}{
+		// test case 2 of RFC 4231, base64 encoded
+		{"RFC 4231", "Jefe", "what do ya want for nothing?", "W9zBRr9gdU5qBCQmCJV1x1oAPwidJzmDnexYuWTsOEM="},
+		{"empty", "", "", "thNnmggU2ex3L5XXeMNfxf8Wl8STcVZTxscSFEKSxa0="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHMAC(tt.key)
+			// a second call must not be affected by the first
+			for i := 0; i < 2; i++ {
+				if got := h.Hash(tt.input); got != tt.want {
+					t.Errorf("Hash(%q) = %q, want %q", tt.input, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestHMACHashConcurrently(t *testing.T) {
+	h := NewHMAC("Jefe")
+	want := h.Hash("what do ya want for nothing?")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if got := h.Hash("what do ya want for nothing?"); got != want {
+					t.Errorf("Hash() = %q, want %q", got, want)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,598 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"strings"
+	"time"
+)
+
+// EXIF tags we read or scrub. IFD0 points at the Exif and GPS IFDs.
+const (
+	tagMake               uint16 = 0x010F
+	tagModel              uint16 = 0x0110
+	tagDateTime           uint16 = 0x0132
+	tagExifIFD            uint16 = 0x8769
+	tagGPSIFD             uint16 = 0x8825
+	tagCameraSerialNumber uint16 = 0xC62F
+	tagExposureTime       uint16 = 0x829A
+	tagFNumber            uint16 = 0x829D
+	tagISO                uint16 = 0x8827
+	tagDateTimeOriginal   uint16 = 0x9003
+	tagFocalLength        uint16 = 0x920A
+	tagMakerNote          uint16 = 0x927C
+	tagImageUniqueID      uint16 = 0xA420
+	tagBodySerialNumber   uint16 = 0xA431
+	tagLensModel          uint16 = 0xA434
+	tagLensSerialNumber   uint16 = 0xA435
+	tagGPSLatitudeRef     uint16 = 0x0001
+	tagGPSLatitude        uint16 = 0x0002
+	tagGPSLongitudeRef    uint16 = 0x0003
+	tagGPSLongitude       uint16 = 0x0004
+)
+
+// exifDateLayout is how EXIF writes timestamps, without a time zone
+const exifDateLayout = "2006:01:02 15:04:05"
+
+// identifyingTags are scrubbed from every publicly served image since they can tie photos to a device
+var identifyingTags = map[uint16]bool{
+	tagCameraSerialNumber: true,
+	tagMakerNote:          true,
+	tagImageUniqueID:      true,
+	tagBodySerialNumber:   true,
+	tagLensSerialNumber:   true,
+}
+
+// Metadata holds the EXIF fields worth showing next to a photo
+type Metadata struct {
+	TakenAt      time.Time
+	Make         string
+	Model        string
+	LensModel    string
+	ExposureTime string
+	FNumber      float64
+	FocalLength  float64
+	ISO          int
+
+	HasLocation bool
+	Latitude    float64
+	Longitude   float64
+}
+
+// ReadMetadata parses the EXIF block of a JPEG, PNG or WebP image.
+// Images without EXIF yield an empty Metadata.
+func ReadMetadata(data []byte) *Metadata {
+	var m Metadata
+	start, end := exifBlock(data)
+	if start < 0 {
+		return &m
+	}
+	t, ok := newTIFF(data[start:end])
+	if !ok {
+		return &m
+	}
+	ifd0 := t.ifd(t.first)
+	m.Make = t.ascii(ifd0[tagMake])
+	m.Model = t.ascii(ifd0[tagModel])
+	m.TakenAt = parseExifDate(t.ascii(ifd0[tagDateTime]))
+
+	if e, ok := ifd0[tagExifIFD]; ok {
+		exif := t.ifd(t.uintAt(e, 0))
+		if taken := parseExifDate(t.ascii(exif[tagDateTimeOriginal])); !taken.IsZero() {
+			m.TakenAt = taken
+		}
+		m.LensModel = t.ascii(exif[tagLensModel])
+		m.ISO = int(t.uintAt(exif[tagISO], 0))
+		m.FNumber = t.decimal(exif[tagFNumber])
+		m.FocalLength = t.decimal(exif[tagFocalLength])
+		if num, den := t.rational(exif[tagExposureTime], 0); den != 0 {
+			m.ExposureTime = formatExposure(num, den)
+		}
+	}
+
+	if e, ok := ifd0[tagGPSIFD]; ok {
+		gps := t.ifd(t.uintAt(e, 0))
+		lat, latOK := t.degrees(gps[tagGPSLatitude])
+		long, longOK := t.degrees(gps[tagGPSLongitude])
+		if latOK && longOK {
+			if t.ascii(gps[tagGPSLatitudeRef]) == "S" {
+				lat = -lat
+			}
+			if t.ascii(gps[tagGPSLongitudeRef]) == "W" {
+				long = -long
+			}
+			m.HasLocation = true
+			m.Latitude, m.Longitude = lat, long
+		}
+	}
+	return &m
+}
+
+// StripMetadata returns a copy of a JPEG, PNG, GIF or WebP image with serial numbers, maker
+// notes and, unless keepLocation is set, GPS coordinates wiped from its EXIF block. The block
+// is scrubbed in place so none of the offsets inside it change. XMP packets are dropped from
+// every format since they can repeat the same details, location included.
+func StripMetadata(data []byte, keepLocation bool) []byte {
+	var out []byte
+	switch {
+	case isJPEG(data):
+		out = jpegDropXMP(data)
+	case isPNG(data):
+		out = pngDropXMP(data)
+	case isGIF(data):
+		out = gifDropXMP(data)
+	case isWebP(data):
+		out = webpDropXMP(data)
+	default:
+		out = append([]byte(nil), data...)
+	}
+	start, end := exifBlock(out)
+	if start < 0 {
+		return out
+	}
+	t, ok := newTIFF(out[start:end])
+	if !ok {
+		return out
+	}
+	ifd0 := t.ifd(t.first)
+	t.scrub(ifd0)
+	if e, ok := ifd0[tagExifIFD]; ok {
+		t.scrub(t.ifd(t.uintAt(e, 0)))
+	}
+	if e, ok := ifd0[tagGPSIFD]; ok && !keepLocation {
+		t.clearIFD(t.uintAt(e, 0))
+	}
+	if isPNG(out) {
+		// the CRC of the eXIf chunk covers its type and data
+		crc := crc32.ChecksumIEEE(out[start-4 : end])
+		binary.BigEndian.PutUint32(out[end:], crc)
+	}
+	return out
+}
+
+func parseExifDate(s string) time.Time {
+	t, err := time.Parse(exifDateLayout, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func formatExposure(num, den uint32) string {
+	if num == 0 {
+		return ""
+	}
+	if num >= den {
+		return strings.TrimSuffix(fmt.Sprintf("%.1f", float64(num)/float64(den)), ".0") + "s"
+	}
+	return fmt.Sprintf("1/%.0fs", float64(den)/float64(num))
+}
+
+/*
+	*************************************
+	Locating the EXIF block in containers
+	*************************************
+*/
+
+func isJPEG(data []byte) bool {
+	return len(data) > 2 && data[0] == 0xFF && data[1] == 0xD8
+}
+
+func isPNG(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n"))
+}
+
+func isGIF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("GIF87a")) || bytes.HasPrefix(data, []byte("GIF89a"))
+}
+
+func isWebP(data []byte) bool {
+	return len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP"
+}
+
+// exifBlock returns where the TIFF structure holding the EXIF data starts and ends, or -1, -1
+func exifBlock(data []byte) (int, int) {
+	switch {
+	case isJPEG(data):
+		return jpegExif(data)
+	case isPNG(data):
+		return pngExif(data)
+	case isWebP(data):
+		return webpExif(data)
+	}
+	return -1, -1
+}
+
+// jpegSegments calls fn with the marker and payload bounds of each segment before the image data
+func jpegSegments(data []byte, fn func(marker byte, start, end int) bool) {
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return
+		}
+		marker := data[i+1]
+		// start of scan, the image data follows so there is no more metadata
+		if marker == 0xDA {
+			return
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		start, end := i+4, i+2+length
+		if length < 2 || end > len(data) {
+			return
+		}
+		if !fn(marker, start, end) {
+			return
+		}
+		i = end
+	}
+}
+
+func jpegExif(data []byte) (int, int) {
+	s, e := -1, -1
+	jpegSegments(data, func(marker byte, start, end int) bool {
+		if marker == 0xE1 && bytes.HasPrefix(data[start:end], []byte("Exif\x00\x00")) {
+			s, e = start+6, end
+			return false
+		}
+		return true
+	})
+	return s, e
+}
+
+// jpegDropXMP returns a copy of a JPEG without its APP1 XMP segments
+func jpegDropXMP(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+	last := 2
+	jpegSegments(data, func(marker byte, start, end int) bool {
+		if marker == 0xE1 && bytes.HasPrefix(data[start:end], []byte("http://ns.adobe.com/xap/1.0/")) {
+			out = append(out, data[last:start-4]...)
+			last = end
+		}
+		return true
+	})
+	return append(out, data[last:]...)
+}
+
+// pngXMPKeywords are the keywords of the text chunks XMP packets are kept in, the second is ImageMagick's
+var pngXMPKeywords = map[string]bool{
+	"XML:com.adobe.xmp":    true,
+	"Raw profile type xmp": true,
+}
+
+// pngDropXMP returns a copy of a PNG without the text chunks holding XMP packets
+func pngDropXMP(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:8]...)
+	last := 8
+	for i := 8; i+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		start, end := i+8, i+8+length
+		if length < 0 || end+4 > len(data) {
+			break
+		}
+		switch string(data[i+4 : i+8]) {
+		case "iTXt", "tEXt", "zTXt":
+			keyword := data[start:end]
+			if k := bytes.IndexByte(keyword, 0); k >= 0 {
+				keyword = keyword[:k]
+			}
+			if pngXMPKeywords[string(keyword)] {
+				out = append(out, data[last:i]...)
+				last = end + 4
+			}
+		}
+		i = end + 4
+	}
+	return append(out, data[last:]...)
+}
+
+func pngExif(data []byte) (int, int) {
+	for i := 8; i+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		start, end := i+8, i+8+length
+		if length < 0 || end+4 > len(data) {
+			break
+		}
+		if string(data[i+4:i+8]) == "eXIf" {
+			return start, end
+		}
+		i = end + 4
+	}
+	return -1, -1
+}
+
+func webpExif(data []byte) (int, int) {
+	for i := 12; i+8 <= len(data); {
+		length := int(binary.LittleEndian.Uint32(data[i+4:]))
+		start, end := i+8, i+8+length
+		if length < 0 || end > len(data) {
+			break
+		}
+		if string(data[i:i+4]) == "EXIF" {
+			// some encoders keep the JPEG style prefix
+			if bytes.HasPrefix(data[start:end], []byte("Exif\x00\x00")) {
+				start += 6
+			}
+			return start, end
+		}
+		i = end + end%2
+	}
+	return -1, -1
+}
+
+// webpDropXMP returns a copy of a WebP without its XMP chunk, with the sizes and flags
+// that tell about it updated to match
+func webpDropXMP(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:12]...)
+	vp8x := -1
+	for i := 12; i+8 <= len(data); {
+		length := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + length
+		if length < 0 || end > len(data) {
+			// keep whatever we cannot make sense of as it is
+			out = append(out, data[i:]...)
+			break
+		}
+		next := end + end%2
+		if next > len(data) {
+			next = len(data)
+		}
+		switch string(data[i : i+4]) {
+		case "XMP ":
+		case "VP8X":
+			vp8x = len(out)
+			out = append(out, data[i:next]...)
+		default:
+			out = append(out, data[i:next]...)
+		}
+		i = next
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	if vp8x >= 0 && vp8x+8 < len(out) {
+		// the XMP flag of the extended header
+		out[vp8x+8] &^= 0x04
+	}
+	return out
+}
+
+// gifXMPApp is the identifier and authentication code of the application extension holding XMP
+var gifXMPApp = []byte("XMP DataXMP")
+
+// gifDropXMP returns a copy of a GIF without its XMP application extension. Images that
+// cannot be walked to the end are returned unchanged.
+func gifDropXMP(data []byte) []byte {
+	i := 13 // header and logical screen descriptor
+	if len(data) < i {
+		return append([]byte(nil), data...)
+	}
+	if flags := data[10]; flags&0x80 != 0 {
+		i += 3 << (flags&0x07 + 1) // global color table
+	}
+	if i > len(data) {
+		return append([]byte(nil), data...)
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:i]...)
+	for i < len(data) {
+		var end int
+		var ok, drop bool
+		switch data[i] {
+		case 0x3B: // trailer
+			return append(out, data[i:]...)
+		case 0x21: // extension: label, then data sub-blocks
+			app := data[i+1:]
+			drop = len(app) > 1+len(gifXMPApp) && app[0] == 0xFF &&
+				app[1] == byte(len(gifXMPApp)) && bytes.Equal(app[2:2+len(gifXMPApp)], gifXMPApp)
+			end, ok = gifSkipSubBlocks(data, i+2)
+		case 0x2C: // image descriptor, optional local color table, LZW code size, data sub-blocks
+			if i+10 > len(data) {
+				break
+			}
+			j := i + 10
+			if flags := data[i+9]; flags&0x80 != 0 {
+				j += 3 << (flags&0x07 + 1)
+			}
+			end, ok = gifSkipSubBlocks(data, j+1)
+		}
+		if !ok {
+			return append([]byte(nil), data...)
+		}
+		if !drop {
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return append([]byte(nil), data...)
+}
+
+// gifSkipSubBlocks returns where the data sub-blocks starting at i end, past their terminator
+func gifSkipSubBlocks(data []byte, i int) (int, bool) {
+	for i < len(data) {
+		size := int(data[i])
+		i++
+		if size == 0 {
+			return i, true
+		}
+		i += size
+	}
+	return 0, false
+}
+
+/*
+	*****************************
+	Reading the TIFF structure
+	*****************************
+*/
+
+// tiff reads the IFDs of an EXIF block
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+	first uint32
+}
+
+// ifdEntry is a tag of an IFD, value points at where its value bytes are in the block
+type ifdEntry struct {
+	offset uint32
+	typ    uint16
+	count  uint32
+	value  uint32
+}
+
+// typeSizes holds the size in bytes of each TIFF field type
+var typeSizes = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+func newTIFF(data []byte) (*tiff, bool) {
+	if len(data) < 8 {
+		return nil, false
+	}
+	t := tiff{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, false
+	}
+	if t.order.Uint16(data[2:]) != 42 {
+		return nil, false
+	}
+	t.first = t.order.Uint32(data[4:])
+	return &t, true
+}
+
+func (t *tiff) inBounds(offset, size uint32) bool {
+	return uint64(offset)+uint64(size) <= uint64(len(t.data))
+}
+
+// ifd reads the entries of the IFD at offset keyed by tag, skipping any that point outside the block
+func (t *tiff) ifd(offset uint32) map[uint16]ifdEntry {
+	entries := make(map[uint16]ifdEntry)
+	if offset == 0 || !t.inBounds(offset, 2) {
+		return entries
+	}
+	n := uint32(t.order.Uint16(t.data[offset:]))
+	for i := uint32(0); i < n; i++ {
+		at := offset + 2 + i*12
+		if !t.inBounds(at, 12) {
+			break
+		}
+		e := ifdEntry{
+			offset: at,
+			typ:    t.order.Uint16(t.data[at+2:]),
+			count:  t.order.Uint32(t.data[at+4:]),
+			value:  at + 8,
+		}
+		size, ok := typeSizes[e.typ]
+		if !ok || uint64(size)*uint64(e.count) > uint64(len(t.data)) {
+			continue
+		}
+		if size*e.count > 4 {
+			e.value = t.order.Uint32(t.data[at+8:])
+		}
+		if !t.inBounds(e.value, size*e.count) {
+			continue
+		}
+		entries[t.order.Uint16(t.data[at:])] = e
+	}
+	return entries
+}
+
+func (t *tiff) ascii(e ifdEntry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	b := t.data[e.value : e.value+e.count]
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// uintAt reads the i-th value of a BYTE, SHORT or LONG entry
+func (t *tiff) uintAt(e ifdEntry, i uint32) uint32 {
+	if i >= e.count {
+		return 0
+	}
+	switch e.typ {
+	case 1:
+		return uint32(t.data[e.value+i])
+	case 3:
+		return uint32(t.order.Uint16(t.data[e.value+2*i:]))
+	case 4:
+		return t.order.Uint32(t.data[e.value+4*i:])
+	}
+	return 0
+}
+
+// rational reads the i-th numerator and denominator of a RATIONAL or SRATIONAL entry
+func (t *tiff) rational(e ifdEntry, i uint32) (uint32, uint32) {
+	if (e.typ != 5 && e.typ != 10) || i >= e.count {
+		return 0, 0
+	}
+	at := e.value + 8*i
+	return t.order.Uint32(t.data[at:]), t.order.Uint32(t.data[at+4:])
+}
+
+// decimal reads a RATIONAL entry rounded to one decimal place
+func (t *tiff) decimal(e ifdEntry) float64 {
+	num, den := t.rational(e, 0)
+	if den == 0 {
+		return 0
+	}
+	return math.Round(float64(num)/float64(den)*10) / 10
+}
+
+// degrees reads a GPS coordinate stored as degrees, minutes and seconds
+func (t *tiff) degrees(e ifdEntry) (float64, bool) {
+	if e.count < 3 {
+		return 0, false
+	}
+	var parts [3]float64
+	for i := range parts {
+		num, den := t.rational(e, uint32(i))
+		if den == 0 {
+			return 0, false
+		}
+		parts[i] = float64(num) / float64(den)
+	}
+	return parts[0] + parts[1]/60 + parts[2]/3600, true
+}
+
+// scrub zeroes the values of the identifying tags of an IFD
+func (t *tiff) scrub(entries map[uint16]ifdEntry) {
+	for tag, e := range entries {
+		if identifyingTags[tag] {
+			t.zero(e.value, typeSizes[e.typ]*e.count)
+		}
+	}
+}
+
+// clearIFD zeroes every value of an IFD and then empties it
+func (t *tiff) clearIFD(offset uint32) {
+	entries := t.ifd(offset)
+	for _, e := range entries {
+		t.zero(e.value, typeSizes[e.typ]*e.count)
+	}
+	if !t.inBounds(offset, 2) {
+		return
+	}
+	n := uint32(t.order.Uint16(t.data[offset:]))
+	if t.inBounds(offset+2, n*12) {
+		t.zero(offset+2, n*12)
+	}
+	t.order.PutUint16(t.data[offset:], 0)
+}
+
+func (t *tiff) zero(offset, size uint32) {
+	for i := offset; i < offset+size; i++ {
+		t.data[i] = 0
+	}
+}
@@ -0,0 +1,369 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"math"
+	"testing"
+	"time"
+)
+
+// testXMP is an XMP packet repeating the location of the photo, the way editors write it
+const testXMP = `<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>` +
+	`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+	`<rdf:Description xmlns:exif="http://ns.adobe.com/exif/1.0/" exif:GPSLatitude="52,30.0N" exif:GPSLongitude="13,24.0W"/>` +
+	`</rdf:RDF></x:xmpmeta><?xpacket end="w"?>`
+
+// testSerial is the body serial number written into the EXIF fixture
+const testSerial = "SN-0042-SECRET"
+
+// testWebP is a 1x1 lossless WebP, its VP8L chunk is reused to build extended WebPs
+var testWebP = []byte("RIFF\x1a\x00\x00\x00WEBPVP8L\r\x00\x00\x00/\x00\x00\x00\x10\a\x10\x11\x11\x88\x88\xfe\a\x00")
+
+type tiffField struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+func asciiField(tag uint16, s string) tiffField {
+	return tiffField{tag: tag, typ: 2, count: uint32(len(s) + 1), data: append([]byte(s), 0)}
+}
+
+func shortField(tag uint16, v uint16) tiffField {
+	data := make([]byte, 2)
+	binary.LittleEndian.PutUint16(data, v)
+	return tiffField{tag: tag, typ: 3, count: 1, data: data}
+}
+
+func longField(tag uint16, v uint32) tiffField {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, v)
+	return tiffField{tag: tag, typ: 4, count: 1, data: data}
+}
+
+// rationalField takes numerator and denominator pairs
+func rationalField(tag uint16, v ...uint32) tiffField {
+	data := make([]byte, 4*len(v))
+	for i, n := range v {
+		binary.LittleEndian.PutUint32(data[4*i:], n)
+	}
+	return tiffField{tag: tag, typ: 5, count: uint32(len(v) / 2), data: data}
+}
+
+// testTIFF returns a little endian EXIF block with camera details, a serial number and a
+// location of 52°30'N 13°24'W
+func testTIFF() []byte {
+	ifd0 := []tiffField{
+		asciiField(tagMake, "Gophr"),
+		asciiField(tagModel, "Camera 1"),
+		asciiField(tagDateTime, "2019:06:01 10:00:00"),
+		longField(tagExifIFD, 0),
+		longField(tagGPSIFD, 0),
+	}
+	exif := []tiffField{
+		rationalField(tagExposureTime, 1, 250),
+		rationalField(tagFNumber, 28, 10),
+		shortField(tagISO, 200),
+		asciiField(tagDateTimeOriginal, "2019:05:31 18:30:00"),
+		asciiField(tagBodySerialNumber, testSerial),
+	}
+	gps := []tiffField{
+		asciiField(tagGPSLatitudeRef, "N"),
+		rationalField(tagGPSLatitude, 52, 1, 30, 1, 0, 1),
+		asciiField(tagGPSLongitudeRef, "W"),
+		rationalField(tagGPSLongitude, 13, 1, 24, 1, 0, 1),
+	}
+	ifds := [][]tiffField{ifd0, exif, gps}
+
+	// the IFDs follow the header one after another, values that don't fit an entry come last
+	offsets := make([]uint32, len(ifds))
+	next := uint32(8)
+	for i, ifd := range ifds {
+		offsets[i] = next
+		next += 2 + 12*uint32(len(ifd)) + 4
+	}
+	binary.LittleEndian.PutUint32(ifd0[3].data, offsets[1])
+	binary.LittleEndian.PutUint32(ifd0[4].data, offsets[2])
+
+	le := binary.LittleEndian
+	var buf, values bytes.Buffer
+	buf.WriteString("II")
+	binary.Write(&buf, le, uint16(42))
+	binary.Write(&buf, le, uint32(8))
+	for _, ifd := range ifds {
+		binary.Write(&buf, le, uint16(len(ifd)))
+		for _, f := range ifd {
+			binary.Write(&buf, le, f.tag)
+			binary.Write(&buf, le, f.typ)
+			binary.Write(&buf, le, f.count)
+			if len(f.data) <= 4 {
+				var inline [4]byte
+				copy(inline[:], f.data)
+				buf.Write(inline[:])
+				continue
+			}
+			binary.Write(&buf, le, next+uint32(values.Len()))
+			values.Write(f.data)
+			if values.Len()%2 == 1 {
+				values.WriteByte(0)
+			}
+		}
+		binary.Write(&buf, le, uint32(0))
+	}
+	buf.Write(values.Bytes())
+	return buf.Bytes()
+}
+
+func testImage() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	img.Set(1, 1, color.NRGBA{R: 255, A: 255})
+	return img
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	seg := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+	return append(seg, payload...)
+}
+
+// testJPEG returns a JPEG with an EXIF segment and an XMP segment right after the SOI marker
+func testJPEG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	img := buf.Bytes()
+	out := append([]byte(nil), img[:2]...)
+	out = append(out, jpegSegment(0xE1, append([]byte("Exif\x00\x00"), testTIFF()...))...)
+	out = append(out, jpegSegment(0xE1, append([]byte("http://ns.adobe.com/xap/1.0/\x00"), testXMP...))...)
+	return append(out, img[2:]...)
+}
+
+func pngChunk(typ string, data []byte) []byte {
+	chunk := make([]byte, 4, 12+len(data))
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	chunk = append(chunk, typ...)
+	chunk = append(chunk, data...)
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(chunk[4:]))
+	return append(chunk, crc[:]...)
+}
+
+// testPNG returns a PNG with eXIf and XMP iTXt chunks right after its header chunk
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	img := encodePNG(t, 4, 4)
+	// signature and IHDR
+	ihdrEnd := 8 + 12 + 13
+	out := append([]byte(nil), img[:ihdrEnd]...)
+	out = append(out, pngChunk("eXIf", testTIFF())...)
+	// keyword, no compression, no language tag and no translated keyword
+	out = append(out, pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00"+testXMP))...)
+	return append(out, img[ihdrEnd:]...)
+}
+
+// testGIF returns a GIF with the XMP application extension right before its trailer
+func testGIF(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	img := buf.Bytes()
+	ext := append([]byte{0x21, 0xFF, 0x0B}, "XMP DataXMP"+testXMP...)
+	// the magic trailer makes the raw packet walkable as data sub-blocks
+	ext = append(ext, 0x01)
+	for i := 0xFF; i >= 0; i-- {
+		ext = append(ext, byte(i))
+	}
+	ext = append(ext, 0x00)
+	out := append([]byte(nil), img[:len(img)-1]...)
+	out = append(out, ext...)
+	return append(out, img[len(img)-1:]...)
+}
+
+func webpChunk(fourcc string, data []byte) []byte {
+	chunk := make([]byte, 8, 9+len(data))
+	copy(chunk, fourcc)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(data)))
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// testExtendedWebP returns a 1x1 WebP with EXIF and XMP chunks flagged in its VP8X header
+func testExtendedWebP() []byte {
+	// EXIF and XMP flags, then a canvas of 1x1 stored minus one
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x08 | 0x04
+	body := []byte("WEBP")
+	body = append(body, webpChunk("VP8X", vp8x)...)
+	body = append(body, testWebP[12:]...)
+	body = append(body, webpChunk("EXIF", testTIFF())...)
+	body = append(body, webpChunk("XMP ", []byte(testXMP+" "))...)
+	out := []byte("RIFF\x00\x00\x00\x00")
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(body)))
+	return append(out, body...)
+}
+
+func TestReadMetadata(t *testing.T) {
+	want := Metadata{
+		TakenAt:      time.Date(2019, 5, 31, 18, 30, 0, 0, time.UTC),
+		Make:         "Gophr",
+		Model:        "Camera 1",
+		ExposureTime: "1/250s",
+		FNumber:      2.8,
+		ISO:          200,
+		HasLocation:  true,
+		Latitude:     52.5,
+		Longitude:    -13.4,
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want Metadata
+	}{
+		{name: "JPEG", data: testJPEG(t), want: want},
+		{name: "PNG", data: testPNG(t), want: want},
+		{name: "WebP", data: testExtendedWebP(), want: want},
+		{name: "no EXIF", data: encodePNG(t, 2, 2)},
+		{name: "GIF", data: testGIF(t)},
+		{name: "not an image", data: []byte("hello, world")},
+		{name: "truncated", data: testJPEG(t)[:40]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ReadMetadata(tt.data)
+			if !got.TakenAt.Equal(tt.want.TakenAt) {
+				t.Errorf("TakenAt = %v, want %v", got.TakenAt, tt.want.TakenAt)
+			}
+			got.TakenAt = tt.want.TakenAt
+			got.Latitude = math.Round(got.Latitude*1e6) / 1e6
+			got.Longitude = math.Round(got.Longitude*1e6) / 1e6
+			if *got != tt.want {
+				t.Errorf("ReadMetadata() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatExposure(t *testing.T) {
+	tests := []struct {
+		num, den uint32
+		want     string
+	}{
+		{1, 250, "1/250s"},
+		{10, 300, "1/30s"},
+		{2, 1, "2s"},
+		{25, 10, "2.5s"},
+		{0, 1, ""},
+	}
+	for _, tt := range tests {
+		if got := formatExposure(tt.num, tt.den); got != tt.want {
+			t.Errorf("formatExposure(%d, %d) = %q, want %q", tt.num, tt.den, got, tt.want)
+		}
+	}
+}
+
+func TestStripMetadata(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         []byte
+		format       string
+		hasEXIF      bool
+		keepLocation bool
+	}{
+		{name: "JPEG", data: testJPEG(t), format: "jpeg", hasEXIF: true},
+		{name: "JPEG keeping location", data: testJPEG(t), format: "jpeg", hasEXIF: true, keepLocation: true},
+		{name: "PNG", data: testPNG(t), format: "png", hasEXIF: true},
+		{name: "PNG keeping location", data: testPNG(t), format: "png", hasEXIF: true, keepLocation: true},
+		{name: "WebP", data: testExtendedWebP(), format: "webp", hasEXIF: true},
+		{name: "WebP keeping location", data: testExtendedWebP(), format: "webp", hasEXIF: true, keepLocation: true},
+		{name: "GIF", data: testGIF(t), format: "gif"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !bytes.Contains(tt.data, []byte("GPSLatitude")) {
+				t.Fatal("fixture has no XMP location")
+			}
+			if _, format, err := image.Decode(bytes.NewReader(tt.data)); err != nil || format != tt.format {
+				t.Fatalf("decoding the fixture: format %q, error %v", format, err)
+			}
+
+			got := StripMetadata(tt.data, tt.keepLocation)
+			// XMP repeats the location, and isn't worth keeping for anything else
+			if bytes.Contains(got, []byte("GPSLatitude")) {
+				t.Error("XMP location survived")
+			}
+			if bytes.Contains(got, []byte(testSerial)) {
+				t.Error("serial number survived")
+			}
+			if _, format, err := image.Decode(bytes.NewReader(got)); err != nil || format != tt.format {
+				t.Errorf("decoding the stripped image: format %q, error %v", format, err)
+			}
+
+			m := ReadMetadata(got)
+			if tt.hasEXIF && m.Make != "Gophr" {
+				t.Errorf("Make = %q, want the camera details kept", m.Make)
+			}
+			if m.HasLocation != (tt.hasEXIF && tt.keepLocation) {
+				t.Errorf("HasLocation = %v with keepLocation %v", m.HasLocation, tt.keepLocation)
+			}
+		})
+	}
+}
+
+func TestStripMetadataWebPHeader(t *testing.T) {
+	got := StripMetadata(testExtendedWebP(), false)
+	if size := binary.LittleEndian.Uint32(got[4:]); int(size) != len(got)-8 {
+		t.Errorf("RIFF size = %d, want %d", size, len(got)-8)
+	}
+	// VP8X data follows the 12 byte RIFF header and the 8 byte chunk header
+	if flags := got[20]; flags != 0x08 {
+		t.Errorf("VP8X flags = %#x, want only EXIF (0x08)", flags)
+	}
+}
+
+func TestStripMetadataPNGChecksums(t *testing.T) {
+	got := StripMetadata(testPNG(t), false)
+	for i := 8; i+12 <= len(got); {
+		length := int(binary.BigEndian.Uint32(got[i:]))
+		end := i + 8 + length
+		if end+4 > len(got) {
+			t.Fatalf("chunk at %d runs past the end", i)
+		}
+		if crc := crc32.ChecksumIEEE(got[i+4 : end]); crc != binary.BigEndian.Uint32(got[end:]) {
+			t.Errorf("%s chunk has a bad CRC", got[i+4:i+8])
+		}
+		i = end + 4
+	}
+}
+
+func TestStripMetadataUnknown(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "not an image", data: []byte("hello, world")},
+		{name: "truncated GIF", data: testGIF(t)[:30]},
+		{name: "truncated PNG", data: testPNG(t)[:60]},
+		{name: "bare WebP", data: testWebP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := StripMetadata(tt.data, false); !bytes.Equal(got, tt.data) {
+				t.Errorf("StripMetadata() changed an image with nothing to strip")
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/draw"
+
+	// registered so image.Decode understands WebP uploads
+	_ "golang.org/x/image/webp"
+)
+
+var (
+	// ErrFormatUnsupported is returned when an image cannot be encoded in the format asked for
+	ErrFormatUnsupported = errors.New("imaging: image format is not supported")
+
+	// ErrTooManyPixels is returned when decoding an image that is larger than MaxPixels
+	ErrTooManyPixels = errors.New("imaging: image has too many pixels")
+)
+
+const (
+	// jpegQuality is the quality resized JPEGs are encoded with
+	jpegQuality = 85
+
+	// MaxPixels is the largest image Decode accepts, 50 megapixels. A decoded image takes
+	// 4 bytes or more per pixel while a few kilobytes of file can claim any size at all.
+	MaxPixels = 50 * 1000 * 1000
+)
+
+// Picture is a decoded image along with the EXIF orientation it should be displayed with
+type Picture struct {
+	Image       image.Image
+	Format      string
+	Orientation int
+}
+
+// Decode reads a JPEG, PNG, GIF or WebP image. Only the first frame of animated GIFs is kept.
+// The dimensions are checked against MaxPixels before any pixels are decoded.
+func Decode(data []byte) (*Picture, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > MaxPixels {
+		return nil, ErrTooManyPixels
+	}
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return &Picture{
+		Image:       img,
+		Format:      format,
+		Orientation: Orientation(data),
+	}, nil
+}
+
+// Size returns the dimensions of the picture as it is meant to be displayed
+func (p *Picture) Size() (width, height int) {
+	b := p.Image.Bounds()
+	if swapsAxes(p.Orientation) {
+		return b.Dy(), b.Dx()
+	}
+	return b.Dx(), b.Dy()
+}
+
+// Fit scales the picture down so it fits inside maxWidth x maxHeight while keeping
+// its aspect ratio, then rotates it upright. Pictures are never scaled up.
+func (p *Picture) Fit(maxWidth, maxHeight int) image.Image {
+	if swapsAxes(p.Orientation) {
+		maxWidth, maxHeight = maxHeight, maxWidth
+	}
+	b := p.Image.Bounds()
+	w, h := FitSize(b.Dx(), b.Dy(), maxWidth, maxHeight)
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), p.Image, b, draw.Src, nil)
+	return orient(dst, p.Orientation)
+}
+
+// FitSize returns the largest dimensions no bigger than the original that fit
+// inside maxWidth x maxHeight with the same aspect ratio
+func FitSize(width, height, maxWidth, maxHeight int) (int, int) {
+	if width <= maxWidth && height <= maxHeight {
+		return width, height
+	}
+	// compare the aspect ratios without dividing to decide which side limits the size
+	if width*maxHeight > height*maxWidth {
+		h := height * maxWidth / width
+		if h < 1 {
+			h = 1
+		}
+		return maxWidth, h
+	}
+	w := width * maxHeight / height
+	if w < 1 {
+		w = 1
+	}
+	return w, maxHeight
+}
+
+// Encode writes img in the given format. Encoding drops any metadata the source carried.
+func Encode(w io.Writer, img image.Image, format string) error {
+	switch format {
+	case "jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: jpegQuality})
+	case "png":
+		return png.Encode(w, img)
+	case "gif":
+		return gif.Encode(w, img, nil)
+	default:
+		return ErrFormatUnsupported
+	}
+}
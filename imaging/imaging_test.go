@@ -0,0 +1,118 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// pngHeader returns the start of a PNG claiming to be width x height, enough for DecodeConfig
+func pngHeader(width, height uint32) []byte {
+	var ihdr [13]byte
+	binary.BigEndian.PutUint32(ihdr[0:], width)
+	binary.BigEndian.PutUint32(ihdr[4:], height)
+	ihdr[8] = 8 // bit depth
+	ihdr[9] = 6 // RGBA
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	binary.Write(&buf, binary.BigEndian, uint32(len(ihdr)))
+	chunk := append([]byte("IHDR"), ihdr[:]...)
+	buf.Write(chunk)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+	return buf.Bytes()
+}
+
+func encodePNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	img.Set(0, 0, color.NRGBA{R: 255, A: 255})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       []byte
+		wantErr    error
+		wantFormat string
+		wantWidth  int
+		wantHeight int
+	}{
+		{name: "small PNG", data: encodePNG(t, 30, 20), wantFormat: "png", wantWidth: 30, wantHeight: 20},
+		{name: "claims 50000x50000", data: pngHeader(50000, 50000), wantErr: ErrTooManyPixels},
+		{name: "claims one row too many", data: pngHeader(10000, MaxPixels/10000+1), wantErr: ErrTooManyPixels},
+		{name: "not an image", data: []byte("hello, world"), wantErr: image.ErrFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pic, err := Decode(tt.data)
+			if err != tt.wantErr {
+				t.Fatalf("Decode() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if pic.Format != tt.wantFormat {
+				t.Errorf("Format = %q, want %q", pic.Format, tt.wantFormat)
+			}
+			if w, h := pic.Size(); w != tt.wantWidth || h != tt.wantHeight {
+				t.Errorf("Size() = %dx%d, want %dx%d", w, h, tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+}
+
+func TestFitSize(t *testing.T) {
+	tests := []struct {
+		width, height, maxWidth, maxHeight int
+		wantWidth, wantHeight              int
+	}{
+		{100, 50, 200, 200, 100, 50},
+		{200, 200, 200, 200, 200, 200},
+		{400, 200, 200, 200, 200, 100},
+		{200, 400, 200, 200, 100, 200},
+		{4000, 3000, 1600, 1600, 1600, 1200},
+		{3000, 4000, 800, 800, 600, 800},
+		{10000, 1, 200, 200, 200, 1},
+		{1, 10000, 200, 200, 1, 200},
+	}
+	for _, tt := range tests {
+		w, h := FitSize(tt.width, tt.height, tt.maxWidth, tt.maxHeight)
+		if w != tt.wantWidth || h != tt.wantHeight {
+			t.Errorf("FitSize(%d, %d, %d, %d) = %d, %d, want %d, %d",
+				tt.width, tt.height, tt.maxWidth, tt.maxHeight, w, h, tt.wantWidth, tt.wantHeight)
+		}
+	}
+}
+
+func TestFit(t *testing.T) {
+	pic, err := Decode(encodePNG(t, 400, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		orientation           int
+		wantWidth, wantHeight int
+	}{
+		{1, 200, 50},
+		{3, 200, 50},
+		// 6 and 8 turn the picture on its side, so it is displayed 100 wide and 400 tall
+		{6, 50, 200},
+		{8, 50, 200},
+	}
+	for _, tt := range tests {
+		pic.Orientation = tt.orientation
+		b := pic.Fit(200, 200).Bounds()
+		if b.Dx() != tt.wantWidth || b.Dy() != tt.wantHeight {
+			t.Errorf("Fit with orientation %d = %dx%d, want %dx%d", tt.orientation, b.Dx(), b.Dy(), tt.wantWidth, tt.wantHeight)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package imaging
+
+import (
+	"image"
+)
+
+// The values of the EXIF Orientation tag, named after what has to be done to show the image upright
+const (
+	OrientationNormal     = 1
+	OrientationFlipH      = 2
+	OrientationRotate180  = 3
+	OrientationFlipV      = 4
+	OrientationTranspose  = 5
+	OrientationRotate90   = 6
+	OrientationTransverse = 7
+	OrientationRotate270  = 8
+)
+
+// exifTagOrientation is the id of the Orientation tag in IFD0
+const exifTagOrientation uint16 = 0x0112
+
+// Orientation looks up the EXIF orientation of an image, returning OrientationNormal when there is none
+func Orientation(data []byte) int {
+	start, end := exifBlock(data)
+	if start < 0 {
+		return OrientationNormal
+	}
+	t, ok := newTIFF(data[start:end])
+	if !ok {
+		return OrientationNormal
+	}
+	o := int(t.uintAt(t.ifd(t.first)[exifTagOrientation], 0))
+	if o < OrientationNormal || o > OrientationRotate270 {
+		return OrientationNormal
+	}
+	return o
+}
+
+func swapsAxes(orientation int) bool {
+	return orientation >= OrientationTranspose && orientation <= OrientationRotate270
+}
+
+// orient transforms an image the way its EXIF orientation asks for so it ends up upright
+func orient(img *image.NRGBA, orientation int) image.Image {
+	if orientation <= OrientationNormal || orientation > OrientationRotate270 {
+		return img
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dw, dh := w, h
+	if swapsAxes(orientation) {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case OrientationFlipH:
+				dx, dy = w-1-x, y
+			case OrientationRotate180:
+				dx, dy = w-1-x, h-1-y
+			case OrientationFlipV:
+				dx, dy = x, h-1-y
+			case OrientationTranspose:
+				dx, dy = y, x
+			case OrientationRotate90:
+				dx, dy = h-1-y, x
+			case OrientationTransverse:
+				dx, dy = h-1-y, w-1-x
+			case OrientationRotate270:
+				dx, dy = y, w-1-x
+			}
+			si := img.PixOffset(x+img.Rect.Min.X, y+img.Rect.Min.Y)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], img.Pix[si:si+4])
+		}
+	}
+	return dst
+}
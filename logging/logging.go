@@ -0,0 +1,136 @@
+// Package logging writes structured logs, one JSON object per line, and carries a logger
+// for every request in its context so whatever is logged while serving it, in controllers
+// or in models, can be tied back to the request.
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	LevelInfo  = "info"
+	LevelError = "error"
+)
+
+// Logger writes log lines with the fields it was given through With. It is safe to use
+// from several goroutines at once.
+type Logger struct {
+	out    *output
+	fields []interface{}
+}
+
+// output is shared by a logger and the loggers made from it, so their lines do not interleave
+type output struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+type loggerKey struct{}
+
+var std = New(os.Stderr)
+
+// New returns a Logger writing to w
+func New(w io.Writer) *Logger {
+	return &Logger{out: &output{w: w}}
+}
+
+// Default returns the Logger writing to stderr, where the log package writes too
+func Default() *Logger {
+	return std
+}
+
+// With returns a copy of the logger that adds keyvals, pairs of keys and values, to every line
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{out: l.out, fields: fields}
+}
+
+// Info logs msg along with keyvals, pairs of keys and values
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.write(LevelInfo, msg, "", keyvals)
+}
+
+// Error logs err along with keyvals, and the file and line it was logged from. A "caller"
+// given through With takes the place of the latter, for errors logged on behalf of someone else.
+func (l *Logger) Error(err error, keyvals ...interface{}) {
+	l.write(LevelError, err.Error(), Caller(1), keyvals)
+}
+
+// Caller returns where the function that called Caller was called from, skip levels further
+// up the stack, as package directory, file and line, or "" when the stack is not that deep
+func Caller(skip int) string {
+	_, file, line, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return ""
+	}
+	return filepath.Base(filepath.Dir(file)) + "/" + filepath.Base(file) + ":" + strconv.Itoa(line)
+}
+
+func (l *Logger) write(level, msg, caller string, keyvals []interface{}) {
+	buf := []byte("{")
+	buf = appendField(buf, "time", time.Now().UTC().Format(time.RFC3339Nano))
+	buf = appendField(buf, "level", level)
+	buf = appendField(buf, "msg", msg)
+	fields := append(l.fields[:len(l.fields):len(l.fields)], keyvals...)
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		if key == "caller" {
+			caller = ""
+		}
+		var value interface{} = "(missing)"
+		if i+1 < len(fields) {
+			value = fields[i+1]
+		}
+		buf = appendField(buf, key, value)
+	}
+	if caller != "" {
+		buf = appendField(buf, "caller", caller)
+	}
+	buf[len(buf)-1] = '}'
+	buf = append(buf, '\n')
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(buf)
+}
+
+// appendField appends "key":value, to buf. Errors are written as their message and values
+// JSON cannot represent as the text fmt prints for them.
+func appendField(buf []byte, key string, value interface{}) []byte {
+	k, _ := json.Marshal(key)
+	buf = append(buf, k...)
+	buf = append(buf, ':')
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+	v, err := json.Marshal(value)
+	if err != nil {
+		v, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf = append(buf, v...)
+	return append(buf, ',')
+}
+
+// NewContext returns a copy of ctx that carries logger
+func NewContext(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the logger stored in ctx, or Default if there is none
+func FromContext(ctx context.Context) *Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return logger
+	}
+	return std
+}
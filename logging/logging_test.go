@@ -0,0 +1,161 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// decode parses every line logged to buf
+func decode(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			t.Fatalf("line %q is not JSON: %v", line, err)
+		}
+		lines = append(lines, fields)
+	}
+	return lines
+}
+
+func TestLogger(t *testing.T) {
+	tests := []struct {
+		name string
+		log  func(l *Logger)
+		want map[string]interface{}
+		// wantMissing are fields that must not be in the line
+		wantMissing []string
+	}{
+		{
+			name:        "info",
+			log:         func(l *Logger) { l.Info("request", "status", 200, "path", "/") },
+			want:        map[string]interface{}{"level": LevelInfo, "msg": "request", "status": 200.0, "path": "/"},
+			wantMissing: []string{"caller"},
+		},
+		{
+			name: "error",
+			log:  func(l *Logger) { l.Error(errors.New("boom"), "user_id", 7) },
+			want: map[string]interface{}{"level": LevelError, "msg": "boom", "user_id": 7.0, "caller": "logging/logging_test.go"},
+		},
+		{
+			name: "caller given",
+			log:  func(l *Logger) { l.Error(errors.New("boom"), "caller", "controllers/users.go:10") },
+			want: map[string]interface{}{"caller": "controllers/users.go:10"},
+		},
+		{
+			name: "fields from With",
+			log:  func(l *Logger) { l.With("request_id", "abc").With("user_id", 7).Info("request") },
+			want: map[string]interface{}{"request_id": "abc", "user_id": 7.0},
+		},
+		{
+			name: "odd keyvals",
+			log:  func(l *Logger) { l.Info("request", "status") },
+			want: map[string]interface{}{"status": "(missing)"},
+		},
+		{
+			name: "error value",
+			log:  func(l *Logger) { l.Info("request", "err", errors.New("boom")) },
+			want: map[string]interface{}{"err": "boom"},
+		},
+		{
+			name: "value JSON can't hold",
+			log:  func(l *Logger) { l.Info("request", "fn", complex(1, 2)) },
+			want: map[string]interface{}{"fn": "(1+2i)"},
+		},
+		{
+			name: "message with quotes",
+			log:  func(l *Logger) { l.Info("say \"hi\"\n") },
+			want: map[string]interface{}{"msg": "say \"hi\"\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tt.log(New(&buf))
+			lines := decode(t, &buf)
+			if len(lines) != 1 {
+				t.Fatalf("logged %d lines, want 1", len(lines))
+			}
+			got := lines[0]
+			if _, ok := got["time"]; !ok {
+				t.Error("line has no time")
+			}
+			for k, want := range tt.want {
+				if k == "caller" && strings.HasPrefix(got[k].(string), want.(string)+":") {
+					continue
+				}
+				if got[k] != want {
+					t.Errorf("%s = %#v, want %#v", k, got[k], want)
+				}
+			}
+			for _, k := range tt.wantMissing {
+				if _, ok := got[k]; ok {
+					t.Errorf("line has %s, want none", k)
+				}
+			}
+		})
+	}
+}
+
+func TestLoggerWithKeepsParent(t *testing.T) {
+	var buf bytes.Buffer
+	parent := New(&buf).With("a", 1)
+	// both children start from the same fields, neither may see the other's
+	first, second := parent.With("b", 2), parent.With("c", 3)
+	first.Info("first")
+	second.Info("second")
+	parent.Info("parent")
+	lines := decode(t, &buf)
+	if _, ok := lines[1]["b"]; ok {
+		t.Error("a logger got the fields of its sibling")
+	}
+	if _, ok := lines[2]["b"]; ok {
+		t.Error("a logger got the fields of its child")
+	}
+	if lines[0]["a"] != 1.0 || lines[1]["a"] != 1.0 {
+		t.Error("a child lost the fields of its parent")
+	}
+}
+
+func TestLoggerConcurrently(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			l.With("n", i).Info(strings.Repeat("x", 1000))
+		}(i)
+	}
+	wg.Wait()
+	// decode fails if lines were written over each other
+	if lines := decode(t, &buf); len(lines) != 50 {
+		t.Errorf("logged %d lines, want 50", len(lines))
+	}
+}
+
+func TestContext(t *testing.T) {
+	if FromContext(context.Background()) != Default() {
+		t.Error("FromContext() without a logger is not the default one")
+	}
+	l := New(&bytes.Buffer{})
+	if FromContext(NewContext(context.Background(), l)) != l {
+		t.Error("FromContext() did not return the logger stored")
+	}
+}
+
+func TestCaller(t *testing.T) {
+	if got := Caller(0); !strings.HasPrefix(got, "logging/logging_test.go:") {
+		t.Errorf("Caller(0) = %q, want this file", got)
+	}
+	if got := Caller(1000); got != "" {
+		t.Errorf("Caller(1000) = %q, want empty", got)
+	}
+}
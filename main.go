@@ -1,23 +1,28 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
+	"gophr.com/config"
 	"gophr.com/controllers"
+	"gophr.com/email"
+	"gophr.com/logging"
+	"gophr.com/middleware"
+	"gophr.com/migrate"
 	"gophr.com/models"
+	"gophr.com/rand"
+	"gophr.com/storage"
 
+	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
 )
 
-const (
-	host     = "localhost"
-	port     = 5432
-	user     = "postgres"
-	password = "ani15162"
-	dbname   = "gophr"
-)
+// accountPurgeInterval is how often accounts whose deletion is due are looked for
+const accountPurgeInterval = time.Hour
 
 func init() {
 	log.SetPrefix("LOG: ")
@@ -26,27 +31,200 @@ func init() {
 }
 
 func main() {
-	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", host, port, user, password, dbname)
-	us, err := models.NewUserService(psqlInfo)
+	cfgLoader := config.NewLoader(flag.CommandLine)
+	regenVariants := flag.Bool("regen-variants", false, "rebuild the resized variants of every image from the current presets and exit")
+	migrateCmd := flag.String("migrate", "", "run a schema migration command and exit: up applies pending migrations, down rolls back the last one, status lists them")
+	flag.Parse()
+
+	cfg, err := cfgLoader.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store, err := storage.New(cfg.Storage)
 	if err != nil {
 		panic(err)
 	}
-	defer us.Close()
-	us.AutoMigrate()
+	services, err := models.NewServices(
+		models.WithGorm(cfg.Database.Dialect, cfg.Database.ConnectionInfo()),
+		models.WithLogMode(!cfg.IsProd()),
+		models.WithUser(cfg.Pepper, cfg.HMACKey),
+		models.WithSession(cfg.HMACKey),
+		models.WithGallery(),
+		models.WithImage(store, cfg.MaxImageBytes),
+		models.WithLoginThrottle(cfg.ThrottleStore == config.ThrottleStoreMemory, cfg.HMACKey),
+	)
+	if err != nil {
+		panic(err)
+	}
+	defer services.Close()
 
-	usersC := controllers.NewUsers(us)
-	staticC := controllers.NewStatic()
+	migrator := services.Migrator()
+	if *migrateCmd != "" {
+		if err := runMigrate(migrator, *migrateCmd); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := migrator.Check(); err != nil {
+		log.Fatal(err, " (run with -migrate up)")
+	}
+
+	if *regenVariants {
+		if err := services.Image.RegenerateVariants(); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("image variants regenerated")
+		return
+	}
+
+	mailer, err := email.New(cfg.Mail)
+	if err != nil {
+		panic(err)
+	}
+
+	userMw := middleware.User{
+		UserService:    services.User,
+		SessionService: services.Session,
+	}
+	requireUserMw := middleware.RequireUser{}
+
+	csrfKey := []byte(cfg.CSRFKey)
+	if len(csrfKey) == 0 {
+		csrfKey, err = rand.Bytes(32)
+		if err != nil {
+			panic(err)
+		}
+	}
 
 	r := mux.NewRouter()
+	usersC := controllers.NewUsers(services.User, services.Session, services.LoginThrottle, mailer, cfg.SiteURL)
+	staticC := controllers.NewStatic()
+	galleriesC := controllers.NewGalleries(services.Gallery, services.Image, services.User, r)
+
 	r.Handle("/", staticC.Home).Methods("GET")
 	r.Handle("/contact", staticC.Contact).Methods("GET")
 	r.Handle("/faq", staticC.Faq).Methods("GET")
 	r.HandleFunc("/signup", usersC.New).Methods("GET")
 	r.HandleFunc("/signup", usersC.Create).Methods("POST")
-	r.Handle("/login", usersC.LogInView).Methods("GET")
+	r.HandleFunc("/login", usersC.LogIn).Methods("GET")
 	r.HandleFunc("/login", usersC.Login).Methods("POST")
-	r.HandleFunc("/cookietest", usersC.CookieTest).Methods("GET")
+	r.HandleFunc("/login/two-factor", usersC.TwoFactorLogIn).Methods("GET")
+	r.HandleFunc("/login/two-factor", usersC.TwoFactorLogin).Methods("POST")
+	r.HandleFunc("/logout", requireUserMw.ApplyFn(usersC.Logout)).Methods("POST")
+	r.HandleFunc("/unlock", usersC.Unlock).Methods("GET")
+	r.HandleFunc("/forgot", usersC.ForgotPassword).Methods("GET")
+	r.HandleFunc("/forgot", usersC.InitiateReset).Methods("POST")
+	r.HandleFunc("/reset", usersC.ResetPassword).Methods("GET")
+	r.HandleFunc("/reset", usersC.CompleteReset).Methods("POST")
+	r.HandleFunc("/account", requireUserMw.ApplyFn(usersC.Account)).Methods("GET")
+	r.HandleFunc("/account/privacy", requireUserMw.ApplyFn(usersC.UpdatePrivacy)).Methods("POST")
+	r.HandleFunc("/account/settings", requireUserMw.ApplyFn(usersC.Settings)).Methods("GET")
+	r.HandleFunc("/account/settings/name", requireUserMw.ApplyFn(usersC.UpdateName)).Methods("POST")
+	r.HandleFunc("/account/settings/email", requireUserMw.ApplyFn(usersC.UpdateEmail)).Methods("POST")
+	r.HandleFunc("/account/settings/password", requireUserMw.ApplyFn(usersC.UpdatePassword)).Methods("POST")
+	r.HandleFunc("/account/sessions", requireUserMw.ApplyFn(usersC.Sessions)).Methods("GET")
+	r.HandleFunc("/account/sessions/{id:[0-9]+}/revoke", requireUserMw.ApplyFn(usersC.RevokeSession)).Methods("POST")
+	r.HandleFunc("/account/sessions/revoke-all", requireUserMw.ApplyFn(usersC.SignOutEverywhere)).Methods("POST")
+	r.HandleFunc("/account/verify", requireUserMw.ApplyFn(usersC.ResendVerification)).Methods("POST")
+	r.HandleFunc("/account/two-factor/setup", requireUserMw.ApplyFn(usersC.SetupTwoFactor)).Methods("POST")
+	r.HandleFunc("/account/two-factor/enable", requireUserMw.ApplyFn(usersC.EnableTwoFactor)).Methods("POST")
+	r.HandleFunc("/account/two-factor/disable", requireUserMw.ApplyFn(usersC.DisableTwoFactor)).Methods("POST")
+	r.HandleFunc("/account/delete", requireUserMw.ApplyFn(usersC.DeleteAccount)).Methods("POST")
+	r.HandleFunc("/verify", usersC.Verify).Methods("GET")
+
+	// Gallery routes
+	r.HandleFunc("/galleries", requireUserMw.ApplyFn(galleriesC.Index)).Methods("GET")
+	r.HandleFunc("/galleries/new", requireUserMw.ApplyFn(galleriesC.NewGallery)).Methods("GET")
+	r.HandleFunc("/galleries", requireUserMw.ApplyFn(galleriesC.Create)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}", galleriesC.Show).Methods("GET").Name(controllers.ShowGallery)
+	r.HandleFunc("/galleries/{id:[0-9]+}/edit", requireUserMw.ApplyFn(galleriesC.Edit)).Methods("GET").Name(controllers.EditGallery)
+	r.HandleFunc("/galleries/{id:[0-9]+}/update", requireUserMw.ApplyFn(galleriesC.Update)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/delete", requireUserMw.ApplyFn(galleriesC.Delete)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/publish", requireUserMw.ApplyFn(galleriesC.Publish)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/unpublish", requireUserMw.ApplyFn(galleriesC.Unpublish)).Methods("POST")
+
+	// Image routes
+	r.HandleFunc("/galleries/{id:[0-9]+}/images", requireUserMw.ApplyFn(galleriesC.ImageUpload)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}", galleriesC.ImageServe).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/info", galleriesC.ImageInfo).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete", requireUserMw.ApplyFn(galleriesC.ImageDelete)).Methods("POST")
 	r.NotFoundHandler = staticC.Error404
 
-	log.Fatal(http.ListenAndServe(":8080", r))
+	csrfMw := csrf.Protect(csrfKey,
+		csrf.Path("/"),
+		csrf.Secure(cfg.IsProd()),
+		csrf.ErrorHandler(http.HandlerFunc(staticC.InvalidCSRF)))
+
+	go purgeDeletedAccounts(services)
+
+	recoverMw := middleware.Recover{
+		ErrorHandler: http.HandlerFunc(staticC.InternalError),
+	}
+
+	limitBodyMw := middleware.LimitBody{
+		MaxBytes:     cfg.MaxUploadBytes,
+		ErrorHandler: http.HandlerFunc(staticC.RequestTooLarge),
+	}
+
+	accessLogMw := middleware.AccessLog{
+		Logger: logging.Default(),
+	}
+
+	log.Fatal(http.ListenAndServe(cfg.Addr(), accessLogMw.Apply(recoverMw.Apply(limitBodyMw.Apply(csrfMw(userMw.Apply(r)))))))
+}
+
+// purgeDeletedAccounts removes the accounts whose deletion is due, once at startup and
+// then every accountPurgeInterval for as long as the server runs
+func purgeDeletedAccounts(services *models.Services) {
+	ticker := time.NewTicker(accountPurgeInterval)
+	defer ticker.Stop()
+	for {
+		n, err := services.PurgeDeletedAccounts()
+		if err != nil {
+			logging.Default().Error(err)
+		}
+		if n > 0 {
+			logging.Default().Info("purged deleted accounts", "count", n)
+		}
+		<-ticker.C
+	}
+}
+
+// runMigrate carries out one of the -migrate commands
+func runMigrate(m *migrate.Migrator, cmd string) error {
+	switch cmd {
+	case "up":
+		applied, err := m.Up()
+		for _, id := range applied {
+			fmt.Println("applied", id)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("no pending migrations")
+		}
+	case "down":
+		id, err := m.Down()
+		if err != nil {
+			return err
+		}
+		fmt.Println("rolled back", id)
+	case "status":
+		statuses, err := m.Status()
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			if s.Applied {
+				fmt.Printf("%-40s applied %s\n", s.ID, s.AppliedAt.Format("2006-01-02 15:04:05"))
+			} else {
+				fmt.Printf("%-40s pending\n", s.ID)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %q, use up, down or status", cmd)
+	}
+	return nil
 }
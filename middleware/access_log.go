@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	stdcontext "context"
+	"net/http"
+	"time"
+
+	"gophr.com/context"
+	"gophr.com/logging"
+	"gophr.com/rand"
+)
+
+// maxRequestIDLength keeps the ids passed in by proxies from bloating the logs
+const maxRequestIDLength = 64
+
+// AccessLog logs a line for every request once it has been served. It gives each request an
+// id, the X-Request-ID header it came with or a new one, which is sent back in the response
+// and kept in the request context along with a logger that adds it to everything logged.
+// It should wrap every other middleware so it sees the response that actually went out.
+type AccessLog struct {
+	Logger *logging.Logger
+}
+
+// accessEntry collects what the middlewares further in learn about a request for its access log line
+type accessEntry struct {
+	userID uint
+}
+
+type accessEntryKey struct{}
+
+// Apply wraps an http.Handler with the AccessLog middleware
+func (mw *AccessLog) Apply(next http.Handler) http.Handler {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn wraps an http.HandlerFunc with the AccessLog middleware
+func (mw *AccessLog) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			var err error
+			if id, err = rand.RequestID(); err != nil {
+				logging.FromContext(r.Context()).Error(err)
+			}
+		}
+		w.Header().Set("X-Request-ID", id)
+		r = withRequestID(r, mw.Logger, id)
+		entry := &accessEntry{}
+		r = r.WithContext(stdcontext.WithValue(r.Context(), accessEntryKey{}, entry))
+
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			keyvals := []interface{}{
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", sw.status(),
+				"bytes", sw.bytes,
+				"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if entry.userID != 0 {
+				keyvals = append(keyvals, "user_id", entry.userID)
+			}
+			logging.FromContext(r.Context()).Info("request", keyvals...)
+		}()
+		next(sw, r)
+	})
+}
+
+// withRequestID returns the request with id and a logger that adds it to every line in its
+// context. The logger is made from base, or from the default logger when base is nil.
+func withRequestID(r *http.Request, base *logging.Logger, id string) *http.Request {
+	if base == nil {
+		base = logging.Default()
+	}
+	ctx := context.WithRequestID(r.Context(), id)
+	ctx = logging.NewContext(ctx, base.With("request_id", id))
+	return r.WithContext(ctx)
+}
+
+// logUser notes the logged in user for the access log and the rest of the request's logs
+func logUser(r *http.Request, userID uint) *http.Request {
+	if entry, ok := r.Context().Value(accessEntryKey{}).(*accessEntry); ok {
+		entry.userID = userID
+	}
+	logger := logging.FromContext(r.Context()).With("user_id", userID)
+	return r.WithContext(logging.NewContext(r.Context(), logger))
+}
+
+// validRequestID reports whether an id from a request header is fit to be logged and sent back
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// statusWriter records the status and size of the response for the access log
+type statusWriter struct {
+	http.ResponseWriter
+	code  int
+	bytes int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.code == 0 {
+		sw.code = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.code == 0 {
+		sw.code = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += n
+	return n, err
+}
+
+// status returns the status the response went out with, a handler that wrote nothing sent a 200
+func (sw *statusWriter) status() int {
+	if sw.code == 0 {
+		return http.StatusOK
+	}
+	return sw.code
+}
@@ -0,0 +1,154 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gophr.com/context"
+	"gophr.com/logging"
+)
+
+func TestAccessLog(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		handler http.HandlerFunc
+		// wantID is the request id expected, empty for any new one
+		wantID     string
+		wantStatus float64
+		wantBytes  float64
+		wantUserID float64
+	}{
+		{
+			name:       "id passed in",
+			header:     "req-123_abc.1",
+			handler:    func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("hello")) },
+			wantID:     "req-123_abc.1",
+			wantStatus: http.StatusOK,
+			wantBytes:  5,
+		},
+		{
+			name:       "no id",
+			handler:    func(w http.ResponseWriter, r *http.Request) {},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "id with characters that don't belong in a log",
+			header:     "abc\" injected",
+			handler:    func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNotFound) },
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "id too long",
+			header:     strings.Repeat("a", maxRequestIDLength+1),
+			handler:    func(w http.ResponseWriter, r *http.Request) {},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:   "first status wins",
+			header: "abc",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusFound)
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			wantID:     "abc",
+			wantStatus: http.StatusFound,
+		},
+		{
+			name:   "logged in user",
+			header: "abc",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				logUser(r, 42)
+				w.Write([]byte("hi"))
+			},
+			wantID:     "abc",
+			wantStatus: http.StatusOK,
+			wantBytes:  2,
+			wantUserID: 42,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			mw := AccessLog{Logger: logging.New(&buf)}
+			var ctxID string
+			h := mw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+				ctxID = context.RequestID(r.Context())
+				tt.handler(w, r)
+			})
+			r := httptest.NewRequest("GET", "/galleries?page=2", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Request-ID", tt.header)
+			}
+			w := httptest.NewRecorder()
+			h(w, r)
+
+			id := w.Header().Get("X-Request-ID")
+			if tt.wantID != "" && id != tt.wantID {
+				t.Errorf("X-Request-ID = %q, want %q", id, tt.wantID)
+			}
+			if id == "" || (tt.wantID == "" && id == tt.header) {
+				t.Errorf("X-Request-ID = %q, want a new id", id)
+			}
+			if ctxID != id {
+				t.Errorf("request id in the context = %q, want %q", ctxID, id)
+			}
+
+			var line map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+				t.Fatalf("access log %q is not a JSON line: %v", buf.String(), err)
+			}
+			want := map[string]interface{}{
+				"msg":        "request",
+				"request_id": id,
+				"method":     "GET",
+				"path":       "/galleries",
+				"status":     tt.wantStatus,
+				"bytes":      tt.wantBytes,
+			}
+			if tt.wantUserID != 0 {
+				want["user_id"] = tt.wantUserID
+			}
+			for k, v := range want {
+				if line[k] != v {
+					t.Errorf("%s = %#v, want %#v", k, line[k], v)
+				}
+			}
+			if _, ok := line["user_id"]; ok && tt.wantUserID == 0 {
+				t.Error("access log has a user_id for a visitor")
+			}
+			if _, ok := line["duration_ms"]; !ok {
+				t.Error("access log has no duration_ms")
+			}
+		})
+	}
+}
+
+// TestAccessLogRequestLogger checks that what handlers log carries the id of the request
+func TestAccessLogRequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	mw := AccessLog{Logger: logging.New(&buf)}
+	h := mw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+		r = logUser(r, 42)
+		logging.FromContext(r.Context()).Info("handler")
+	})
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Request-ID", "abc")
+	h(httptest.NewRecorder(), r)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %d lines, want the handler's and the access log", len(lines))
+	}
+	var line map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line["msg"] != "handler" || line["request_id"] != "abc" || line["user_id"] != 42.0 {
+		t.Errorf("handler logged %v, want it with the request id and user id", line)
+	}
+}
@@ -0,0 +1,31 @@
+package middleware
+
+import "net/http"
+
+// LimitBody turns away requests with a body over MaxBytes. Parsing a form, which the CSRF
+// check does before any handler runs, reads all of the body however large it is.
+type LimitBody struct {
+	MaxBytes int64
+
+	// ErrorHandler renders the page for requests that are too large, it must not read the body
+	ErrorHandler http.Handler
+}
+
+// Apply wraps an http.Handler with the LimitBody middleware
+func (mw *LimitBody) Apply(next http.Handler) http.Handler {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn wraps an http.HandlerFunc with the LimitBody middleware
+func (mw *LimitBody) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// browsers say how large their uploads are, so they can be turned away before reading any of it
+		if r.ContentLength > mw.MaxBytes {
+			mw.ErrorHandler.ServeHTTP(w, r)
+			return
+		}
+		// the rest are cut off once they go over
+		r.Body = http.MaxBytesReader(w, r.Body, mw.MaxBytes)
+		next(w, r)
+	})
+}
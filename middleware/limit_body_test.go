@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimitBody(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		wantStatus    int
+		wantRead      string
+	}{
+		{"under the limit", "12345", 5, http.StatusOK, "12345"},
+		{"at the limit", "1234567890", 10, http.StatusOK, "1234567890"},
+		{"says it is over the limit", "12345678901", 11, http.StatusRequestEntityTooLarge, ""},
+		{"goes over without saying", "12345678901", -1, http.StatusBadRequest, "1234567890"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var read string
+			mw := LimitBody{
+				MaxBytes: 10,
+				ErrorHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusRequestEntityTooLarge)
+				}),
+			}
+			h := mw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+				b, err := ioutil.ReadAll(r.Body)
+				read = string(b)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+				}
+			})
+			r := httptest.NewRequest("POST", "/", ioutil.NopCloser(strings.NewReader(tt.body)))
+			r.ContentLength = tt.contentLength
+			w := httptest.NewRecorder()
+			h(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if read != tt.wantRead {
+				t.Errorf("handler read %q, want %q", read, tt.wantRead)
+			}
+		})
+	}
+}
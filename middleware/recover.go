@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+
+	"gophr.com/context"
+	"gophr.com/logging"
+	"gophr.com/rand"
+)
+
+// Recover turns a panic in a handler into a 500 response, so the visitor gets an error
+// page instead of a dropped connection. The panic is logged with its stack and the id of
+// the request, which the error page shows so a report can be matched with the log.
+type Recover struct {
+	// ErrorHandler renders the error page for browsers, the request id is in the context of the request it gets
+	ErrorHandler http.Handler
+}
+
+// errorJSON is the body of the 500 responses sent to API clients
+type errorJSON struct {
+	Error     string `json:"error"`
+	RequestID string `json:"request_id"`
+}
+
+// Apply wraps an http.Handler with the Recover middleware
+func (mw *Recover) Apply(next http.Handler) http.Handler {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn wraps an http.HandlerFunc with the Recover middleware
+func (mw *Recover) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if context.RequestID(r.Context()) == "" {
+			// AccessLog usually gives requests their id, but the error page needs one either way
+			id, err := rand.RequestID()
+			if err != nil {
+				logging.FromContext(r.Context()).Error(err)
+			}
+			r = withRequestID(r, nil, id)
+		}
+		tw := &trackingWriter{ResponseWriter: w}
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				// net/http aborts responses on purpose with it and keeps quiet about it
+				panic(rec)
+			}
+			id := context.RequestID(r.Context())
+			logging.FromContext(r.Context()).Error(fmt.Errorf("panic: %v", rec),
+				"method", r.Method,
+				"path", r.URL.Path,
+				"stack", string(debug.Stack()))
+			if tw.wroteHeader {
+				// part of the response is out already, all that is left is to cut it short
+				panic(http.ErrAbortHandler)
+			}
+			// whatever the handler set, like cookies, belongs to the response that failed
+			for k := range w.Header() {
+				if k != http.CanonicalHeaderKey("X-Request-ID") {
+					delete(w.Header(), k)
+				}
+			}
+			if wantsJSON(r) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(errorJSON{
+					Error:     http.StatusText(http.StatusInternalServerError),
+					RequestID: id,
+				})
+				return
+			}
+			mw.ErrorHandler.ServeHTTP(w, r)
+		}()
+		next(tw, r)
+	})
+}
+
+// wantsJSON reports whether the client asked for JSON rather than a page
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// trackingWriter notes whether the response has started, after which its status cannot change
+type trackingWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (tw *trackingWriter) WriteHeader(status int) {
+	tw.wroteHeader = true
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *trackingWriter) Write(b []byte) (int, error) {
+	tw.wroteHeader = true
+	return tw.ResponseWriter.Write(b)
+}
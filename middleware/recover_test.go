@@ -0,0 +1,155 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gophr.com/context"
+	"gophr.com/logging"
+)
+
+// errorPage stands in for the error page, showing the request id like the real one
+var errorPage = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte("error " + context.RequestID(r.Context())))
+})
+
+func TestRecover(t *testing.T) {
+	tests := []struct {
+		name     string
+		accept   string
+		wantJSON bool
+	}{
+		{name: "browser", accept: "text/html,application/xhtml+xml,*/*;q=0.8"},
+		{name: "no accept header"},
+		{name: "api client", accept: "application/json", wantJSON: true},
+		{name: "json or a page", accept: "application/json, text/html"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logMw := AccessLog{Logger: logging.New(&buf)}
+			recoverMw := Recover{ErrorHandler: errorPage}
+			h := logMw.Apply(recoverMw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+				http.SetCookie(w, &http.Cookie{Name: "remember_token", Value: "abc"})
+				w.Header().Set("Content-Type", "image/png")
+				panic("boom")
+			}))
+			r := httptest.NewRequest("GET", "/galleries/1", nil)
+			r.Header.Set("X-Request-ID", "req-1")
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != http.StatusInternalServerError {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+			}
+			if got := w.Header().Get("X-Request-ID"); got != "req-1" {
+				t.Errorf("X-Request-ID = %q, want it kept", got)
+			}
+			if got := w.Header().Get("Set-Cookie"); got != "" {
+				t.Errorf("Set-Cookie = %q, want the failed response's headers dropped", got)
+			}
+			if tt.wantJSON {
+				var body errorJSON
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+					t.Fatalf("body %q is not JSON: %v", w.Body.String(), err)
+				}
+				if body.RequestID != "req-1" || body.Error != "Internal Server Error" {
+					t.Errorf("body = %+v, want the error with the request id", body)
+				}
+				if got := w.Header().Get("Content-Type"); got != "application/json" {
+					t.Errorf("Content-Type = %q, want application/json", got)
+				}
+			} else if got := w.Body.String(); got != "error req-1" {
+				t.Errorf("body = %q, want the error page with the request id", got)
+			}
+
+			var line map[string]interface{}
+			if err := json.Unmarshal([]byte(strings.SplitN(buf.String(), "\n", 2)[0]), &line); err != nil {
+				t.Fatalf("log %q is not JSON lines: %v", buf.String(), err)
+			}
+			if line["request_id"] != "req-1" || line["path"] != "/galleries/1" || line["msg"] != "panic: boom" {
+				t.Errorf("logged %v, want the panic with the request", line)
+			}
+			if stack, _ := line["stack"].(string); !strings.Contains(stack, "recover_test.go") {
+				t.Error("the panic was logged without the stack of the handler")
+			}
+		})
+	}
+}
+
+// TestRecoverWithoutAccessLog checks that the error page gets a request id even when nothing gave the request one
+func TestRecoverWithoutAccessLog(t *testing.T) {
+	mw := Recover{ErrorHandler: errorPage}
+	h := mw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if body := w.Body.String(); body == "error " {
+		t.Error("the error page got no request id")
+	}
+}
+
+func TestRecoverAborts(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{
+			name: "aborted on purpose",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				panic(http.ErrAbortHandler)
+			},
+		},
+		{
+			name: "response started",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("<html>"))
+				panic("boom")
+			},
+		},
+		{
+			name: "status sent",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				panic("boom")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pageCalled bool
+			mw := Recover{ErrorHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				pageCalled = true
+			})}
+			h := mw.ApplyFn(tt.handler)
+			w := httptest.NewRecorder()
+			func() {
+				defer func() {
+					// net/http closes the connection on this panic, cutting the response short
+					if rec := recover(); rec != http.ErrAbortHandler {
+						t.Errorf("panicked with %v, want %v", rec, http.ErrAbortHandler)
+					}
+				}()
+				h(w, httptest.NewRequest("GET", "/", nil))
+			}()
+			if pageCalled {
+				t.Error("the error page was rendered into an aborted response")
+			}
+			if w.Code == http.StatusInternalServerError {
+				t.Error("the status of an aborted response was changed")
+			}
+		})
+	}
+}
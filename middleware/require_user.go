@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"net/http"
+	"net/url"
+
+	"gophr.com/context"
+	"gophr.com/models"
+)
+
+// User looks up the session a request's remember_token cookie belongs to and stores
+// it in the request context along with its user. Requests without a valid cookie pass
+// through anonymously.
+type User struct {
+	models.UserService
+	SessionService models.SessionService
+}
+
+// Apply wraps an http.Handler with the User middleware
+func (mw *User) Apply(next http.Handler) http.Handler {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn wraps an http.HandlerFunc with the User middleware
+func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie("remember_token")
+		if err != nil {
+			next(w, r)
+			return
+		}
+		session, err := mw.SessionService.Lookup(cookie.Value)
+		if err != nil {
+			next(w, r)
+			return
+		}
+		user, err := mw.ByID(session.UserID)
+		if err != nil {
+			next(w, r)
+			return
+		}
+		r = logUser(r, user.ID)
+		ctx := context.WithUser(r.Context(), user)
+		ctx = context.WithSession(ctx, session)
+		next(w, r.WithContext(ctx))
+	})
+}
+
+// RequireUser sends anonymous visitors to the login page, remembering where they were headed.
+// It expects the User middleware to have run first.
+type RequireUser struct{}
+
+// Apply wraps an http.Handler with the RequireUser middleware
+func (mw *RequireUser) Apply(next http.Handler) http.Handler {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn wraps an http.HandlerFunc with the RequireUser middleware
+func (mw *RequireUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if context.User(r.Context()) == nil {
+			// only pages can be returned to, a form post would turn into a GET of a route that does not exist
+			if r.Method != http.MethodGet {
+				http.Redirect(w, r, "/login", http.StatusFound)
+				return
+			}
+			http.Redirect(w, r, "/login?return_to="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+		next(w, r)
+	})
+}
@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gophr.com/context"
+	"gophr.com/models"
+)
+
+func TestUser(t *testing.T) {
+	us := models.NewMemUserService("pepper", "hmac-key")
+	ss := models.NewMemSessionService("hmac-key")
+	user := models.User{Name: "Jon", Email: "jon@example.com", Password: "correct horse battery"}
+	if err := us.Create(&user); err != nil {
+		t.Fatal(err)
+	}
+	session, err := ss.Start(user.ID, "test", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a session whose user is gone
+	orphan, err := ss.Start(user.ID+1, "test", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		cookie string
+		want   uint
+	}{
+		{"valid session", session.Token, user.ID},
+		{"no cookie", "", 0},
+		{"unknown token", "not-a-token", 0},
+		{"user deleted", orphan.Token, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mw := User{UserService: us, SessionService: ss}
+			var called bool
+			var gotUser *models.User
+			var gotSession *models.Session
+			h := mw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				gotUser = context.User(r.Context())
+				gotSession = context.Session(r.Context())
+			})
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: "remember_token", Value: tt.cookie})
+			}
+			h(httptest.NewRecorder(), r)
+			if !called {
+				t.Fatal("the handler was not called")
+			}
+			if tt.want == 0 {
+				if gotUser != nil || gotSession != nil {
+					t.Errorf("context has user %v and session %v, want neither", gotUser, gotSession)
+				}
+				return
+			}
+			if gotUser == nil || gotUser.ID != tt.want {
+				t.Fatalf("context user = %v, want user %d", gotUser, tt.want)
+			}
+			if gotSession == nil || gotSession.ID != session.ID {
+				t.Errorf("context session = %v, want session %d", gotSession, session.ID)
+			}
+		})
+	}
+}
+
+func TestRequireUser(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		target       string
+		user         *models.User
+		wantCalled   bool
+		wantLocation string
+	}{
+		{name: "logged in", method: "GET", target: "/galleries", user: &models.User{}, wantCalled: true},
+		{name: "logged in post", method: "POST", target: "/galleries", user: &models.User{}, wantCalled: true},
+		{name: "page", method: "GET", target: "/galleries/1/edit?tab=images", wantLocation: "/login?return_to=%2Fgalleries%2F1%2Fedit%3Ftab%3Dimages"},
+		{name: "form post", method: "POST", target: "/galleries/1/delete", wantLocation: "/login"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mw RequireUser
+			var called bool
+			h := mw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			})
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			if tt.user != nil {
+				r = r.WithContext(context.WithUser(r.Context(), tt.user))
+			}
+			w := httptest.NewRecorder()
+			h(w, r)
+			if called != tt.wantCalled {
+				t.Fatalf("handler called = %v, want %v", called, tt.wantCalled)
+			}
+			if tt.wantCalled {
+				return
+			}
+			if w.Code != http.StatusFound {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusFound)
+			}
+			if got := w.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", got, tt.wantLocation)
+			}
+		})
+	}
+}
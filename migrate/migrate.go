@@ -0,0 +1,208 @@
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	// ErrPending is returned when the database is missing migrations the code expects
+	ErrPending = errors.New("migrate: there are pending migrations, apply them before starting the server")
+
+	// ErrNothingToRollback is returned when rolling back a database that has no migrations applied
+	ErrNothingToRollback = errors.New("migrate: no migrations have been applied")
+
+	// ErrNoDown is returned when rolling back a migration that cannot be undone
+	ErrNoDown = errors.New("migrate: migration cannot be rolled back")
+)
+
+// Migration is a named change to the schema. Up applies it and Down undoes it,
+// both run inside a transaction together with the bookkeeping in schema_migrations.
+// IDs must never change once a migration has been released.
+type Migration struct {
+	ID   string
+	Up   func(tx *gorm.DB) error
+	Down func(tx *gorm.DB) error
+}
+
+// Status tells whether a migration has been applied, and when
+type Status struct {
+	ID        string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// schemaMigration is a row of the table recording the applied migrations
+type schemaMigration struct {
+	ID        string `gorm:"primary_key"`
+	AppliedAt time.Time
+}
+
+// TableName keeps the bookkeeping table name stable whatever gorm's naming rules are
+func (schemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// Migrator applies and rolls back an ordered list of migrations
+type Migrator struct {
+	db         *gorm.DB
+	migrations []Migration
+}
+
+// New creates a Migrator for the migrations, which are applied in the order given
+func New(db *gorm.DB, migrations []Migration) *Migrator {
+	return &Migrator{
+		db:         db,
+		migrations: migrations,
+	}
+}
+
+// applied returns the applied migrations keyed by id, creating the bookkeeping table if needed
+func (m *Migrator) applied() (map[string]schemaMigration, error) {
+	if err := m.db.AutoMigrate(&schemaMigration{}).Error; err != nil {
+		return nil, err
+	}
+	var rows []schemaMigration
+	if err := m.db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	applied := make(map[string]schemaMigration, len(rows))
+	for _, row := range rows {
+		applied[row.ID] = row
+	}
+	// a migration we do not know about means the database is ahead of this build
+	known := make(map[string]bool, len(m.migrations))
+	for _, mig := range m.migrations {
+		known[mig.ID] = true
+	}
+	for id := range applied {
+		if !known[id] {
+			return nil, fmt.Errorf("migrate: database has migration %q applied which this build does not know about", id)
+		}
+	}
+	return applied, nil
+}
+
+// Status lists every migration in order along with whether it has been applied
+func (m *Migrator) Status() ([]Status, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]Status, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		row, ok := applied[mig.ID]
+		statuses = append(statuses, Status{
+			ID:        mig.ID,
+			Applied:   ok,
+			AppliedAt: row.AppliedAt,
+		})
+	}
+	return statuses, nil
+}
+
+// Pending returns the migrations that have not been applied yet, in order
+func (m *Migrator) Pending() ([]Migration, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, mig := range m.migrations {
+		if _, ok := applied[mig.ID]; !ok {
+			pending = append(pending, mig)
+		}
+	}
+	return pending, nil
+}
+
+// Check returns ErrPending unless every migration has been applied
+func (m *Migrator) Check() error {
+	pending, err := m.Pending()
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return ErrPending
+	}
+	return nil
+}
+
+// Up applies every pending migration in order and returns the ids of the ones applied.
+// It stops at the first failure, leaving the migrations before it applied.
+func (m *Migrator) Up() ([]string, error) {
+	pending, err := m.Pending()
+	if err != nil {
+		return nil, err
+	}
+	var done []string
+	for _, mig := range pending {
+		err := m.inTx(func(tx *gorm.DB) error {
+			if err := mig.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&schemaMigration{ID: mig.ID, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return done, fmt.Errorf("migrate: applying %s: %v", mig.ID, err)
+		}
+		done = append(done, mig.ID)
+	}
+	return done, nil
+}
+
+// Down rolls back the most recently applied migration and returns its id
+func (m *Migrator) Down() (string, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return "", err
+	}
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		mig := m.migrations[i]
+		if _, ok := applied[mig.ID]; !ok {
+			continue
+		}
+		if mig.Down == nil {
+			return "", ErrNoDown
+		}
+		err := m.inTx(func(tx *gorm.DB) error {
+			if err := mig.Down(tx); err != nil {
+				return err
+			}
+			return tx.Where("id = ?", mig.ID).Delete(&schemaMigration{}).Error
+		})
+		if err != nil {
+			return "", fmt.Errorf("migrate: rolling back %s: %v", mig.ID, err)
+		}
+		return mig.ID, nil
+	}
+	return "", ErrNothingToRollback
+}
+
+// Reset rolls back every applied migration, newest first
+func (m *Migrator) Reset() error {
+	for {
+		_, err := m.Down()
+		if err == ErrNothingToRollback {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (m *Migrator) inTx(fn func(tx *gorm.DB) error) error {
+	tx := m.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
@@ -0,0 +1,199 @@
+package migrate
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+
+	// imported for the effects
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to :memory: gets a database of its own
+	db.DB().SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// createTable returns a migration creating a table with a single column, and dropping it again
+func createTable(id, table string) Migration {
+	return Migration{
+		ID: id,
+		Up: func(tx *gorm.DB) error {
+			return tx.Exec("CREATE TABLE " + table + " (id integer)").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Exec("DROP TABLE " + table).Error
+		},
+	}
+}
+
+func testMigrations() []Migration {
+	return []Migration{
+		createTable("0001_a", "a"),
+		createTable("0002_b", "b"),
+		createTable("0003_c", "c"),
+	}
+}
+
+func ids(statuses []Status) (applied, pending []string) {
+	for _, s := range statuses {
+		if s.Applied {
+			applied = append(applied, s.ID)
+		} else {
+			pending = append(pending, s.ID)
+		}
+	}
+	return applied, pending
+}
+
+func TestUp(t *testing.T) {
+	db := newTestDB(t)
+	// the first two are released, the third comes with a newer build
+	if _, err := New(db, testMigrations()[:2]).Up(); err != nil {
+		t.Fatal(err)
+	}
+	m := New(db, testMigrations())
+	if err := m.Check(); err != ErrPending {
+		t.Errorf("Check() with a migration pending = %v, want %v", err, ErrPending)
+	}
+	done, err := m.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(done, []string{"0003_c"}) {
+		t.Errorf("Up() applied %v, want only the pending one", done)
+	}
+	for _, table := range []string{"a", "b", "c"} {
+		if !db.HasTable(table) {
+			t.Errorf("table %s was not created", table)
+		}
+	}
+	if err := m.Check(); err != nil {
+		t.Errorf("Check() after Up() = %v", err)
+	}
+	if done, err := m.Up(); err != nil || len(done) != 0 {
+		t.Errorf("Up() with nothing pending = %v, %v, want nothing applied", done, err)
+	}
+	statuses, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range statuses {
+		if !s.Applied || s.AppliedAt.IsZero() {
+			t.Errorf("Status() of %s = %+v, want it applied with a time", s.ID, s)
+		}
+	}
+}
+
+func TestUpFailure(t *testing.T) {
+	db := newTestDB(t)
+	errBroken := errors.New("broken")
+	migrations := testMigrations()
+	// creates its table and then fails, the table must not stay behind
+	migrations[1].Up = func(tx *gorm.DB) error {
+		if err := tx.Exec("CREATE TABLE b (id integer)").Error; err != nil {
+			return err
+		}
+		return errBroken
+	}
+	m := New(db, migrations)
+	done, err := m.Up()
+	if err == nil || !strings.Contains(err.Error(), "applying 0002_b: broken") {
+		t.Errorf("Up() error = %v, want the failing migration named", err)
+	}
+	if !reflect.DeepEqual(done, []string{"0001_a"}) {
+		t.Errorf("Up() applied %v, want the ones before the failure", done)
+	}
+	if db.HasTable("b") || db.HasTable("c") {
+		t.Error("the failed migration, or one after it, left a table behind")
+	}
+	statuses, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, pending := ids(statuses)
+	if !reflect.DeepEqual(applied, []string{"0001_a"}) || !reflect.DeepEqual(pending, []string{"0002_b", "0003_c"}) {
+		t.Errorf("Status() applied %v and pending %v", applied, pending)
+	}
+}
+
+func TestDown(t *testing.T) {
+	db := newTestDB(t)
+	m := New(db, testMigrations())
+	if _, err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"0003_c", "0002_b"} {
+		id, err := m.Down()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != want {
+			t.Errorf("Down() rolled back %s, want %s", id, want)
+		}
+	}
+	if db.HasTable("b") || db.HasTable("c") || !db.HasTable("a") {
+		t.Error("Down() did not undo exactly the newest migrations")
+	}
+	pending, err := m.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].ID != "0002_b" {
+		t.Errorf("Pending() = %v, want the two rolled back in order", pending)
+	}
+
+	if err := m.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if db.HasTable("a") {
+		t.Error("Reset() left table a")
+	}
+	if _, err := m.Down(); err != ErrNothingToRollback {
+		t.Errorf("Down() with nothing applied = %v, want %v", err, ErrNothingToRollback)
+	}
+}
+
+func TestDownWithoutDown(t *testing.T) {
+	db := newTestDB(t)
+	migrations := testMigrations()
+	migrations[2].Down = nil
+	m := New(db, migrations)
+	if _, err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Down(); err != ErrNoDown {
+		t.Errorf("Down() of a migration without one = %v, want %v", err, ErrNoDown)
+	}
+	if err := m.Check(); err != nil {
+		t.Errorf("the migration was marked rolled back: %v", err)
+	}
+}
+
+func TestUnknownMigration(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := New(db, testMigrations()).Up(); err != nil {
+		t.Fatal(err)
+	}
+	// an older build does not know about the newest migration
+	m := New(db, testMigrations()[:2])
+	if _, err := m.Status(); err == nil || !strings.Contains(err.Error(), "0003_c") {
+		t.Errorf("Status() error = %v, want the unknown migration named", err)
+	}
+	if err := m.Check(); err == nil {
+		t.Error("Check() of a database ahead of the build succeeded")
+	}
+	if _, err := m.Up(); err == nil {
+		t.Error("Up() on a database ahead of the build succeeded")
+	}
+}
@@ -0,0 +1,66 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// PurgeDeletedAccounts permanently removes the accounts whose deletion is due, along with
+// their galleries, image files, sessions and tokens, and returns how many it removed.
+// It stops at the first account that fails. Every step can safely run twice, so that
+// account is finished off by the next run.
+func (s *Services) PurgeDeletedAccounts() (int, error) {
+	users, err := s.User.DueForDeletion(time.Now())
+	if err != nil {
+		return 0, err
+	}
+	for i := range users {
+		if err := s.purgeAccount(&users[i]); err != nil {
+			return i, fmt.Errorf("models: purging user %d: %v", users[i].ID, err)
+		}
+	}
+	return len(users), nil
+}
+
+// purgeAccount removes the files first, the rows pointing to them are what lets a failed
+// purge find them again
+func (s *Services) purgeAccount(user *User) error {
+	// galleries and images deleted earlier only had their rows soft deleted, they go too
+	var galleryIDs []uint
+	err := s.db.Unscoped().Model(&Gallery{}).Where("user_id = ?", user.ID).Pluck("id", &galleryIDs).Error
+	if err != nil {
+		return err
+	}
+	if len(galleryIDs) > 0 {
+		var images []Image
+		if err := s.db.Unscoped().Where("gallery_id IN (?)", galleryIDs).Find(&images).Error; err != nil {
+			return err
+		}
+		for i := range images {
+			if err := s.Image.Remove(&images[i]); err != nil {
+				return err
+			}
+		}
+	}
+	if s.LoginThrottle != nil {
+		if err := s.LoginThrottle.Succeeded(user.Email); err != nil {
+			return err
+		}
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		tx = tx.Unscoped()
+		if len(galleryIDs) > 0 {
+			if err := tx.Where("gallery_id IN (?)", galleryIDs).Delete(&Image{}).Error; err != nil {
+				return err
+			}
+		}
+		for _, model := range []interface{}{&Gallery{}, &Session{}, &pwReset{}, &recoveryCode{}} {
+			if err := tx.Where("user_id = ?", user.ID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Where("id = ?", user.ID).Delete(&User{}).Error
+	})
+}
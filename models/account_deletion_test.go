@@ -0,0 +1,149 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"gophr.com/storage"
+)
+
+// accountWithData creates a user with a gallery and an image in it, a gallery they deleted
+// along with its image, a session, a password reset and recovery codes
+func accountWithData(t *testing.T, s *Services, email string) (*User, []string) {
+	t.Helper()
+	us := s.User.(*userService)
+	user := createVerifiedUser(t, us, email)
+	var files []string
+	for i, title := range []string{"Holiday", "Deleted"} {
+		gallery := Gallery{UserID: user.ID, Title: title}
+		if err := s.Gallery.Create(&gallery); err != nil {
+			t.Fatal(err)
+		}
+		filename := fmt.Sprintf("photo%d.png", i)
+		if _, err := s.Image.Upload(gallery.ID, filename, bytes.NewReader(testPNG(t, 4, 4, 200))); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, fmt.Sprintf("galleries/%d/%s", gallery.ID, filename))
+		if title == "Deleted" {
+			if err := s.Gallery.Delete(gallery.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := s.Session.Start(user.ID, "test", "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	initiateReset(t, us, user)
+	enableTwoFactor(t, us, user)
+	return user, files
+}
+
+// scheduleDeletion marks the account of a user to be deleted at due
+func scheduleDeletion(t *testing.T, us UserService, user *User, due time.Time) {
+	t.Helper()
+	user.DeletionDueAt = &due
+	if err := us.Update(user); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countRows returns how many rows of a table belong to a user, deleted ones included
+func countRows(t *testing.T, s *Services, table, column string, userID uint) int {
+	t.Helper()
+	var n int
+	if err := s.db.Unscoped().Table(table).Where(column+" = ?", userID).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestPurgeDeletedAccounts(t *testing.T) {
+	store, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServices(t, WithImage(store, 1<<20))
+	due, dueFiles := accountWithData(t, s, "due@example.com")
+	scheduleDeletion(t, s.User, due, time.Now().Add(-time.Minute))
+	later, laterFiles := accountWithData(t, s, "later@example.com")
+	scheduleDeletion(t, s.User, later, time.Now().Add(time.Hour))
+	kept, keptFiles := accountWithData(t, s, "kept@example.com")
+
+	n, err := s.PurgeDeletedAccounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("PurgeDeletedAccounts() = %d, want 1", n)
+	}
+
+	tables := []struct{ table, column string }{
+		{"users", "id"},
+		{"galleries", "user_id"},
+		{"sessions", "user_id"},
+		{"pw_resets", "user_id"},
+		{"recovery_codes", "user_id"},
+	}
+	for _, tt := range tables {
+		if got := countRows(t, s, tt.table, tt.column, due.ID); got != 0 {
+			t.Errorf("%d rows left in %s for the purged account", got, tt.table)
+		}
+		for _, user := range []*User{later, kept} {
+			if got := countRows(t, s, tt.table, tt.column, user.ID); got == 0 {
+				t.Errorf("%s lost the rows of %s", tt.table, user.Email)
+			}
+		}
+	}
+	var images int
+	if err := s.db.Unscoped().Model(&Image{}).Count(&images).Error; err != nil {
+		t.Fatal(err)
+	}
+	if images != len(laterFiles)+len(keptFiles) {
+		t.Errorf("%d images left, want the %d of the accounts kept", images, len(laterFiles)+len(keptFiles))
+	}
+	for _, file := range dueFiles {
+		if _, err := store.Stat(file); err != storage.ErrNotExist {
+			t.Errorf("Stat(%s) of the purged account = %v, want %v", file, err, storage.ErrNotExist)
+		}
+	}
+	for _, file := range append(laterFiles, keptFiles...) {
+		if _, err := store.Stat(file); err != nil {
+			t.Errorf("Stat(%s) of an account kept = %v", file, err)
+		}
+	}
+
+	// nothing else is due, so running again removes nothing
+	if n, err := s.PurgeDeletedAccounts(); err != nil || n != 0 {
+		t.Errorf("PurgeDeletedAccounts() again = %d, %v, want 0, nil", n, err)
+	}
+}
+
+func TestPurgeDeletedAccountsAfterFailure(t *testing.T) {
+	s := newTestServices(t)
+	user, _ := accountWithData(t, s, "due@example.com")
+	scheduleDeletion(t, s.User, user, time.Now().Add(-time.Minute))
+
+	// a purge that stopped after removing the files leaves the rows to find them by
+	var images []Image
+	if err := s.db.Unscoped().Find(&images).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i := range images {
+		if err := s.Image.Remove(&images[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := s.PurgeDeletedAccounts()
+	if err != nil {
+		t.Fatalf("PurgeDeletedAccounts() after a partial purge = %v", err)
+	}
+	if n != 1 {
+		t.Errorf("PurgeDeletedAccounts() = %d, want 1", n)
+	}
+	if got := countRows(t, s, "users", "id", user.ID); got != 0 {
+		t.Error("the account was not purged")
+	}
+}
@@ -0,0 +1,18 @@
+package models
+
+import "testing"
+
+// testBackends returns the services on SQLite and the ones kept in memory, so a test can
+// run against both and check the in-memory tables behave like the database. Only the
+// services that have an in-memory version are set on the second.
+func testBackends(t *testing.T) map[string]*Services {
+	t.Helper()
+	return map[string]*Services{
+		"gorm": newTestServices(t),
+		"mem": {
+			User:          NewMemUserService(testPepper, testHMACKey),
+			Session:       NewMemSessionService(testHMACKey),
+			LoginThrottle: NewMemLoginThrottle(testHMACKey),
+		},
+	}
+}
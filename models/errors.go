@@ -0,0 +1,42 @@
+package models
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PublicError is implemented by the errors whose message can be shown to users. Any other
+// error, like one from the database, may give away details of the server and is not.
+type PublicError interface {
+	error
+	Public() string
+}
+
+// modelError is the type of the errors the services return for things users did, like
+// entering the wrong password, as opposed to things that went wrong on the server
+type modelError string
+
+func (e modelError) Error() string {
+	return string(e)
+}
+
+// Public returns the message without the package prefix, written as a sentence
+func (e modelError) Public() string {
+	return publicMessage(string(e))
+}
+
+// publicMessage turns "models: email address is already taken" into "Email address is already taken."
+func publicMessage(msg string) string {
+	msg = strings.TrimPrefix(msg, "models: ")
+	r, size := utf8.DecodeRuneInString(msg)
+	msg = string(unicode.ToUpper(r)) + msg[size:]
+	if !strings.HasSuffix(msg, ".") {
+		msg += "."
+	}
+	return msg
+}
+
+var _ PublicError = modelError("")
+var _ PublicError = invalidError("")
+var _ PublicError = &ValidationError{}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPublicMessage(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want string
+	}{
+		{"models: email address is already taken", "Email address is already taken."},
+		{"models: resource not found.", "Resource not found."},
+		{"no prefix", "No prefix."},
+		{"models: éclair is not a password", "Éclair is not a password."},
+		// only the leading prefix is removed
+		{"models: see models: for details", "See models: for details."},
+	}
+	for _, tt := range tests {
+		if got := publicMessage(tt.msg); got != tt.want {
+			t.Errorf("publicMessage(%q) = %q, want %q", tt.msg, got, tt.want)
+		}
+	}
+}
+
+func TestPublicError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantPublic string
+	}{
+		{"model error", ErrPasswordIncorrect, "Incorrect password provided."},
+		{"invalid value", ErrEmailTaken, "Email address is already taken."},
+		{"validation error", &ValidationError{Fields: map[string]error{"email": ErrEmailRequired}}, "Email address is required."},
+		// anything else, like a database error, is kept from users
+		{"other error", errors.New("models: pq: connection refused"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pErr, ok := tt.err.(PublicError)
+			if ok != (tt.wantPublic != "") {
+				t.Fatalf("%v implements PublicError = %v", tt.err, ok)
+			}
+			if !ok {
+				return
+			}
+			if got := pErr.Public(); got != tt.wantPublic {
+				t.Errorf("Public() = %q, want %q", got, tt.wantPublic)
+			}
+		})
+	}
+}
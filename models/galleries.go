@@ -0,0 +1,196 @@
+package models
+
+import (
+	"errors"
+
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	// ErrUserIDRequired is a custom error we return when a gallery is created or updated without an owner
+	ErrUserIDRequired = errors.New("models: user ID is required")
+
+	// ErrTitleRequired is a custom error we return when a gallery is created or updated without a title
+	ErrTitleRequired error = modelError("models: title is required")
+)
+
+// Gallery is the database model for an album of images owned by a user
+type Gallery struct {
+	gorm.Model
+	UserID uint    `gorm:"not null;index"`
+	Title  string  `gorm:"not null"`
+	Images []Image `gorm:"-"`
+
+	// Published galleries can be seen by anyone, the rest only by their owner
+	Published bool `gorm:"not null;default:false"`
+}
+
+// GalleryDB is used to interact with the galleries database
+type GalleryDB interface {
+	// Methods for querying galleries
+	ByID(id uint) (*Gallery, error)
+	ByUserID(userID uint) ([]Gallery, error)
+
+	// Methods for altering galleries
+	Create(gallery *Gallery) error
+	Update(gallery *Gallery) error
+	Delete(id uint) error
+
+	// Used to close a DB connection
+	Close() error
+}
+
+// GalleryService is a set of methods used to manipulate and work with the gallery model
+type GalleryService interface {
+	GalleryDB
+}
+
+type galleryService struct {
+	GalleryDB
+}
+
+type galleryGorm struct {
+	db *gorm.DB
+}
+
+type galleryValidator struct {
+	GalleryDB
+}
+
+type galleryValFn func(*Gallery) error
+
+// NewGalleryService is an abstraction layer providing us access to the galleries table through db
+func NewGalleryService(db *gorm.DB) GalleryService {
+	return &galleryService{
+		GalleryDB: &galleryValidator{
+			GalleryDB: &galleryGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+/*
+	********************************
+	********************************
+	Start of functions related to db
+	********************************
+	********************************
+*/
+
+// ByID is used to search a gallery by ID from the db
+func (gg *galleryGorm) ByID(id uint) (*Gallery, error) {
+	var gallery Gallery
+	db := gg.db.Where("id = ?", id)
+	err := first(db, &gallery)
+	if err != nil {
+		return nil, err
+	}
+	return &gallery, nil
+}
+
+// ByUserID is used to look up all the galleries owned by a user
+func (gg *galleryGorm) ByUserID(userID uint) ([]Gallery, error) {
+	var galleries []Gallery
+	err := gg.db.Where("user_id = ?", userID).Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+// Create is used to add a new gallery
+func (gg *galleryGorm) Create(gallery *Gallery) error {
+	return gg.db.Create(gallery).Error
+}
+
+// Update is used to update gallery data in the db
+func (gg *galleryGorm) Update(gallery *Gallery) error {
+	return gg.db.Save(gallery).Error
+}
+
+// Delete is used to delete a gallery from the db
+func (gg *galleryGorm) Delete(id uint) error {
+	gallery := Gallery{Model: gorm.Model{ID: id}}
+	return gg.db.Delete(&gallery).Error
+}
+
+// Close is a function that is used to close the connection with the db
+func (gg *galleryGorm) Close() error {
+	return gg.db.Close()
+}
+
+/*
+	***********************************************
+	***********************************************
+	Start of validation and normalization functions
+	***********************************************
+	***********************************************
+*/
+
+// Validation code for Create
+func (gv *galleryValidator) Create(gallery *Gallery) error {
+	err := runGalleryValFns(gallery,
+		gv.userIDRequired,
+		gv.titleRequired)
+	if err != nil {
+		return err
+	}
+	return gv.GalleryDB.Create(gallery)
+}
+
+// Validation code for Update
+func (gv *galleryValidator) Update(gallery *Gallery) error {
+	err := runGalleryValFns(gallery,
+		gv.userIDRequired,
+		gv.titleRequired)
+	if err != nil {
+		return err
+	}
+	return gv.GalleryDB.Update(gallery)
+}
+
+// Validation code for Delete
+func (gv *galleryValidator) Delete(id uint) error {
+	var gallery Gallery
+	gallery.ID = id
+	if err := runGalleryValFns(&gallery, gv.nonZeroID); err != nil {
+		return err
+	}
+	return gv.GalleryDB.Delete(id)
+}
+
+func (gv *galleryValidator) userIDRequired(gallery *Gallery) error {
+	if gallery.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (gv *galleryValidator) titleRequired(gallery *Gallery) error {
+	if gallery.Title == "" {
+		return ErrTitleRequired
+	}
+	return nil
+}
+
+func (gv *galleryValidator) nonZeroID(gallery *Gallery) error {
+	if gallery.ID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+func runGalleryValFns(gallery *Gallery, fns ...galleryValFn) error {
+	for _, fn := range fns {
+		if err := fn(gallery); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// simple statements to check whether the interface is implemented properly
+// will give error in compile time, if not implemented properly
+var _ GalleryDB = &galleryGorm{}
+var _ GalleryService = &galleryService{}
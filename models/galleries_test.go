@@ -0,0 +1,86 @@
+package models
+
+import "testing"
+
+func TestGalleryValidation(t *testing.T) {
+	gs := newTestServices(t).Gallery
+	tests := []struct {
+		name    string
+		gallery Gallery
+		wantErr error
+	}{
+		{"valid", Gallery{UserID: 1, Title: "Holiday"}, nil},
+		{"no owner", Gallery{Title: "Holiday"}, ErrUserIDRequired},
+		{"no title", Gallery{UserID: 1}, ErrTitleRequired},
+		{"nothing", Gallery{}, ErrUserIDRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gallery := tt.gallery
+			if err := gs.Create(&gallery); err != tt.wantErr {
+				t.Fatalf("Create() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if gallery.ID != 0 {
+					t.Error("Create() stored a gallery that is not valid")
+				}
+				return
+			}
+			// an update is held to the same rules
+			gallery.Title = ""
+			if err := gs.Update(&gallery); err != ErrTitleRequired {
+				t.Errorf("Update() without a title error = %v, want %v", err, ErrTitleRequired)
+			}
+		})
+	}
+}
+
+func TestGalleryService(t *testing.T) {
+	gs := newTestServices(t).Gallery
+	holiday := Gallery{UserID: 1, Title: "Holiday"}
+	for _, g := range []*Gallery{&holiday, {UserID: 1, Title: "Pets"}, {UserID: 2, Title: "Food"}} {
+		if err := gs.Create(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := gs.ByID(holiday.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "Holiday" || got.UserID != 1 || got.Published {
+		t.Errorf("ByID() = %+v, want the unpublished Holiday gallery of user 1", got)
+	}
+	galleries, err := gs.ByUserID(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(galleries) != 2 {
+		t.Errorf("ByUserID(1) returned %d galleries, want 2", len(galleries))
+	}
+	if galleries, err := gs.ByUserID(3); err != nil || len(galleries) != 0 {
+		t.Errorf("ByUserID() of a user without galleries = %v, %v, want none", galleries, err)
+	}
+
+	holiday.Title = "Summer holiday"
+	holiday.Published = true
+	if err := gs.Update(&holiday); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := gs.ByID(holiday.ID); err != nil || got.Title != "Summer holiday" || !got.Published {
+		t.Errorf("ByID() after Update() = %+v, %v, want the new title, published", got, err)
+	}
+
+	if err := gs.Delete(0); err != ErrIDInvalid {
+		t.Errorf("Delete(0) error = %v, want %v", err, ErrIDInvalid)
+	}
+	if err := gs.Delete(holiday.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gs.ByID(holiday.ID); err != ErrNotFound {
+		t.Errorf("ByID() after Delete() error = %v, want %v", err, ErrNotFound)
+	}
+	if galleries, err := gs.ByUserID(1); err != nil || len(galleries) != 1 {
+		t.Errorf("ByUserID(1) after Delete() returned %d galleries, %v, want 1", len(galleries), err)
+	}
+}
@@ -0,0 +1,508 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"gophr.com/imaging"
+	"gophr.com/storage"
+
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	// ErrGalleryIDRequired is a custom error we return when an image is created without a gallery
+	ErrGalleryIDRequired = errors.New("models: gallery ID is required")
+
+	// ErrFilenameInvalid is a custom error we return when an uploaded image has an unusable file name
+	ErrFilenameInvalid error = modelError("models: image file name is not valid")
+
+	// ErrFilenameTaken is a custom error we return when the gallery already has an image with the same file name
+	ErrFilenameTaken error = modelError("models: gallery already has an image with that file name")
+
+	// ErrImageTypeInvalid is a custom error we return when an uploaded file is not a supported image
+	ErrImageTypeInvalid error = modelError("models: only JPEG, PNG, GIF and WebP images are allowed")
+
+	// ErrImageTooLarge is a custom error we return when an uploaded image is over the size limit
+	ErrImageTooLarge error = modelError("models: image file is too large")
+
+	// ErrImageTooManyPixels is a custom error we return when an uploaded image is wider and taller than we can process
+	ErrImageTooManyPixels error = modelError("models: image dimensions are too large")
+)
+
+// sniffLen is the number of bytes http.DetectContentType looks at
+const sniffLen = 512
+
+// the directories of a gallery the copies of its images with metadata stripped are kept in
+const (
+	publicDir        = "public"
+	publicLocatedDir = "public-located"
+)
+
+// imageContentTypes holds the content types we accept for uploaded images
+var imageContentTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// Image is the database model for a photo uploaded to a gallery
+type Image struct {
+	gorm.Model
+	GalleryID   uint   `gorm:"not null;index"`
+	Filename    string `gorm:"not null"`
+	ContentType string `gorm:"not null"`
+	Size        int64
+	Width       int
+	Height      int
+
+	// Fields read from the EXIF metadata of the photo
+	TakenAt      *time.Time
+	CameraMake   string
+	CameraModel  string
+	LensModel    string
+	ExposureTime string
+	FNumber      float64
+	FocalLength  float64
+	ISO          int
+	HasLocation  bool
+	Latitude     float64
+	Longitude    float64
+}
+
+// Path returns the URL path the image is served from
+func (i Image) Path() string {
+	return fmt.Sprintf("/galleries/%v/images/%v", i.GalleryID, url.PathEscape(i.Filename))
+}
+
+// Camera returns the make and model of the camera that took the photo
+func (i Image) Camera() string {
+	// most makers repeat their name at the start of the model
+	if strings.HasPrefix(i.CameraModel, i.CameraMake) {
+		return i.CameraModel
+	}
+	return strings.TrimSpace(i.CameraMake + " " + i.CameraModel)
+}
+
+// InfoPath returns the URL path of the page showing the details of the image
+func (i Image) InfoPath() string {
+	return i.Path() + "/info"
+}
+
+// setMetadata copies the EXIF fields worth keeping onto the image
+func (i *Image) setMetadata(m *imaging.Metadata) {
+	i.TakenAt = nil
+	if !m.TakenAt.IsZero() {
+		takenAt := m.TakenAt
+		i.TakenAt = &takenAt
+	}
+	i.CameraMake = m.Make
+	i.CameraModel = m.Model
+	i.LensModel = m.LensModel
+	i.ExposureTime = m.ExposureTime
+	i.FNumber = m.FNumber
+	i.FocalLength = m.FocalLength
+	i.ISO = m.ISO
+	i.HasLocation = m.HasLocation
+	i.Latitude = m.Latitude
+	i.Longitude = m.Longitude
+}
+
+// key returns the storage key the image file is kept under
+func (i *Image) key() string {
+	return path.Join(galleryImageKey(i.GalleryID), i.Filename)
+}
+
+// publicKey returns the storage key of the copy of the image shown to visitors, the one
+// with GPS coordinates left in is only stored for images that have them
+func (i *Image) publicKey(keepLocation bool) string {
+	if keepLocation && i.HasLocation {
+		return path.Join(galleryImageKey(i.GalleryID), publicLocatedDir, i.Filename)
+	}
+	return path.Join(galleryImageKey(i.GalleryID), publicDir, i.Filename)
+}
+
+// galleryImageKey returns the storage key prefix of the images of a gallery
+func galleryImageKey(galleryID uint) string {
+	return fmt.Sprintf("galleries/%v", galleryID)
+}
+
+// ImageDB is used to interact with the images database
+type ImageDB interface {
+	// Methods for querying images
+	All() ([]Image, error)
+	ByID(id uint) (*Image, error)
+	ByGalleryID(galleryID uint) ([]Image, error)
+	ByFilename(galleryID uint, filename string) (*Image, error)
+
+	// Methods for altering images
+	Create(image *Image) error
+	Update(image *Image) error
+	Delete(id uint) error
+
+	// Used to close a DB connection
+	Close() error
+}
+
+// ImageService is a set of methods used to store, look up and remove the images of a gallery
+type ImageService interface {
+	// Upload sniffs and stores the image read from r and records it in the db
+	Upload(galleryID uint, filename string, r io.Reader) (*Image, error)
+	// Open returns the stored file of an image, the caller must close it
+	Open(image *Image) (io.ReadCloser, error)
+	// OpenPublic returns the stored file of an image with identifying metadata stripped
+	OpenPublic(image *Image, keepLocation bool) (io.ReadCloser, error)
+	// OpenVariant returns the stored file of a resized variant of an image, the caller must close it
+	OpenVariant(image *Image, variant string) (io.ReadCloser, error)
+	// RegenerateVariants rebuilds the resized variants of every image from the current presets
+	RegenerateVariants() error
+	// Remove deletes the stored file of an image and its variants along with its record
+	Remove(image *Image) error
+	ImageDB
+}
+
+type imageService struct {
+	ImageDB
+	validator *imageValidator
+	store     storage.Store
+	maxBytes  int64
+}
+
+type imageGorm struct {
+	db *gorm.DB
+}
+
+type imageValidator struct {
+	ImageDB
+}
+
+type imageValFn func(*Image) error
+
+// NewImageService is an abstraction layer providing us access to the images table through db
+// along with the store the image files are kept in. Images over maxBytes are turned away.
+func NewImageService(db *gorm.DB, store storage.Store, maxBytes int64) ImageService {
+	iv := &imageValidator{
+		ImageDB: &imageGorm{
+			db: db,
+		},
+	}
+	return &imageService{
+		ImageDB:   iv,
+		validator: iv,
+		store:     store,
+		maxBytes:  maxBytes,
+	}
+}
+
+// Upload is used to store a new image in a gallery
+func (is *imageService) Upload(galleryID uint, filename string, r io.Reader) (*Image, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return nil, ErrImageTypeInvalid
+		}
+		return nil, err
+	}
+	head = head[:n]
+
+	image := Image{
+		GalleryID:   galleryID,
+		Filename:    filename,
+		ContentType: http.DetectContentType(head),
+	}
+	// the file name decides where the image is stored, so it is checked before anything is
+	if err := is.validator.checkNew(&image); err != nil {
+		return nil, err
+	}
+
+	// the record is only created once the files are in place, so nobody is
+	// shown an image that cannot be served
+	if err := is.storeNew(&image, io.MultiReader(bytes.NewReader(head), r)); err != nil {
+		if err != ErrFilenameTaken {
+			is.removeFiles(&image)
+		}
+		return nil, err
+	}
+	return &image, nil
+}
+
+// storeNew writes the original of a new image along with its variants and creates its record
+func (is *imageService) storeNew(image *Image, r io.Reader) error {
+	// reading a byte past the limit is enough to tell the image is too large
+	counter := &countingReader{r: io.LimitReader(r, is.maxBytes+1)}
+	if err := is.store.Put(image.key(), counter); err != nil {
+		return err
+	}
+	image.Size = counter.n
+	if image.Size > is.maxBytes {
+		return ErrImageTooLarge
+	}
+	if err := is.generateVariants(image); err != nil {
+		return err
+	}
+	// the unique index turns away a concurrent upload of the same file name
+	// that got here first, its files are then left in place
+	return is.ImageDB.Create(image)
+}
+
+// Open is used to read the stored file of an image
+func (is *imageService) Open(image *Image) (io.ReadCloser, error) {
+	return is.store.Get(image.key())
+}
+
+// OpenPublic is used to read an image the way it is shown to visitors: serial numbers are
+// always stripped from its metadata and GPS coordinates are stripped unless keepLocation is set.
+// The stripped copies are made when the image is uploaded, images stored before they existed
+// are stripped on every read until the server is run with -regen-variants.
+func (is *imageService) OpenPublic(image *Image, keepLocation bool) (io.ReadCloser, error) {
+	f, err := is.store.Get(image.publicKey(keepLocation))
+	if err != storage.ErrNotExist {
+		return f, err
+	}
+	rc, err := is.store.Get(image.key())
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	return readSeekCloser{bytes.NewReader(imaging.StripMetadata(data, keepLocation))}, nil
+}
+
+// Remove is used to delete an image file, its variants and its record
+func (is *imageService) Remove(image *Image) error {
+	if err := is.removeFiles(image); err != nil {
+		return err
+	}
+	return is.ImageDB.Delete(image.ID)
+}
+
+// removeFiles deletes the stored original of an image and everything made from it
+func (is *imageService) removeFiles(image *Image) error {
+	if err := is.removeVariants(image, nil); err != nil {
+		return err
+	}
+	return is.store.Delete(image.key())
+}
+
+// readSeekCloser lets an in-memory image be served like a file
+type readSeekCloser struct {
+	*bytes.Reader
+}
+
+func (readSeekCloser) Close() error {
+	return nil
+}
+
+// countingReader keeps track of how many bytes have been read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+/*
+	********************************
+	********************************
+	Start of functions related to db
+	********************************
+	********************************
+*/
+
+// All is used to look up every image in the db
+func (ig *imageGorm) All() ([]Image, error) {
+	var images []Image
+	err := ig.db.Order("id").Find(&images).Error
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// ByID is used to search an image by ID from the db
+func (ig *imageGorm) ByID(id uint) (*Image, error) {
+	var image Image
+	err := first(ig.db.Where("id = ?", id), &image)
+	if err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+// ByGalleryID is used to look up all the images of a gallery
+func (ig *imageGorm) ByGalleryID(galleryID uint) ([]Image, error) {
+	var images []Image
+	err := ig.db.Where("gallery_id = ?", galleryID).Order("id").Find(&images).Error
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// ByFilename is used to search the image of a gallery with the given file name
+func (ig *imageGorm) ByFilename(galleryID uint, filename string) (*Image, error) {
+	var image Image
+	db := ig.db.Where("gallery_id = ? AND filename = ?", galleryID, filename)
+	err := first(db, &image)
+	if err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+// Create is used to add a new image record
+func (ig *imageGorm) Create(image *Image) error {
+	return ig.db.Create(image).Error
+}
+
+// Update is used to update image data in the db
+func (ig *imageGorm) Update(image *Image) error {
+	return ig.db.Save(image).Error
+}
+
+// Delete is used to delete an image record from the db
+func (ig *imageGorm) Delete(id uint) error {
+	image := Image{Model: gorm.Model{ID: id}}
+	return ig.db.Delete(&image).Error
+}
+
+// Close is a function that is used to close the connection with the db
+func (ig *imageGorm) Close() error {
+	return ig.db.Close()
+}
+
+/*
+	***********************************************
+	***********************************************
+	Start of validation and normalization functions
+	***********************************************
+	***********************************************
+*/
+
+// Validation code for Create
+func (iv *imageValidator) Create(image *Image) error {
+	if err := iv.checkNew(image); err != nil {
+		return err
+	}
+	return iv.ImageDB.Create(image)
+}
+
+// checkNew normalizes and validates an image that is about to be created
+func (iv *imageValidator) checkNew(image *Image) error {
+	return runImageValFns(image,
+		iv.galleryIDRequired,
+		iv.normalizeFilename,
+		iv.filenameValid,
+		iv.filenameIsAvail,
+		iv.contentTypeAllowed)
+}
+
+// Validation code for Update
+func (iv *imageValidator) Update(image *Image) error {
+	err := runImageValFns(image,
+		iv.nonZeroID,
+		iv.galleryIDRequired,
+		iv.contentTypeAllowed)
+	if err != nil {
+		return err
+	}
+	return iv.ImageDB.Update(image)
+}
+
+// Validation code for Delete
+func (iv *imageValidator) Delete(id uint) error {
+	var image Image
+	image.ID = id
+	if err := runImageValFns(&image, iv.nonZeroID); err != nil {
+		return err
+	}
+	return iv.ImageDB.Delete(id)
+}
+
+func (iv *imageValidator) galleryIDRequired(image *Image) error {
+	if image.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return nil
+}
+
+// normalizeFilename strips any directories a browser may have sent along with the file name
+func (iv *imageValidator) normalizeFilename(image *Image) error {
+	image.Filename = path.Base(strings.Replace(image.Filename, "\\", "/", -1))
+	image.Filename = strings.TrimSpace(image.Filename)
+	return nil
+}
+
+func (iv *imageValidator) filenameValid(image *Image) error {
+	switch image.Filename {
+	case "", ".", "..", "/":
+		return ErrFilenameInvalid
+	}
+	if strings.HasPrefix(image.Filename, ".") {
+		return ErrFilenameInvalid
+	}
+	// the variants of a gallery are kept in directories named after the presets
+	if _, ok := imageVariant(image.Filename); ok {
+		return ErrFilenameInvalid
+	}
+	if image.Filename == publicDir || image.Filename == publicLocatedDir {
+		return ErrFilenameInvalid
+	}
+	return nil
+}
+
+func (iv *imageValidator) filenameIsAvail(image *Image) error {
+	_, err := iv.ByFilename(image.GalleryID, image.Filename)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return ErrFilenameTaken
+}
+
+func (iv *imageValidator) contentTypeAllowed(image *Image) error {
+	if !imageContentTypes[image.ContentType] {
+		return ErrImageTypeInvalid
+	}
+	return nil
+}
+
+func (iv *imageValidator) nonZeroID(image *Image) error {
+	if image.ID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+func runImageValFns(image *Image, fns ...imageValFn) error {
+	for _, fn := range fns {
+		if err := fn(image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// simple statements to check whether the interface is implemented properly
+// will give error in compile time, if not implemented properly
+var _ ImageDB = &imageGorm{}
+var _ ImageService = &imageService{}
@@ -0,0 +1,191 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"gophr.com/storage"
+)
+
+func TestImageUploadRejectsTooManyPixels(t *testing.T) {
+	s := newTestServices(t)
+	// a few bytes of PNG claiming to be 50000x50000, decoding it would take 10 GB
+	var ihdr [13]byte
+	binary.BigEndian.PutUint32(ihdr[0:], 50000)
+	binary.BigEndian.PutUint32(ihdr[4:], 50000)
+	ihdr[8], ihdr[9] = 8, 6
+	chunk := append([]byte("IHDR"), ihdr[:]...)
+	var bomb bytes.Buffer
+	bomb.WriteString("\x89PNG\r\n\x1a\n")
+	binary.Write(&bomb, binary.BigEndian, uint32(len(ihdr)))
+	bomb.Write(chunk)
+	binary.Write(&bomb, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+
+	if _, err := s.Image.Upload(1, "bomb.png", &bomb); err != ErrImageTooManyPixels {
+		t.Fatalf("Upload() error = %v, want ErrImageTooManyPixels", err)
+	}
+	if _, err := s.Image.ByFilename(1, "bomb.png"); err != ErrNotFound {
+		t.Errorf("rejected image left a record behind: %v", err)
+	}
+}
+
+// failingStore is a storage.Store that can't store any more objects
+type failingStore struct {
+	storage.Store
+}
+
+func (failingStore) Put(key string, r io.Reader) error {
+	return errors.New("disk full")
+}
+
+func TestImageUploadCleansUp(t *testing.T) {
+	store, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServices(t, WithImage(store, 1<<20))
+	if _, err := s.Image.Upload(1, "cat.png", bytes.NewReader(testPNG(t, 4, 4, 200))); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		store    storage.Store
+		filename string
+		data     []byte
+	}{
+		{"store failing", failingStore{store}, "dog.png", testPNG(t, 4, 4, 200)},
+		{"not an image", store, "notes.png", append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 100)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServices(t, WithImage(tt.store, 1<<20))
+			if _, err := s.Image.Upload(1, tt.filename, bytes.NewReader(tt.data)); err == nil {
+				t.Fatal("Upload() succeeded")
+			}
+			if _, err := s.Image.ByFilename(1, tt.filename); err != ErrNotFound {
+				t.Errorf("failed upload left a record behind: %v", err)
+			}
+			objects, err := store.List("galleries/1/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, o := range objects {
+				if strings.HasSuffix(o.Key, "/"+tt.filename) {
+					t.Errorf("failed upload left %s behind", o.Key)
+				}
+			}
+		})
+	}
+
+	// a file name that is taken is turned away before the image in the gallery is overwritten
+	if _, err := s.Image.Upload(1, "cat.png", strings.NewReader("not an image at all")); err != ErrFilenameTaken {
+		t.Fatalf("Upload() of a taken file name error = %v, want %v", err, ErrFilenameTaken)
+	}
+	if _, err := store.Stat("galleries/1/thumbnail/cat.png"); err != nil {
+		t.Errorf("Stat() of the existing image's thumbnail = %v, want it kept", err)
+	}
+}
+
+func TestImageUploadSizeLimit(t *testing.T) {
+	const maxBytes = 1000
+	store, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServices(t, WithImage(store, maxBytes))
+
+	tests := []struct {
+		name     string
+		filename string
+		size     int
+		wantErr  error
+	}{
+		{"under the limit", "small.png", maxBytes / 2, nil},
+		{"at the limit", "exact.png", maxBytes, nil},
+		{"over the limit", "large.png", maxBytes + 1, ErrImageTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image, err := s.Image.Upload(1, tt.filename, bytes.NewReader(testPNG(t, 4, 4, tt.size)))
+			if err != tt.wantErr {
+				t.Fatalf("Upload() error = %v, want %v", err, tt.wantErr)
+			}
+			_, lookupErr := s.Image.ByFilename(1, tt.filename)
+			_, statErr := store.Stat("galleries/1/" + tt.filename)
+			if tt.wantErr != nil {
+				if lookupErr != ErrNotFound || statErr != storage.ErrNotExist {
+					t.Errorf("rejected image left a record (%v) or a file (%v) behind", lookupErr, statErr)
+				}
+				return
+			}
+			if image.Size != int64(tt.size) {
+				t.Errorf("Size = %d, want %d", image.Size, tt.size)
+			}
+			if lookupErr != nil || statErr != nil {
+				t.Errorf("stored image is missing its record (%v) or file (%v)", lookupErr, statErr)
+			}
+		})
+	}
+}
+
+func TestImageOpenPublic(t *testing.T) {
+	store, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServices(t, WithImage(store, 1<<20))
+	img, err := s.Image.Upload(1, "photo.png", bytes.NewReader(testPNG(t, 4, 4, 200)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Stat("galleries/1/public/photo.png"); err != nil {
+		t.Fatalf("Stat() of the public copy = %v, want it stored on upload", err)
+	}
+	if _, err := store.Stat("galleries/1/public-located/photo.png"); err != storage.ErrNotExist {
+		t.Errorf("Stat() of the copy with a location = %v, want none for a photo without one", err)
+	}
+	// visitors are served the stripped copy without the original being read again
+	original, err := store.Get("galleries/1/photo.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(original)
+	original.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("galleries/1/photo.png"); err != nil {
+		t.Fatal(err)
+	}
+	for _, keepLocation := range []bool{false, true} {
+		rc, err := s.Image.OpenPublic(img, keepLocation)
+		if err != nil {
+			t.Fatalf("OpenPublic(%v) error = %v", keepLocation, err)
+		}
+		rc.Close()
+	}
+
+	// images stored before the public copies existed are stripped as they are read
+	if err := store.Put("galleries/1/photo.png", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("galleries/1/public/photo.png"); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := s.Image.OpenPublic(img, false)
+	if err != nil {
+		t.Fatalf("OpenPublic() of an image without a public copy error = %v", err)
+	}
+	rc.Close()
+
+	if _, err := s.Image.Upload(1, "public", bytes.NewReader(testPNG(t, 4, 4, 200))); err != ErrFilenameInvalid {
+		t.Errorf("Upload() named after the public copies error = %v, want %v", err, ErrFilenameInvalid)
+	}
+}
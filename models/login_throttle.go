@@ -0,0 +1,351 @@
+package models
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"gophr.com/hash"
+	"gophr.com/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	// ErrLoginThrottled is a custom error we return when logins are attempted again too soon after failing
+	ErrLoginThrottled error = modelError("models: too many failed login attempts, please wait a little before trying again")
+
+	// ErrAccountLocked is a custom error we return when logging in to an account locked after too many failed attempts
+	ErrAccountLocked error = modelError("models: this account is locked after too many failed login attempts, check your email for a link to unlock it")
+)
+
+const (
+	// accountFreeFailures and ipFreeFailures are the failed logins allowed before
+	// every further attempt has to wait. Addresses get more room since many people
+	// can share one behind a NAT.
+	accountFreeFailures = 3
+	ipFreeFailures      = 20
+
+	// throttleBaseDelay is the wait after the first failure past the free ones, it doubles
+	// with every further failure up to throttleMaxDelay
+	throttleBaseDelay = 1 * time.Second
+	throttleMaxDelay  = 15 * time.Minute
+
+	// lockoutThreshold is the number of failed logins that locks an account for lockoutDuration
+	lockoutThreshold = 10
+	lockoutDuration  = 1 * time.Hour
+
+	// attemptWindow is how long failures are remembered after the last one
+	attemptWindow = 24 * time.Hour
+)
+
+// LoginAttempt counts the failed logins for an account or a client address
+type LoginAttempt struct {
+	Key             string `gorm:"primary_key"`
+	Failures        int    `gorm:"not null;default:0"`
+	LastFailure     time.Time
+	LockedUntil     *time.Time
+	UnlockTokenHash string `gorm:"index"`
+}
+
+// locked reports whether the attempt has locked its account at the given time
+func (a *LoginAttempt) locked(now time.Time) bool {
+	return a.LockedUntil != nil && now.Before(*a.LockedUntil)
+}
+
+// retryAt returns when the next login may be tried after the failures so far
+func (a *LoginAttempt) retryAt(freeFailures int) time.Time {
+	if a.Failures < freeFailures {
+		return time.Time{}
+	}
+	delay := throttleBaseDelay
+	for i := freeFailures; i < a.Failures && delay < throttleMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > throttleMaxDelay {
+		delay = throttleMaxDelay
+	}
+	return a.LastFailure.Add(delay)
+}
+
+// countFailure is called with a counter that just had a failure added. It starts the count
+// over when the earlier failures are too old to matter or the lock they caused ran out.
+func (a *LoginAttempt) countFailure(now time.Time) {
+	lockRanOut := a.LockedUntil != nil && !a.locked(now)
+	if lockRanOut || (!a.locked(now) && now.Sub(a.LastFailure) > attemptWindow) {
+		*a = LoginAttempt{Key: a.Key, Failures: 1}
+	}
+	a.LastFailure = now
+}
+
+// LoginAttemptDB stores the failed login counters, either in the database or in memory
+type LoginAttemptDB interface {
+	ByKey(key string) (*LoginAttempt, error)
+	ByUnlockToken(tokenHash string) (*LoginAttempt, error)
+
+	// AddFailure adds one to the failures of the counter stored under key, creating it when
+	// there is none, and saves whatever changes update then makes to it. Failures added under
+	// the same key at the same time wait for each other, so none of them is lost.
+	AddFailure(key string, update func(a *LoginAttempt) error) error
+
+	Delete(key string) error
+}
+
+// LoginThrottle slows down password guessing by making logins wait longer after each
+// failure, both per account and per client address, and locks accounts that keep failing
+type LoginThrottle interface {
+	// Check returns ErrLoginThrottled or ErrAccountLocked when a login to the account
+	// with the email from the client address must not be attempted now
+	Check(email, ip string) error
+
+	// Failed records a failed login. When the failure locks the account it returns
+	// the token of the link that unlocks it, which has to be emailed to the owner.
+	Failed(email, ip string) (string, error)
+
+	// Succeeded forgets the failed logins of the account
+	Succeeded(email string) error
+
+	// Unlock lifts the lock from the account the unlock token was sent for
+	Unlock(token string) error
+}
+
+type loginThrottle struct {
+	db   LoginAttemptDB
+	hmac hash.HMAC
+}
+
+// NewLoginThrottle returns a LoginThrottle keeping its counters in the database
+func NewLoginThrottle(db *gorm.DB, hmacKey string) LoginThrottle {
+	return newLoginThrottle(&loginAttemptGorm{db: db}, hmacKey)
+}
+
+// NewMemLoginThrottle returns a LoginThrottle keeping its counters in memory, they are lost on restart
+// and not shared between servers
+func NewMemLoginThrottle(hmacKey string) LoginThrottle {
+	return newLoginThrottle(&loginAttemptMem{attempts: make(map[string]LoginAttempt)}, hmacKey)
+}
+
+func newLoginThrottle(db LoginAttemptDB, hmacKey string) *loginThrottle {
+	return &loginThrottle{
+		db:   db,
+		hmac: hash.NewHMAC(hmacKey),
+	}
+}
+
+// accountKey and ipKey keep the two kinds of counters apart in the same table
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// attempt returns the counter stored under key, or a fresh one when there is none or it has expired
+func (lt *loginThrottle) attempt(key string, now time.Time) (*LoginAttempt, error) {
+	a, err := lt.db.ByKey(key)
+	if err == ErrNotFound {
+		return &LoginAttempt{Key: key}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !a.locked(now) && now.Sub(a.LastFailure) > attemptWindow {
+		return &LoginAttempt{Key: key}, nil
+	}
+	return a, nil
+}
+
+// Check looks at the counters of both the account and the address
+func (lt *loginThrottle) Check(email, ip string) error {
+	now := time.Now()
+	account, err := lt.attempt(accountKey(email), now)
+	if err != nil {
+		return err
+	}
+	if account.locked(now) {
+		return ErrAccountLocked
+	}
+	if now.Before(account.retryAt(accountFreeFailures)) {
+		return ErrLoginThrottled
+	}
+	addr, err := lt.attempt(ipKey(ip), now)
+	if err != nil {
+		return err
+	}
+	if now.Before(addr.retryAt(ipFreeFailures)) {
+		return ErrLoginThrottled
+	}
+	return nil
+}
+
+// Failed bumps both counters and locks the account once it reaches the threshold
+func (lt *loginThrottle) Failed(email, ip string) (string, error) {
+	now := time.Now()
+	err := lt.db.AddFailure(ipKey(ip), func(a *LoginAttempt) error {
+		a.countFailure(now)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var token string
+	err = lt.db.AddFailure(accountKey(email), func(a *LoginAttempt) error {
+		a.countFailure(now)
+		if a.Failures < lockoutThreshold || a.locked(now) {
+			return nil
+		}
+		var err error
+		token, err = rand.String(rand.RememberTokenBytes)
+		if err != nil {
+			return err
+		}
+		until := now.Add(lockoutDuration)
+		a.LockedUntil = &until
+		a.UnlockTokenHash = lt.hmac.Hash(token)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Succeeded removes the counter of the account. The address keeps its counter so
+// an attacker cannot clear it by logging in to an account of their own.
+func (lt *loginThrottle) Succeeded(email string) error {
+	return lt.db.Delete(accountKey(email))
+}
+
+// Unlock removes the counter of the account the token belongs to
+func (lt *loginThrottle) Unlock(token string) error {
+	if token == "" {
+		return ErrTokenInvalid
+	}
+	a, err := lt.db.ByUnlockToken(lt.hmac.Hash(token))
+	if err == ErrNotFound {
+		return ErrTokenInvalid
+	}
+	if err != nil {
+		return err
+	}
+	return lt.db.Delete(a.Key)
+}
+
+/*
+	********************************
+	********************************
+	Start of functions related to db
+	********************************
+	********************************
+*/
+
+type loginAttemptGorm struct {
+	db *gorm.DB
+}
+
+// ByKey is used to look up the counter stored under a key
+func (lag *loginAttemptGorm) ByKey(key string) (*LoginAttempt, error) {
+	var a LoginAttempt
+	if err := first(lag.db.Where("key = ?", key), &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// ByUnlockToken is used to look up the counter of a locked account by the hash of its unlock token
+func (lag *loginAttemptGorm) ByUnlockToken(tokenHash string) (*LoginAttempt, error) {
+	var a LoginAttempt
+	if err := first(lag.db.Where("unlock_token_hash = ?", tokenHash), &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// AddFailure counts the failure with a single UPDATE, which keeps the row locked until the
+// transaction ends, so a concurrent failure cannot read the counter before this one is saved
+func (lag *loginAttemptGorm) AddFailure(key string, update func(a *LoginAttempt) error) error {
+	return lag.db.Transaction(func(tx *gorm.DB) error {
+		// the zero time stands in for a counter that never failed, NULL can't be read into a time.Time.
+		// ON CONFLICT is what needs Postgres 9.5 and SQLite 3.24, FirstOrCreate would make two
+		// first failures race to insert and abort the transaction of the one that loses.
+		err := tx.Exec("INSERT INTO login_attempts (key, failures, last_failure) VALUES (?, 0, ?) ON CONFLICT DO NOTHING",
+			key, time.Time{}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&LoginAttempt{}).Where("key = ?", key).
+			UpdateColumn("failures", gorm.Expr("failures + 1")).Error
+		if err != nil {
+			return err
+		}
+		var a LoginAttempt
+		if err := first(tx.Where("key = ?", key), &a); err != nil {
+			return err
+		}
+		if err := update(&a); err != nil {
+			return err
+		}
+		return tx.Save(&a).Error
+	})
+}
+
+// Delete removes the counter stored under a key
+func (lag *loginAttemptGorm) Delete(key string) error {
+	return lag.db.Where("key = ?", key).Delete(&LoginAttempt{}).Error
+}
+
+type loginAttemptMem struct {
+	mu       sync.Mutex
+	attempts map[string]LoginAttempt
+}
+
+// ByKey is used to look up the counter stored under a key
+func (lam *loginAttemptMem) ByKey(key string) (*LoginAttempt, error) {
+	lam.mu.Lock()
+	defer lam.mu.Unlock()
+	a, ok := lam.attempts[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &a, nil
+}
+
+// ByUnlockToken is used to look up the counter of a locked account by the hash of its unlock token
+func (lam *loginAttemptMem) ByUnlockToken(tokenHash string) (*LoginAttempt, error) {
+	lam.mu.Lock()
+	defer lam.mu.Unlock()
+	for _, a := range lam.attempts {
+		if a.UnlockTokenHash != "" && a.UnlockTokenHash == tokenHash {
+			return &a, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// AddFailure holds the lock from reading the counter until it is stored again
+func (lam *loginAttemptMem) AddFailure(key string, update func(a *LoginAttempt) error) error {
+	lam.mu.Lock()
+	defer lam.mu.Unlock()
+	a := lam.attempts[key]
+	a.Key = key
+	a.Failures++
+	if err := update(&a); err != nil {
+		return err
+	}
+	lam.attempts[key] = a
+	return nil
+}
+
+// Delete removes the counter stored under a key
+func (lam *loginAttemptMem) Delete(key string) error {
+	lam.mu.Lock()
+	defer lam.mu.Unlock()
+	delete(lam.attempts, key)
+	return nil
+}
+
+var _ LoginAttemptDB = &loginAttemptGorm{}
+var _ LoginAttemptDB = &loginAttemptMem{}
+var _ LoginThrottle = &loginThrottle{}
@@ -0,0 +1,219 @@
+package models
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoginAttemptRetryAt(t *testing.T) {
+	last := time.Date(2019, 6, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		failures     int
+		freeFailures int
+		want         time.Duration
+	}{
+		{failures: 0, freeFailures: 3, want: 0},
+		{failures: 2, freeFailures: 3, want: 0},
+		{failures: 3, freeFailures: 3, want: time.Second},
+		{failures: 4, freeFailures: 3, want: 2 * time.Second},
+		{failures: 6, freeFailures: 3, want: 8 * time.Second},
+		{failures: 12, freeFailures: 3, want: 512 * time.Second},
+		{failures: 13, freeFailures: 3, want: throttleMaxDelay},
+		{failures: 1000, freeFailures: 3, want: throttleMaxDelay},
+		{failures: 19, freeFailures: 20, want: 0},
+		{failures: 21, freeFailures: 20, want: 2 * time.Second},
+	}
+	for _, tt := range tests {
+		a := LoginAttempt{Failures: tt.failures, LastFailure: last}
+		got := a.retryAt(tt.freeFailures)
+		if tt.want == 0 {
+			if !got.IsZero() {
+				t.Errorf("retryAt(%d) after %d failures = %v, want no wait", tt.freeFailures, tt.failures, got)
+			}
+			continue
+		}
+		if wait := got.Sub(last); wait != tt.want {
+			t.Errorf("retryAt(%d) after %d failures waits %v, want %v", tt.freeFailures, tt.failures, wait, tt.want)
+		}
+	}
+}
+
+func TestLoginAttemptCountFailure(t *testing.T) {
+	now := time.Now()
+	locked, expired := now.Add(time.Minute), now.Add(-time.Minute)
+	tests := []struct {
+		name         string
+		attempt      LoginAttempt
+		wantFailures int
+		wantLocked   bool
+	}{
+		{"first failure", LoginAttempt{Failures: 1}, 1, false},
+		{"recent failures", LoginAttempt{Failures: 5, LastFailure: now.Add(-time.Hour)}, 5, false},
+		{"failures out of the window", LoginAttempt{Failures: 5, LastFailure: now.Add(-attemptWindow - time.Second)}, 1, false},
+		{"locked", LoginAttempt{Failures: 11, LastFailure: now.Add(-attemptWindow - time.Second), LockedUntil: &locked, UnlockTokenHash: "hash"}, 11, true},
+		{"lock ran out", LoginAttempt{Failures: 11, LastFailure: now.Add(-time.Hour), LockedUntil: &expired, UnlockTokenHash: "hash"}, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := tt.attempt
+			a.Key = "account:jon@example.com"
+			a.countFailure(now)
+			if a.Failures != tt.wantFailures {
+				t.Errorf("Failures = %d, want %d", a.Failures, tt.wantFailures)
+			}
+			if a.locked(now) != tt.wantLocked {
+				t.Errorf("locked = %v, want %v", a.locked(now), tt.wantLocked)
+			}
+			if !a.LastFailure.Equal(now) {
+				t.Errorf("LastFailure = %v, want %v", a.LastFailure, now)
+			}
+			if a.Key != "account:jon@example.com" {
+				t.Errorf("Key = %q, the counter lost its key", a.Key)
+			}
+		})
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	for name, backend := range testBackends(t) {
+		lt := backend.LoginThrottle.(*loginThrottle)
+		t.Run(name, func(t *testing.T) {
+			const email, ip = "jon@example.com", "192.0.2.1"
+			var token string
+			for i := 1; i <= lockoutThreshold; i++ {
+				if err := lt.Check(email, ip); err != nil && i <= accountFreeFailures {
+					t.Fatalf("Check() before failure %d = %v, want nil", i, err)
+				}
+				got, err := lt.Failed(" Jon@Example.com", ip)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if (got != "") != (i == lockoutThreshold) {
+					t.Fatalf("Failed() number %d returned token %q", i, got)
+				}
+				token = got
+				if i == accountFreeFailures {
+					if err := lt.Check(email, ip); err != ErrLoginThrottled {
+						t.Errorf("Check() after %d failures = %v, want %v", i, err, ErrLoginThrottled)
+					}
+				}
+			}
+			if err := lt.Check(email, ip); err != ErrAccountLocked {
+				t.Errorf("Check() of a locked account = %v, want %v", err, ErrAccountLocked)
+			}
+			// failing again while locked doesn't send another link
+			if again, err := lt.Failed(email, ip); err != nil || again != "" {
+				t.Errorf("Failed() while locked = %q, %v, want no new token", again, err)
+			}
+			if err := lt.Check("jane@example.com", "192.0.2.2"); err != nil {
+				t.Errorf("Check() of another account = %v, want nil", err)
+			}
+
+			if err := lt.Unlock("not-the-token"); err != ErrTokenInvalid {
+				t.Errorf("Unlock() with a wrong token = %v, want %v", err, ErrTokenInvalid)
+			}
+			if err := lt.Unlock(token); err != nil {
+				t.Fatal(err)
+			}
+			if err := lt.Unlock(token); err != ErrTokenInvalid {
+				t.Errorf("Unlock() twice = %v, want %v", err, ErrTokenInvalid)
+			}
+			if err := lt.Check(email, "192.0.2.3"); err != nil {
+				t.Errorf("Check() after unlocking = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestLoginThrottleByAddress(t *testing.T) {
+	for name, backend := range testBackends(t) {
+		lt := backend.LoginThrottle.(*loginThrottle)
+		t.Run(name, func(t *testing.T) {
+			const ip = "192.0.2.1"
+			// a different account every time, so only the address counter adds up
+			for i := 0; i < ipFreeFailures; i++ {
+				if _, err := lt.Failed(fmt.Sprintf("user%d@example.com", i), ip); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := lt.Check("new@example.com", ip); err != ErrLoginThrottled {
+				t.Errorf("Check() from a busy address = %v, want %v", err, ErrLoginThrottled)
+			}
+			if err := lt.Check("new@example.com", "192.0.2.2"); err != nil {
+				t.Errorf("Check() from another address = %v, want nil", err)
+			}
+			// logging in doesn't clear the address counter
+			if err := lt.Succeeded("user0@example.com"); err != nil {
+				t.Fatal(err)
+			}
+			if err := lt.Check("user0@example.com", ip); err != ErrLoginThrottled {
+				t.Errorf("Check() after a login from a busy address = %v, want %v", err, ErrLoginThrottled)
+			}
+		})
+	}
+}
+
+func TestLoginThrottleSucceeded(t *testing.T) {
+	for name, backend := range testBackends(t) {
+		lt := backend.LoginThrottle.(*loginThrottle)
+		t.Run(name, func(t *testing.T) {
+			const email = "jon@example.com"
+			for i := 0; i < accountFreeFailures; i++ {
+				if _, err := lt.Failed(email, fmt.Sprintf("192.0.2.%d", i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := lt.Succeeded(email); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := lt.db.ByKey(accountKey(email)); err != ErrNotFound {
+				t.Errorf("ByKey() after a login = %v, want %v", err, ErrNotFound)
+			}
+		})
+	}
+}
+
+func TestLoginThrottleFailedConcurrently(t *testing.T) {
+	const failures = 2 * lockoutThreshold
+	for name, backend := range testBackends(t) {
+		lt := backend.LoginThrottle.(*loginThrottle)
+		t.Run(name, func(t *testing.T) {
+			const email, ip = "jon@example.com", "192.0.2.1"
+			tokens := make([]string, failures)
+			errs := make([]error, failures)
+			var wg sync.WaitGroup
+			for i := 0; i < failures; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					tokens[i], errs[i] = lt.Failed(email, ip)
+				}(i)
+			}
+			wg.Wait()
+
+			var sent int
+			for i := range tokens {
+				if errs[i] != nil {
+					t.Fatalf("Failed() = %v", errs[i])
+				}
+				if tokens[i] != "" {
+					sent++
+				}
+			}
+			if sent != 1 {
+				t.Errorf("%d unlock links sent, want 1", sent)
+			}
+			for _, key := range []string{accountKey(email), ipKey(ip)} {
+				a, err := lt.db.ByKey(key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if a.Failures != failures {
+					t.Errorf("%s counted %d failures, want %d", key, a.Failures, failures)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,319 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"gophr.com/migrate"
+	"gophr.com/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Migrations lists every change to the schema in the order they are applied. Add new
+// migrations to the end and never edit one that has been released.
+//
+// Migrations describe the tables with their own copies of the models, so they keep
+// creating the same schema however the models change later on.
+var Migrations = []migrate.Migration{
+	{
+		// the schema as it was built by AutoMigrate, which databases made before
+		// migrations existed already have, so it only creates what is missing
+		ID: "0001_initial_schema",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&userV1{}, &pwResetV1{}, &galleryV1{}, &imageV1{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists(&imageV1{}, &galleryV1{}, &pwResetV1{}, &userV1{}).Error
+		},
+	},
+	{
+		ID: "0002_create_login_attempts",
+		Up: func(tx *gorm.DB) error {
+			return tx.CreateTable(&loginAttemptV1{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists(&loginAttemptV1{}).Error
+		},
+	},
+	{
+		ID: "0003_add_two_factor",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.AutoMigrate(&userTwoFactorV1{}).Error; err != nil {
+				return err
+			}
+			return tx.CreateTable(&recoveryCodeV1{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.DropTableIfExists(&recoveryCodeV1{}).Error; err != nil {
+				return err
+			}
+			if tx.Dialect().GetName() == DialectSQLite {
+				// SQLite before 3.35 cannot drop columns. Leaving them is harmless,
+				// nothing reads them and applying Up again keeps the existing ones.
+				return nil
+			}
+			if err := tx.Model(&userTwoFactorV1{}).RemoveIndex("idx_users_login_token_hash").Error; err != nil {
+				return err
+			}
+			for _, column := range []string{"totp_secret", "two_factor_enabled", "totp_last_step", "login_token_hash", "login_started_at"} {
+				if err := tx.Model(&userTwoFactorV1{}).DropColumn(column).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		// moves the single remember token of every user into a session of its own, so
+		// nobody is logged out, then drops it. Rolling back gives every user the token of
+		// the device they used last, the other devices have to log in again.
+		ID: "0004_create_sessions",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.CreateTable(&sessionV1{}).Error; err != nil {
+				return err
+			}
+			now := time.Now()
+			err := tx.Exec(`INSERT INTO sessions (user_id, token_hash, user_agent, ip, created_at, last_seen_at, expires_at)
+				SELECT id, remember_hash, '', '', ?, ?, ? FROM users WHERE deleted_at IS NULL`,
+				now, now, now.Add(30*24*time.Hour)).Error
+			if err != nil {
+				return err
+			}
+			if tx.Dialect().GetName() == DialectSQLite {
+				return rebuildUsersWithoutRememberHash(tx)
+			}
+			if err := tx.Model(&userV1{}).RemoveIndex("uix_users_remember_hash").Error; err != nil {
+				return err
+			}
+			return tx.Model(&userV1{}).DropColumn("remember_hash").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			// added without NOT NULL, existing rows would break it until they are filled in
+			if err := tx.AutoMigrate(&userRememberV1{}).Error; err != nil {
+				return err
+			}
+			err := tx.Exec(`UPDATE users SET remember_hash = (SELECT token_hash FROM sessions
+				WHERE sessions.user_id = users.id ORDER BY last_seen_at DESC LIMIT 1)`).Error
+			if err != nil {
+				return err
+			}
+			// users without a session get a hash nobody has the token for, they have to log in again
+			var ids []uint
+			if err := tx.Table("users").Where("remember_hash IS NULL").Pluck("id", &ids).Error; err != nil {
+				return err
+			}
+			for _, id := range ids {
+				token, err := rand.RememberToken()
+				if err != nil {
+					return err
+				}
+				if err := tx.Table("users").Where("id = ?", id).Update("remember_hash", token).Error; err != nil {
+					return err
+				}
+			}
+			if err := tx.Model(&userRememberV1{}).AddUniqueIndex("uix_users_remember_hash", "remember_hash").Error; err != nil {
+				return err
+			}
+			if tx.Dialect().GetName() != DialectSQLite {
+				// SQLite cannot add the constraint to an existing column, nothing inserts NULL either way
+				if err := tx.Exec("ALTER TABLE users ALTER COLUMN remember_hash SET NOT NULL").Error; err != nil {
+					return err
+				}
+			}
+			return tx.DropTableIfExists(&sessionV1{}).Error
+		},
+	},
+	{
+		ID: "0005_schedule_account_deletion",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&userDeletionV1{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if tx.Dialect().GetName() == DialectSQLite {
+				// like 0003_add_two_factor, the column stays behind on SQLite
+				return nil
+			}
+			if err := tx.Model(&userDeletionV1{}).RemoveIndex("idx_users_deletion_due_at").Error; err != nil {
+				return err
+			}
+			return tx.Model(&userDeletionV1{}).DropColumn("deletion_due_at").Error
+		},
+	},
+	{
+		// deleted images keep their rows, so only live ones have to have distinct file names
+		ID: "0006_unique_image_filenames",
+		Up: func(tx *gorm.DB) error {
+			return tx.Exec("CREATE UNIQUE INDEX uix_images_gallery_id_filename ON images (gallery_id, filename) WHERE deleted_at IS NULL").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Exec("DROP INDEX uix_images_gallery_id_filename").Error
+		},
+	},
+}
+
+// rebuildUsersWithoutRememberHash drops remember_hash on SQLite, which cannot drop columns
+// before 3.35, by copying the users into a new table without it as SQLite suggests
+func rebuildUsersWithoutRememberHash(tx *gorm.DB) error {
+	if err := tx.Exec("ALTER TABLE users RENAME TO users_0004").Error; err != nil {
+		return err
+	}
+	// the indexes go along with the renamed table, their names are needed for the new one
+	for _, index := range []string{"idx_users_deleted_at", "uix_users_email", "uix_users_remember_hash", "idx_users_verify_token_hash", "idx_users_login_token_hash"} {
+		if err := tx.Exec("DROP INDEX IF EXISTS " + index).Error; err != nil {
+			return err
+		}
+	}
+	if err := tx.CreateTable(&userV2{}).Error; err != nil {
+		return err
+	}
+	columns := strings.Join(userV2Columns, ", ")
+	if err := tx.Exec("INSERT INTO users (" + columns + ") SELECT " + columns + " FROM users_0004").Error; err != nil {
+		return err
+	}
+	return tx.DropTable("users_0004").Error
+}
+
+// Migrator returns the migrator for the database the services share
+func (s *Services) Migrator() *migrate.Migrator {
+	return migrate.New(s.db, Migrations)
+}
+
+type userV1 struct {
+	gorm.Model
+	Name              string
+	Email             string `gorm:"not null;unique_index"`
+	PasswordHash      string `gorm:"not null"`
+	RememberHash      string `gorm:"not null;unique_index"`
+	KeepPhotoLocation bool   `gorm:"not null;default:false"`
+	EmailVerified     bool   `gorm:"not null;default:false"`
+	VerifyTokenHash   string `gorm:"index"`
+	VerifySentAt      *time.Time
+}
+
+func (userV1) TableName() string { return "users" }
+
+type pwResetV1 struct {
+	ID        uint   `gorm:"primary_key"`
+	UserID    uint   `gorm:"not null;index"`
+	TokenHash string `gorm:"not null;unique_index"`
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+func (pwResetV1) TableName() string { return "pw_resets" }
+
+type galleryV1 struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null;index"`
+	Title     string `gorm:"not null"`
+	Published bool   `gorm:"not null;default:false"`
+}
+
+func (galleryV1) TableName() string { return "galleries" }
+
+type imageV1 struct {
+	gorm.Model
+	GalleryID    uint   `gorm:"not null;index"`
+	Filename     string `gorm:"not null"`
+	ContentType  string `gorm:"not null"`
+	Size         int64
+	Width        int
+	Height       int
+	TakenAt      *time.Time
+	CameraMake   string
+	CameraModel  string
+	LensModel    string
+	ExposureTime string
+	FNumber      float64
+	FocalLength  float64
+	ISO          int
+	HasLocation  bool
+	Latitude     float64
+	Longitude    float64
+}
+
+func (imageV1) TableName() string { return "images" }
+
+type loginAttemptV1 struct {
+	Key             string `gorm:"primary_key"`
+	Failures        int    `gorm:"not null;default:0"`
+	LastFailure     time.Time
+	LockedUntil     *time.Time
+	UnlockTokenHash string `gorm:"index"`
+}
+
+func (loginAttemptV1) TableName() string { return "login_attempts" }
+
+// userTwoFactorV1 only has the columns 0003_add_two_factor adds to the users table
+type userTwoFactorV1 struct {
+	TOTPSecret       string
+	TwoFactorEnabled bool   `gorm:"not null;default:false"`
+	TOTPLastStep     int64  `gorm:"not null;default:0"`
+	LoginTokenHash   string `gorm:"index"`
+	LoginStartedAt   *time.Time
+}
+
+func (userTwoFactorV1) TableName() string { return "users" }
+
+type recoveryCodeV1 struct {
+	ID        uint   `gorm:"primary_key"`
+	UserID    uint   `gorm:"not null;index"`
+	CodeHash  string `gorm:"not null;unique_index"`
+	CreatedAt time.Time
+}
+
+func (recoveryCodeV1) TableName() string { return "recovery_codes" }
+
+type sessionV1 struct {
+	ID         uint   `gorm:"primary_key"`
+	UserID     uint   `gorm:"not null;index"`
+	TokenHash  string `gorm:"not null;unique_index"`
+	UserAgent  string
+	IP         string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+}
+
+func (sessionV1) TableName() string { return "sessions" }
+
+// userV2 is the users table once 0004_create_sessions has dropped remember_hash
+type userV2 struct {
+	gorm.Model
+	Name              string
+	Email             string `gorm:"not null;unique_index"`
+	PasswordHash      string `gorm:"not null"`
+	KeepPhotoLocation bool   `gorm:"not null;default:false"`
+	EmailVerified     bool   `gorm:"not null;default:false"`
+	VerifyTokenHash   string `gorm:"index"`
+	VerifySentAt      *time.Time
+	TOTPSecret        string
+	TwoFactorEnabled  bool   `gorm:"not null;default:false"`
+	TOTPLastStep      int64  `gorm:"not null;default:0"`
+	LoginTokenHash    string `gorm:"index"`
+	LoginStartedAt    *time.Time
+}
+
+func (userV2) TableName() string { return "users" }
+
+// userV2Columns lists the columns of userV2, which the users are copied with
+var userV2Columns = []string{
+	"id", "created_at", "updated_at", "deleted_at", "name", "email", "password_hash",
+	"keep_photo_location", "email_verified", "verify_token_hash", "verify_sent_at",
+	"totp_secret", "two_factor_enabled", "totp_last_step", "login_token_hash", "login_started_at",
+}
+
+// userRememberV1 only has the column rolling back 0004_create_sessions adds back to the users table
+type userRememberV1 struct {
+	RememberHash string
+}
+
+func (userRememberV1) TableName() string { return "users" }
+
+// userDeletionV1 only has the column 0005_schedule_account_deletion adds to the users table
+type userDeletionV1 struct {
+	DeletionDueAt *time.Time `gorm:"index"`
+}
+
+func (userDeletionV1) TableName() string { return "users" }
@@ -0,0 +1,156 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"gophr.com/migrate"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestCreateSessionsMigration(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := migrate.New(db, Migrations[:3]).Up(); err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, db, `INSERT INTO users (id, email, password_hash, remember_hash) VALUES (1, 'a@example.com', 'x', 'hash-a')`)
+	mustExec(t, db, `INSERT INTO users (id, email, password_hash, remember_hash, deleted_at) VALUES (2, 'b@example.com', 'x', 'hash-b', ?)`, time.Now())
+
+	m := migrate.New(db, Migrations[:4])
+	if _, err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	var sessions []sessionV1
+	if err := db.Order("id").Find(&sessions).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].UserID != 1 || sessions[0].TokenHash != "hash-a" {
+		t.Fatalf("sessions = %+v, want one for user 1 with hash-a", sessions)
+	}
+	if db.Dialect().HasColumn("users", "remember_hash") {
+		t.Error("users still has remember_hash")
+	}
+	if !db.Dialect().HasIndex("users", "uix_users_email") {
+		t.Error("users lost its unique email index")
+	}
+	// users are created without a remember hash from here on
+	mustExec(t, db, `INSERT INTO users (id, email, password_hash) VALUES (3, 'c@example.com', 'x')`)
+	mustExec(t, db, `INSERT INTO sessions (user_id, token_hash, last_seen_at, expires_at) VALUES (1, 'hash-c', ?, ?)`,
+		time.Now().Add(time.Hour), time.Now().Add(time.Hour))
+
+	if _, err := m.Down(); err != nil {
+		t.Fatal(err)
+	}
+	hashes := map[uint]string{}
+	rows, err := db.Table("users").Select("id, remember_hash").Rows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var id uint
+		var hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			t.Fatal(err)
+		}
+		hashes[id] = hash
+	}
+	rows.Close()
+	if hashes[1] != "hash-c" {
+		t.Errorf("user 1 remember_hash = %q, want the hash of the session seen last", hashes[1])
+	}
+	if hashes[2] == "" || hashes[3] == "" || hashes[2] == hashes[3] {
+		t.Errorf("users without a session got remember hashes %q and %q, want distinct ones", hashes[2], hashes[3])
+	}
+	if db.HasTable("sessions") {
+		t.Error("sessions table was not dropped")
+	}
+
+	if _, err := m.Up(); err != nil {
+		t.Fatalf("applying again after rolling back: %v", err)
+	}
+}
+
+// TestMigrationsRoundTrip rolls every migration back and applies them again, the way a
+// deploy that is backed out and redone would
+func TestMigrationsRoundTrip(t *testing.T) {
+	db := newTestDB(t)
+	m := migrate.New(db, Migrations)
+	if _, err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, db, `INSERT INTO users (id, email, password_hash) VALUES (1, 'a@example.com', 'x')`)
+	for i := len(Migrations) - 1; i >= 0; i-- {
+		id, err := m.Down()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != Migrations[i].ID {
+			t.Fatalf("Down() rolled back %s, want %s", id, Migrations[i].ID)
+		}
+	}
+	if _, err := m.Down(); err != migrate.ErrNothingToRollback {
+		t.Errorf("Down() with nothing applied = %v, want %v", err, migrate.ErrNothingToRollback)
+	}
+	for _, table := range []string{"users", "pw_resets", "galleries", "images", "login_attempts", "recovery_codes", "sessions"} {
+		if db.HasTable(table) {
+			t.Errorf("table %s is left after rolling everything back", table)
+		}
+	}
+
+	applied, err := m.Up()
+	if err != nil {
+		t.Fatalf("applying again after rolling back: %v", err)
+	}
+	if len(applied) != len(Migrations) {
+		t.Errorf("Up() applied %d migrations, want %d", len(applied), len(Migrations))
+	}
+	if err := m.Check(); err != nil {
+		t.Error(err)
+	}
+	// the schema matches the models, so the services work on top of it
+	us := NewUserService(db, testPepper, testHMACKey)
+	createVerifiedUser(t, us, "jon@example.com")
+}
+
+// TestScheduleAccountDeletionMigration rolls back only that migration, which on
+// SQLite leaves its column behind, and applies it again
+func TestScheduleAccountDeletionMigration(t *testing.T) {
+	db := newTestDB(t)
+	m := migrate.New(db, Migrations[:5])
+	if _, err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	due := time.Now()
+	mustExec(t, db, `INSERT INTO users (id, email, password_hash, deletion_due_at) VALUES (1, 'a@example.com', 'x', ?)`, due)
+	if id, err := m.Down(); err != nil || id != "0005_schedule_account_deletion" {
+		t.Fatalf("Down() = %q, %v, want 0005_schedule_account_deletion rolled back", id, err)
+	}
+	if _, err := m.Up(); err != nil {
+		t.Fatalf("applying again after rolling back: %v", err)
+	}
+	if !db.Dialect().HasColumn("users", "deletion_due_at") || !db.Dialect().HasIndex("users", "idx_users_deletion_due_at") {
+		t.Error("users is missing deletion_due_at or its index")
+	}
+}
+
+func TestUniqueImageFilenamesMigration(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := migrate.New(db, Migrations).Up(); err != nil {
+		t.Fatal(err)
+	}
+	insert := `INSERT INTO images (gallery_id, filename, content_type, deleted_at) VALUES (?, ?, 'image/png', ?)`
+	mustExec(t, db, insert, 1, "cat.png", time.Now())
+	mustExec(t, db, insert, 1, "cat.png", nil)
+	mustExec(t, db, insert, 2, "cat.png", nil)
+	if err := db.Exec(insert, 1, "cat.png", nil).Error; err == nil {
+		t.Error("a gallery got two live images with the same file name")
+	}
+}
+
+func mustExec(t *testing.T, db *gorm.DB, sql string, values ...interface{}) {
+	t.Helper()
+	if err := db.Exec(sql, values...).Error; err != nil {
+		t.Fatal(err)
+	}
+}
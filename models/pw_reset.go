@@ -0,0 +1,186 @@
+package models
+
+import (
+	"time"
+
+	"gophr.com/hash"
+	"gophr.com/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	// ErrTokenInvalid is a custom error we return when a password reset token is unknown, used up or expired
+	ErrTokenInvalid error = modelError("models: token provided is not valid")
+)
+
+// pwResetDuration is how long a password reset link stays usable after it is sent
+const pwResetDuration = 1 * time.Hour
+
+// pwReset is the database model for a pending password reset. Only the HMAC of
+// the token is stored so a leaked table cannot be used to take over accounts.
+type pwReset struct {
+	ID        uint   `gorm:"primary_key"`
+	UserID    uint   `gorm:"not null;index"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+// expired reports whether the reset link can no longer be used
+func (pwr *pwReset) expired() bool {
+	return time.Now().After(pwr.ExpiresAt)
+}
+
+// pwResetDB is used to interact with the password resets database
+type pwResetDB interface {
+	ByToken(token string) (*pwReset, error)
+	Create(pwr *pwReset) error
+	Delete(id uint) error
+	DeleteByUserID(userID uint) error
+}
+
+type pwResetGorm struct {
+	db *gorm.DB
+}
+
+type pwResetValidator struct {
+	pwResetDB
+	hmac hash.HMAC
+}
+
+type pwResetValFn func(*pwReset) error
+
+func newPwResetValidator(db pwResetDB, hmac hash.HMAC) *pwResetValidator {
+	return &pwResetValidator{
+		pwResetDB: db,
+		hmac:      hmac,
+	}
+}
+
+/*
+	********************************
+	********************************
+	Start of functions related to db
+	********************************
+	********************************
+*/
+
+// ByToken is used to look up a password reset by the hash of its token
+func (pwrg *pwResetGorm) ByToken(tokenHash string) (*pwReset, error) {
+	var pwr pwReset
+	err := first(pwrg.db.Where("token_hash = ?", tokenHash), &pwr)
+	if err != nil {
+		return nil, err
+	}
+	return &pwr, nil
+}
+
+// Create is used to add a new password reset
+func (pwrg *pwResetGorm) Create(pwr *pwReset) error {
+	return pwrg.db.Create(pwr).Error
+}
+
+// Delete removes a password reset. It returns ErrTokenInvalid if the reset was
+// already removed, which is how a token is made usable only once.
+func (pwrg *pwResetGorm) Delete(id uint) error {
+	db := pwrg.db.Where("id = ?", id).Delete(&pwReset{})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrTokenInvalid
+	}
+	return nil
+}
+
+// DeleteByUserID removes every outstanding password reset of a user
+func (pwrg *pwResetGorm) DeleteByUserID(userID uint) error {
+	return pwrg.db.Where("user_id = ?", userID).Delete(&pwReset{}).Error
+}
+
+/*
+	***********************************************
+	***********************************************
+	Start of validation and normalization functions
+	***********************************************
+	***********************************************
+*/
+
+// Validation code for ByToken
+func (pwrv *pwResetValidator) ByToken(token string) (*pwReset, error) {
+	pwr := pwReset{Token: token}
+	if err := runPwResetValFns(&pwr, pwrv.hmacToken); err != nil {
+		return nil, err
+	}
+	return pwrv.pwResetDB.ByToken(pwr.TokenHash)
+}
+
+// Validation code for Create
+func (pwrv *pwResetValidator) Create(pwr *pwReset) error {
+	err := runPwResetValFns(pwr,
+		pwrv.requireUserID,
+		pwrv.setTokenIfUnset,
+		pwrv.hmacToken,
+		pwrv.setExpiryIfUnset)
+	if err != nil {
+		return err
+	}
+	return pwrv.pwResetDB.Create(pwr)
+}
+
+// Validation code for Delete
+func (pwrv *pwResetValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return pwrv.pwResetDB.Delete(id)
+}
+
+func (pwrv *pwResetValidator) requireUserID(pwr *pwReset) error {
+	if pwr.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (pwrv *pwResetValidator) setTokenIfUnset(pwr *pwReset) error {
+	if pwr.Token != "" {
+		return nil
+	}
+	token, err := rand.String(rand.RememberTokenBytes)
+	if err != nil {
+		return err
+	}
+	pwr.Token = token
+	return nil
+}
+
+func (pwrv *pwResetValidator) hmacToken(pwr *pwReset) error {
+	if pwr.Token == "" {
+		return nil
+	}
+	pwr.TokenHash = pwrv.hmac.Hash(pwr.Token)
+	return nil
+}
+
+func (pwrv *pwResetValidator) setExpiryIfUnset(pwr *pwReset) error {
+	if !pwr.ExpiresAt.IsZero() {
+		return nil
+	}
+	pwr.ExpiresAt = time.Now().Add(pwResetDuration)
+	return nil
+}
+
+func runPwResetValFns(pwr *pwReset, fns ...pwResetValFn) error {
+	for _, fn := range fns {
+		if err := fn(pwr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ pwResetDB = &pwResetGorm{}
+var _ pwResetDB = &pwResetValidator{}
@@ -0,0 +1,268 @@
+package models
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"gophr.com/hash"
+)
+
+func TestPwResetValidatorCreate(t *testing.T) {
+	hmac := hash.NewHMAC(testHMACKey)
+	expiresAt := time.Now().Add(time.Minute).Truncate(time.Second)
+	tests := []struct {
+		name    string
+		pwr     pwReset
+		wantErr error
+		// wantToken is the token expected back, empty for any fresh one
+		wantToken     string
+		wantExpiresAt time.Time
+	}{
+		{name: "fresh token", pwr: pwReset{UserID: 1}},
+		{name: "given token", pwr: pwReset{UserID: 1, Token: "abc"}, wantToken: "abc"},
+		{name: "given expiry", pwr: pwReset{UserID: 1, ExpiresAt: expiresAt}, wantExpiresAt: expiresAt},
+		{name: "no user", pwr: pwReset{}, wantErr: ErrUserIDRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pwrv := newPwResetValidator(&pwResetMem{}, hmac)
+			before := time.Now()
+			err := pwrv.Create(&tt.pwr)
+			if err != tt.wantErr {
+				t.Fatalf("Create() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if tt.wantToken != "" && tt.pwr.Token != tt.wantToken {
+				t.Errorf("Token = %q, want %q", tt.pwr.Token, tt.wantToken)
+			}
+			if len(tt.pwr.Token) < 32 && tt.wantToken == "" {
+				t.Errorf("Token = %q, too short to be safe", tt.pwr.Token)
+			}
+			// only the HMAC is stored
+			if tt.pwr.TokenHash != hmac.Hash(tt.pwr.Token) || tt.pwr.TokenHash == tt.pwr.Token {
+				t.Errorf("TokenHash = %q, want the HMAC of the token", tt.pwr.TokenHash)
+			}
+			want := tt.wantExpiresAt
+			if want.IsZero() {
+				if got := tt.pwr.ExpiresAt.Sub(before); got < pwResetDuration || got > pwResetDuration+time.Minute {
+					t.Errorf("ExpiresAt is %v after the reset started, want %v", got, pwResetDuration)
+				}
+			} else if !tt.pwr.ExpiresAt.Equal(want) {
+				t.Errorf("ExpiresAt = %v, want %v", tt.pwr.ExpiresAt, want)
+			}
+			found, err := pwrv.ByToken(tt.pwr.Token)
+			if err != nil || found.ID != tt.pwr.ID {
+				t.Errorf("ByToken() = %+v, %v, want the reset just created", found, err)
+			}
+		})
+	}
+}
+
+func TestInitiateReset(t *testing.T) {
+	for name, backend := range testBackends(t) {
+		us := backend.User.(*userService)
+		t.Run(name, func(t *testing.T) {
+			createVerifiedUser(t, us, "verified@example.com")
+			unverified := User{Email: "unverified@example.com", Password: testPassword}
+			if err := us.Create(&unverified); err != nil {
+				t.Fatal(err)
+			}
+
+			tests := []struct {
+				email   string
+				wantErr error
+			}{
+				{"verified@example.com", nil},
+				{" Verified@Example.com ", nil},
+				{"unverified@example.com", ErrEmailNotVerified},
+				{"nobody@example.com", ErrNotFound},
+			}
+			for _, tt := range tests {
+				token, err := us.InitiateReset(tt.email)
+				if err != tt.wantErr {
+					t.Errorf("InitiateReset(%q) error = %v, want %v", tt.email, err, tt.wantErr)
+				}
+				if (token != "") != (tt.wantErr == nil) {
+					t.Errorf("InitiateReset(%q) token = %q", tt.email, token)
+				}
+			}
+		})
+	}
+}
+
+func TestCompleteReset(t *testing.T) {
+	const newPassword = "a brand new password"
+	tests := []struct {
+		name string
+		// token returns the token to use for the user
+		token     func(t *testing.T, us *userService, user *User) string
+		password  string
+		wantErr   error
+		wantField error
+		// wantPassword is the password the user ends up with, their old one when empty
+		wantPassword string
+		resetKept    bool
+	}{
+		{
+			name:         "valid",
+			token:        initiateReset,
+			password:     newPassword,
+			wantPassword: newPassword,
+		},
+		{
+			name:      "empty password",
+			token:     initiateReset,
+			password:  "",
+			wantField: ErrPasswordRequired,
+			resetKept: true,
+		},
+		{
+			name:      "short password",
+			token:     initiateReset,
+			password:  "short",
+			wantField: ErrPasswordTooShort,
+			resetKept: true,
+		},
+		{
+			name: "unknown token",
+			token: func(*testing.T, *userService, *User) string {
+				return "not-a-token"
+			},
+			password: newPassword,
+			wantErr:  ErrTokenInvalid,
+		},
+		{
+			name: "used token",
+			token: func(t *testing.T, us *userService, user *User) string {
+				token := initiateReset(t, us, user)
+				if _, err := us.CompleteReset(token, "the first new password"); err != nil {
+					t.Fatal(err)
+				}
+				return token
+			},
+			password:     newPassword,
+			wantErr:      ErrTokenInvalid,
+			wantPassword: "the first new password",
+		},
+		{
+			name: "expired token",
+			token: func(t *testing.T, us *userService, user *User) string {
+				pwr := pwReset{UserID: user.ID, ExpiresAt: time.Now().Add(-time.Second)}
+				if err := us.pwResetDB.Create(&pwr); err != nil {
+					t.Fatal(err)
+				}
+				return pwr.Token
+			},
+			password:  newPassword,
+			wantErr:   ErrTokenInvalid,
+			resetKept: true,
+		},
+	}
+	for name, backend := range testBackends(t) {
+		us := backend.User.(*userService)
+		for i, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				user := createVerifiedUser(t, us, string(rune('a'+i))+"@example.com")
+				token := tt.token(t, us, user)
+
+				got, err := us.CompleteReset(token, tt.password)
+				if tt.wantField != nil {
+					verr, ok := err.(*ValidationError)
+					if !ok || verr.Field("password") != tt.wantField {
+						t.Fatalf("CompleteReset() error = %v, want %v for the password", err, tt.wantField)
+					}
+				} else if err != tt.wantErr {
+					t.Fatalf("CompleteReset() error = %v, want %v", err, tt.wantErr)
+				}
+
+				if err == nil && got.ID != user.ID {
+					t.Errorf("CompleteReset() user = %d, want %d", got.ID, user.ID)
+				}
+				wantPassword := tt.wantPassword
+				if wantPassword == "" {
+					wantPassword = testPassword
+				}
+				if _, err := us.Authenticate(user.Email, wantPassword); err != nil {
+					t.Errorf("Authenticate() with the expected password: %v", err)
+				}
+
+				_, err = us.pwResetDB.ByToken(token)
+				if kept := err == nil; kept != tt.resetKept {
+					t.Errorf("reset still stored = %v, want %v", kept, tt.resetKept)
+				}
+			})
+		}
+	}
+}
+
+// initiateReset starts a password reset for the user and returns its token
+func initiateReset(t *testing.T, us *userService, user *User) string {
+	t.Helper()
+	token, err := us.InitiateReset(user.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestCompleteResetEndsOtherResets(t *testing.T) {
+	for name, backend := range testBackends(t) {
+		us := backend.User.(*userService)
+		t.Run(name, func(t *testing.T) {
+			user := createVerifiedUser(t, us, "gopher@example.com")
+			first := initiateReset(t, us, user)
+			second := initiateReset(t, us, user)
+			if _, err := us.CompleteReset(second, "a brand new password"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := us.CompleteReset(first, "yet another password"); err != ErrTokenInvalid {
+				t.Errorf("CompleteReset() with an older token error = %v, want %v", err, ErrTokenInvalid)
+			}
+		})
+	}
+}
+
+func TestCompleteResetConcurrently(t *testing.T) {
+	const requests = 8
+	for name, backend := range testBackends(t) {
+		us := backend.User.(*userService)
+		t.Run(name, func(t *testing.T) {
+			user := createVerifiedUser(t, us, "gopher@example.com")
+			token := initiateReset(t, us, user)
+
+			// every request sets a password of its own, so the one the user ends up with tells which got through
+			errs := make([]error, requests)
+			var wg sync.WaitGroup
+			for i := range errs {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					_, errs[i] = us.CompleteReset(token, fmt.Sprintf("new password %d", i))
+				}(i)
+			}
+			wg.Wait()
+
+			winner := -1
+			for i, err := range errs {
+				switch {
+				case err == nil && winner < 0:
+					winner = i
+				case err == nil:
+					t.Errorf("requests %d and %d both redeemed the token", winner, i)
+				case err != ErrTokenInvalid:
+					t.Errorf("CompleteReset() error = %v", err)
+				}
+			}
+			if winner < 0 {
+				t.Fatal("no request redeemed the token")
+			}
+			if _, err := us.Authenticate(user.Email, fmt.Sprintf("new password %d", winner)); err != nil {
+				t.Errorf("the password of the request that redeemed the token was overwritten: %v", err)
+			}
+		})
+	}
+}
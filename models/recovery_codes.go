@@ -0,0 +1,190 @@
+package models
+
+import (
+	"encoding/base32"
+	"strings"
+	"time"
+
+	"gophr.com/hash"
+	"gophr.com/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// recoveryCodeCount is how many recovery codes a user gets when turning on two-factor authentication
+	recoveryCodeCount = 10
+
+	// recoveryCodeBytes is the amount of randomness in each recovery code, 40 bits
+	// make 8 base32 characters that are still easy to type
+	recoveryCodeBytes = 5
+)
+
+// recoveryCode is the database model for a one-time code that stands in for the
+// authenticator app. Only the HMAC of the code is stored, like other tokens.
+type recoveryCode struct {
+	ID        uint   `gorm:"primary_key"`
+	UserID    uint   `gorm:"not null;index"`
+	Code      string `gorm:"-"`
+	CodeHash  string `gorm:"not null;unique_index"`
+	CreatedAt time.Time
+}
+
+// recoveryCodeDB is used to interact with the recovery codes database
+type recoveryCodeDB interface {
+	ByCode(userID uint, code string) (*recoveryCode, error)
+	Create(rc *recoveryCode) error
+	Delete(id uint) error
+	DeleteByUserID(userID uint) error
+}
+
+type recoveryCodeGorm struct {
+	db *gorm.DB
+}
+
+type recoveryCodeValidator struct {
+	recoveryCodeDB
+	hmac hash.HMAC
+}
+
+type recoveryCodeValFn func(*recoveryCode) error
+
+func newRecoveryCodeValidator(db recoveryCodeDB, hmac hash.HMAC) *recoveryCodeValidator {
+	return &recoveryCodeValidator{
+		recoveryCodeDB: db,
+		hmac:           hmac,
+	}
+}
+
+// newRecoveryCode returns a random recovery code formatted as two groups of four characters
+func newRecoveryCode() (string, error) {
+	b, err := rand.Bytes(recoveryCodeBytes)
+	if err != nil {
+		return "", err
+	}
+	code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+	return code[:4] + "-" + code[4:], nil
+}
+
+/*
+	********************************
+	********************************
+	Start of functions related to db
+	********************************
+	********************************
+*/
+
+// ByCode is used to look up an unused recovery code of a user by its hash
+func (rcg *recoveryCodeGorm) ByCode(userID uint, codeHash string) (*recoveryCode, error) {
+	var rc recoveryCode
+	err := first(rcg.db.Where("user_id = ? AND code_hash = ?", userID, codeHash), &rc)
+	if err != nil {
+		return nil, err
+	}
+	return &rc, nil
+}
+
+// Create is used to add a new recovery code
+func (rcg *recoveryCodeGorm) Create(rc *recoveryCode) error {
+	return rcg.db.Create(rc).Error
+}
+
+// Delete removes a recovery code. It returns ErrTwoFactorCodeInvalid if the code was
+// already removed, which is how a code is made usable only once.
+func (rcg *recoveryCodeGorm) Delete(id uint) error {
+	db := rcg.db.Where("id = ?", id).Delete(&recoveryCode{})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrTwoFactorCodeInvalid
+	}
+	return nil
+}
+
+// DeleteByUserID removes every recovery code of a user
+func (rcg *recoveryCodeGorm) DeleteByUserID(userID uint) error {
+	return rcg.db.Where("user_id = ?", userID).Delete(&recoveryCode{}).Error
+}
+
+/*
+	***********************************************
+	***********************************************
+	Start of validation and normalization functions
+	***********************************************
+	***********************************************
+*/
+
+// Validation code for ByCode
+func (rcv *recoveryCodeValidator) ByCode(userID uint, code string) (*recoveryCode, error) {
+	rc := recoveryCode{UserID: userID, Code: code}
+	err := runRecoveryCodeValFns(&rc,
+		rcv.requireUserID,
+		rcv.normalizeCode,
+		rcv.requireCode,
+		rcv.hmacCode)
+	if err != nil {
+		return nil, err
+	}
+	return rcv.recoveryCodeDB.ByCode(rc.UserID, rc.CodeHash)
+}
+
+// Validation code for Create
+func (rcv *recoveryCodeValidator) Create(rc *recoveryCode) error {
+	err := runRecoveryCodeValFns(rc,
+		rcv.requireUserID,
+		rcv.normalizeCode,
+		rcv.requireCode,
+		rcv.hmacCode)
+	if err != nil {
+		return err
+	}
+	return rcv.recoveryCodeDB.Create(rc)
+}
+
+// Validation code for Delete
+func (rcv *recoveryCodeValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return rcv.recoveryCodeDB.Delete(id)
+}
+
+func (rcv *recoveryCodeValidator) requireUserID(rc *recoveryCode) error {
+	if rc.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+// normalizeCode lets codes be typed in either case and with or without the dash
+func (rcv *recoveryCodeValidator) normalizeCode(rc *recoveryCode) error {
+	code := strings.ToLower(strings.TrimSpace(rc.Code))
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	rc.Code = code
+	return nil
+}
+
+func (rcv *recoveryCodeValidator) requireCode(rc *recoveryCode) error {
+	if rc.Code == "" {
+		return ErrTwoFactorCodeInvalid
+	}
+	return nil
+}
+
+func (rcv *recoveryCodeValidator) hmacCode(rc *recoveryCode) error {
+	rc.CodeHash = rcv.hmac.Hash(rc.Code)
+	return nil
+}
+
+func runRecoveryCodeValFns(rc *recoveryCode, fns ...recoveryCodeValFn) error {
+	for _, fn := range fns {
+		if err := fn(rc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ recoveryCodeDB = &recoveryCodeGorm{}
+var _ recoveryCodeDB = &recoveryCodeValidator{}
@@ -0,0 +1,137 @@
+package models
+
+import (
+	"gophr.com/storage"
+
+	"github.com/jinzhu/gorm"
+
+	// imported for the effects
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+const (
+	// DialectPostgres is the dialect used in production, it needs Postgres 9.5 or later
+	DialectPostgres = "postgres"
+
+	// DialectSQLite keeps the whole database in a single file, for local development.
+	// It needs SQLite 3.24 or later.
+	DialectSQLite = "sqlite3"
+)
+
+// ServicesConfig is an option passed to NewServices that sets up part of the Services
+type ServicesConfig func(*Services) error
+
+// WithGorm opens the database connection shared by every service. It has to come before the options adding services.
+// For SQLite connectionInfo is the path of the database file.
+func WithGorm(dialect, connectionInfo string) ServicesConfig {
+	return func(s *Services) error {
+		db, err := gorm.Open(dialect, connectionInfo)
+		if err != nil {
+			return err
+		}
+		if dialect == DialectSQLite {
+			// SQLite allows a single writer, sharing one connection makes requests wait
+			// their turn instead of failing with "database is locked"
+			db.DB().SetMaxOpenConns(1)
+			if err := db.Exec("PRAGMA foreign_keys = ON").Error; err != nil {
+				db.Close()
+				return err
+			}
+		}
+		s.db = db
+		return nil
+	}
+}
+
+// WithLogMode turns logging of the SQL statements run on or off
+func WithLogMode(mode bool) ServicesConfig {
+	return func(s *Services) error {
+		s.db.LogMode(mode)
+		return nil
+	}
+}
+
+// WithUser adds the UserService, pepper is added to passwords before they are hashed and hmacKey is used to hash tokens
+func WithUser(pepper, hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.User = NewUserService(s.db, pepper, hmacKey)
+		return nil
+	}
+}
+
+// WithSession adds the SessionService, hmacKey is used to hash the session tokens
+func WithSession(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.Session = NewSessionService(s.db, hmacKey)
+		return nil
+	}
+}
+
+// WithGallery adds the GalleryService
+func WithGallery() ServicesConfig {
+	return func(s *Services) error {
+		s.Gallery = NewGalleryService(s.db)
+		return nil
+	}
+}
+
+// WithImage adds the ImageService, keeping the image files in store and turning away images over maxBytes
+func WithImage(store storage.Store, maxBytes int64) ServicesConfig {
+	return func(s *Services) error {
+		s.Image = NewImageService(s.db, store, maxBytes)
+		return nil
+	}
+}
+
+// WithLoginThrottle adds the LoginThrottle, keeping its counters in the database when
+// inMemory is false. hmacKey is used to hash the tokens of unlock links.
+func WithLoginThrottle(inMemory bool, hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		if inMemory {
+			s.LoginThrottle = NewMemLoginThrottle(hmacKey)
+		} else {
+			s.LoginThrottle = NewLoginThrottle(s.db, hmacKey)
+		}
+		return nil
+	}
+}
+
+// Services holds every service of the app on top of a single database connection
+type Services struct {
+	User          UserService
+	Session       SessionService
+	Gallery       GalleryService
+	Image         ImageService
+	LoginThrottle LoginThrottle
+	db            *gorm.DB
+}
+
+// NewServices applies the options in order and returns the resulting Services
+func NewServices(cfgs ...ServicesConfig) (*Services, error) {
+	var s Services
+	for _, cfg := range cfgs {
+		if err := cfg(&s); err != nil {
+			if s.db != nil {
+				s.db.Close()
+			}
+			return nil, err
+		}
+	}
+	return &s, nil
+}
+
+// Close closes the database connection shared by the services
+func (s *Services) Close() error {
+	return s.db.Close()
+}
+
+// DestructiveReset drops the tables of every model and creates them again by applying every migration
+func (s *Services) DestructiveReset() error {
+	err := s.db.DropTableIfExists(&User{}, &pwReset{}, &recoveryCode{}, &Session{}, &Gallery{}, &Image{}, &LoginAttempt{}, "schema_migrations").Error
+	if err != nil {
+		return err
+	}
+	_, err = s.Migrator().Up()
+	return err
+}
@@ -0,0 +1,142 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"path/filepath"
+	"testing"
+
+	"gophr.com/storage"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	testPepper  = "test-pepper"
+	testHMACKey = "test-hmac-key"
+)
+
+// testPNG returns a blank PNG of width x height. When padTo is set it is padded with
+// trailing bytes, which decoders ignore, to that many bytes.
+func testPNG(t *testing.T, width, height, padTo int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	if padTo == 0 {
+		return buf.Bytes()
+	}
+	if buf.Len() > padTo {
+		t.Fatalf("a PNG takes %d bytes, more than %d", buf.Len(), padTo)
+	}
+	return append(buf.Bytes(), make([]byte, padTo-buf.Len())...)
+}
+
+// newTestDB opens a SQLite database in memory that lasts as long as the test
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(DialectSQLite, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to :memory: gets a database of its own
+	db.DB().SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newTestServices returns every service on top of a migrated SQLite database in memory,
+// with the image files kept in a temporary directory
+func newTestServices(t *testing.T, cfgs ...ServicesConfig) *Services {
+	t.Helper()
+	store, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgs = append([]ServicesConfig{
+		WithGorm(DialectSQLite, ":memory:"),
+		WithUser(testPepper, testHMACKey),
+		WithSession(testHMACKey),
+		WithGallery(),
+		WithImage(store, 1<<20),
+		WithLoginThrottle(false, testHMACKey),
+	}, cfgs...)
+	s, err := NewServices(cfgs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if _, err := s.Migrator().Up(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestNewServices(t *testing.T) {
+	s, err := NewServices(
+		WithGorm(DialectSQLite, filepath.Join(t.TempDir(), "gophr.db")),
+		WithUser(testPepper, testHMACKey),
+		WithGallery(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.User == nil || s.Gallery == nil {
+		t.Error("NewServices() left out a service it was asked for")
+	}
+	if s.Session != nil || s.Image != nil || s.LoginThrottle != nil {
+		t.Error("NewServices() added a service it was not asked for")
+	}
+	var foreignKeys int
+	if err := s.db.Raw("PRAGMA foreign_keys").Row().Scan(&foreignKeys); err != nil {
+		t.Fatal(err)
+	}
+	if foreignKeys != 1 {
+		t.Error("foreign keys are not enforced on SQLite")
+	}
+}
+
+func TestNewServicesErrors(t *testing.T) {
+	if _, err := NewServices(WithGorm("mysql", "")); err == nil {
+		t.Error("NewServices() with an unknown dialect succeeded")
+	}
+
+	var opened *gorm.DB
+	errOption := errors.New("models: option failed")
+	_, err := NewServices(
+		WithGorm(DialectSQLite, ":memory:"),
+		func(s *Services) error {
+			opened = s.db
+			return nil
+		},
+		func(s *Services) error { return errOption },
+	)
+	if err != errOption {
+		t.Fatalf("NewServices() error = %v, want %v", err, errOption)
+	}
+	// the connection is closed rather than leaked
+	if err := opened.DB().Ping(); err == nil {
+		t.Error("the database is still open after NewServices() failed")
+	}
+}
+
+func TestServicesDestructiveReset(t *testing.T) {
+	s := newTestServices(t)
+	user := User{Name: "Jon", Email: "jon@example.com", Password: testPassword}
+	if err := s.User.Create(&user); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DestructiveReset(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.User.ByEmail("jon@example.com"); err != ErrNotFound {
+		t.Errorf("ByEmail() after DestructiveReset() = %v, want %v", err, ErrNotFound)
+	}
+	if err := s.Migrator().Check(); err != nil {
+		t.Errorf("migrations after DestructiveReset(): %v", err)
+	}
+}
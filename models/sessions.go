@@ -0,0 +1,451 @@
+package models
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"gophr.com/hash"
+	"gophr.com/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	// ErrSessionTokenTooShort is a custom error we return when a session token is not 32 bytes long
+	ErrSessionTokenTooShort = errors.New("models: session token must be atleast 32 bytes")
+)
+
+const (
+	// sessionDuration is how long a login lasts before the user has to log in again
+	sessionDuration = 30 * 24 * time.Hour
+
+	// sessionSeenInterval limits how often LastSeenAt is written, so browsing does not turn every request into a write
+	sessionSeenInterval = 1 * time.Minute
+
+	// maxUserAgentLength keeps absurdly long user agents out of the sessions table
+	maxUserAgentLength = 255
+)
+
+// Session is the database model for a login on one device. The token lives in the
+// remember_token cookie of that device and only its HMAC is stored. UserAgent and IP
+// describe the device when it logged in, so users can tell their sessions apart.
+type Session struct {
+	ID         uint   `gorm:"primary_key"`
+	UserID     uint   `gorm:"not null;index"`
+	Token      string `gorm:"-"`
+	TokenHash  string `gorm:"not null;unique_index"`
+	UserAgent  string
+	IP         string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+}
+
+// expired reports whether the session can no longer be used
+func (s *Session) expired() bool {
+	return time.Now().After(s.ExpiresAt)
+}
+
+// SessionDB is used to interact with the sessions database
+type SessionDB interface {
+	ByID(id uint) (*Session, error)
+	ByToken(token string) (*Session, error)
+	// ByUserID returns the sessions of a user, most recently seen first
+	ByUserID(userID uint) ([]Session, error)
+
+	Create(session *Session) error
+	Update(session *Session) error
+	// Seen sets LastSeenAt of a session without saving anything else, ErrNotFound is returned
+	// when the session is gone, so a session revoked during a lookup is not written back
+	Seen(id uint, at time.Time) error
+	Delete(id uint) error
+	DeleteByUserID(userID uint) error
+}
+
+// SessionService keeps track of the devices users are logged in on
+type SessionService interface {
+	// Start creates a session for a user logging in from the device described by
+	// userAgent and ip, and returns it with the token to put in the cookie
+	Start(userID uint, userAgent, ip string) (*Session, error)
+
+	// Lookup returns the session the token from a cookie belongs to and records that it
+	// was just used. Expired sessions are removed and reported as ErrNotFound.
+	Lookup(token string) (*Session, error)
+
+	SessionDB
+}
+
+type sessionService struct {
+	SessionDB
+}
+
+type sessionGorm struct {
+	db *gorm.DB
+}
+
+type sessionValidator struct {
+	SessionDB
+	hmac hash.HMAC
+}
+
+type sessionValFn func(*Session) error
+
+// NewSessionService returns a SessionService keeping the sessions in the database, hmacKey is used to hash their tokens
+func NewSessionService(db *gorm.DB, hmacKey string) SessionService {
+	return newSessionService(&sessionGorm{db: db}, hmacKey)
+}
+
+// NewMemSessionService returns a SessionService keeping the sessions in memory, for tests and demos
+func NewMemSessionService(hmacKey string) SessionService {
+	return newSessionService(&sessionMem{}, hmacKey)
+}
+
+func newSessionService(sdb SessionDB, hmacKey string) *sessionService {
+	return &sessionService{
+		SessionDB: newSessionValidator(sdb, hash.NewHMAC(hmacKey)),
+	}
+}
+
+func newSessionValidator(sdb SessionDB, hmac hash.HMAC) *sessionValidator {
+	return &sessionValidator{
+		SessionDB: sdb,
+		hmac:      hmac,
+	}
+}
+
+// Start creates a new session, every login gets its own so each device can be signed out on its own
+func (ss *sessionService) Start(userID uint, userAgent, ip string) (*Session, error) {
+	session := Session{
+		UserID:    userID,
+		UserAgent: userAgent,
+		IP:        ip,
+	}
+	if err := ss.Create(&session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Lookup refreshes LastSeenAt at most once every sessionSeenInterval
+func (ss *sessionService) Lookup(token string) (*Session, error) {
+	session, err := ss.ByToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if session.expired() {
+		if err := ss.Delete(session.ID); err != nil {
+			return nil, err
+		}
+		return nil, ErrNotFound
+	}
+	if time.Since(session.LastSeenAt) > sessionSeenInterval {
+		session.LastSeenAt = time.Now()
+		if err := ss.Seen(session.ID, session.LastSeenAt); err != nil {
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+/*
+	********************************
+	********************************
+	Start of functions related to db
+	********************************
+	********************************
+*/
+
+// ByID is used to look up a session by its id
+func (sg *sessionGorm) ByID(id uint) (*Session, error) {
+	var session Session
+	if err := first(sg.db.Where("id = ?", id), &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// ByToken is used to look up a session by the hash of its token
+func (sg *sessionGorm) ByToken(tokenHash string) (*Session, error) {
+	var session Session
+	if err := first(sg.db.Where("token_hash = ?", tokenHash), &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// ByUserID is used to list the sessions of a user
+func (sg *sessionGorm) ByUserID(userID uint) ([]Session, error) {
+	var sessions []Session
+	err := sg.db.Where("user_id = ?", userID).Order("last_seen_at desc").Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// Create is used to add a new session
+func (sg *sessionGorm) Create(session *Session) error {
+	return sg.db.Create(session).Error
+}
+
+// Update is used to save changes to a session
+func (sg *sessionGorm) Update(session *Session) error {
+	return sg.db.Save(session).Error
+}
+
+// Seen is used to record when a session was last used
+func (sg *sessionGorm) Seen(id uint, at time.Time) error {
+	db := sg.db.Model(&Session{}).Where("id = ?", id).UpdateColumn("last_seen_at", at)
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Delete removes a session, signing out the device it belongs to
+func (sg *sessionGorm) Delete(id uint) error {
+	return sg.db.Where("id = ?", id).Delete(&Session{}).Error
+}
+
+// DeleteByUserID removes every session of a user, signing them out everywhere
+func (sg *sessionGorm) DeleteByUserID(userID uint) error {
+	return sg.db.Where("user_id = ?", userID).Delete(&Session{}).Error
+}
+
+/*
+	***********************************************
+	***********************************************
+	Start of validation and normalization functions
+	***********************************************
+	***********************************************
+*/
+
+// Validation code for ByToken
+func (sv *sessionValidator) ByToken(token string) (*Session, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	session := Session{Token: token}
+	if err := runSessionValFns(&session, sv.hmacToken); err != nil {
+		return nil, err
+	}
+	return sv.SessionDB.ByToken(session.TokenHash)
+}
+
+// Validation code for Create
+func (sv *sessionValidator) Create(session *Session) error {
+	err := runSessionValFns(session,
+		sv.requireUserID,
+		sv.setTokenIfUnset,
+		sv.tokenMinBytes,
+		sv.hmacToken,
+		sv.truncateUserAgent,
+		sv.setTimesIfUnset)
+	if err != nil {
+		return err
+	}
+	return sv.SessionDB.Create(session)
+}
+
+// Validation code for Update
+func (sv *sessionValidator) Update(session *Session) error {
+	err := runSessionValFns(session,
+		sv.requireUserID,
+		sv.truncateUserAgent)
+	if err != nil {
+		return err
+	}
+	return sv.SessionDB.Update(session)
+}
+
+// Validation code for Delete
+func (sv *sessionValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return sv.SessionDB.Delete(id)
+}
+
+func (sv *sessionValidator) requireUserID(session *Session) error {
+	if session.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (sv *sessionValidator) setTokenIfUnset(session *Session) error {
+	if session.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	session.Token = token
+	return nil
+}
+
+func (sv *sessionValidator) tokenMinBytes(session *Session) error {
+	n, err := rand.NBytes(session.Token)
+	if err != nil {
+		return err
+	}
+	if n < rand.RememberTokenBytes {
+		return ErrSessionTokenTooShort
+	}
+	return nil
+}
+
+func (sv *sessionValidator) hmacToken(session *Session) error {
+	if session.Token == "" {
+		return nil
+	}
+	session.TokenHash = sv.hmac.Hash(session.Token)
+	return nil
+}
+
+func (sv *sessionValidator) truncateUserAgent(session *Session) error {
+	if len(session.UserAgent) > maxUserAgentLength {
+		session.UserAgent = session.UserAgent[:maxUserAgentLength]
+	}
+	return nil
+}
+
+func (sv *sessionValidator) setTimesIfUnset(session *Session) error {
+	now := time.Now()
+	if session.LastSeenAt.IsZero() {
+		session.LastSeenAt = now
+	}
+	if session.ExpiresAt.IsZero() {
+		session.ExpiresAt = now.Add(sessionDuration)
+	}
+	return nil
+}
+
+func runSessionValFns(session *Session, fns ...sessionValFn) error {
+	for _, fn := range fns {
+		if err := fn(session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sessionMem is a SessionDB kept in memory that behaves like sessionGorm
+type sessionMem struct {
+	mu       sync.Mutex
+	nextID   uint
+	sessions []Session
+}
+
+func (sm *sessionMem) find(match func(*Session) bool) (*Session, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for _, s := range sm.sessions {
+		if match(&s) {
+			return &s, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// ByID is used to look up a session by its id
+func (sm *sessionMem) ByID(id uint) (*Session, error) {
+	return sm.find(func(s *Session) bool { return s.ID == id })
+}
+
+// ByToken is used to look up a session by the hash of its token
+func (sm *sessionMem) ByToken(tokenHash string) (*Session, error) {
+	return sm.find(func(s *Session) bool { return s.TokenHash == tokenHash })
+}
+
+// ByUserID is used to list the sessions of a user, most recently seen first
+func (sm *sessionMem) ByUserID(userID uint) ([]Session, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	var sessions []Session
+	for _, s := range sm.sessions {
+		if s.UserID == userID {
+			sessions = append(sessions, s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+	return sessions, nil
+}
+
+// Create is used to add a new session
+func (sm *sessionMem) Create(session *Session) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for _, s := range sm.sessions {
+		if s.TokenHash == session.TokenHash {
+			return errUniqueViolation
+		}
+	}
+	sm.nextID++
+	session.ID = sm.nextID
+	session.CreatedAt = time.Now()
+	sm.sessions = append(sm.sessions, *session)
+	return nil
+}
+
+// Update is used to save changes to a session
+func (sm *sessionMem) Update(session *Session) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for i := range sm.sessions {
+		if sm.sessions[i].ID == session.ID {
+			sm.sessions[i] = *session
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// Seen is used to record when a session was last used
+func (sm *sessionMem) Seen(id uint, at time.Time) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for i := range sm.sessions {
+		if sm.sessions[i].ID == id {
+			sm.sessions[i].LastSeenAt = at
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// Delete removes a session
+func (sm *sessionMem) Delete(id uint) error {
+	return sm.deleteWhere(func(s *Session) bool { return s.ID == id })
+}
+
+// DeleteByUserID removes every session of a user
+func (sm *sessionMem) DeleteByUserID(userID uint) error {
+	return sm.deleteWhere(func(s *Session) bool { return s.UserID == userID })
+}
+
+func (sm *sessionMem) deleteWhere(match func(*Session) bool) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	kept := sm.sessions[:0]
+	for _, s := range sm.sessions {
+		if !match(&s) {
+			kept = append(kept, s)
+		}
+	}
+	sm.sessions = kept
+	return nil
+}
+
+var _ SessionDB = &sessionGorm{}
+var _ SessionDB = &sessionValidator{}
+var _ SessionDB = &sessionMem{}
+var _ SessionService = &sessionService{}
@@ -0,0 +1,219 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionStart(t *testing.T) {
+	for name, backend := range testBackends(t) {
+		ss := backend.Session
+		t.Run(name, func(t *testing.T) {
+			before := time.Now()
+			session, err := ss.Start(1, strings.Repeat("a", maxUserAgentLength+10), "192.0.2.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if session.Token == "" || session.TokenHash == "" || session.TokenHash == session.Token {
+				t.Errorf("Start() token %q with hash %q, want a token stored only as its hash", session.Token, session.TokenHash)
+			}
+			if len(session.UserAgent) != maxUserAgentLength {
+				t.Errorf("user agent is %d bytes, want it cut to %d", len(session.UserAgent), maxUserAgentLength)
+			}
+			if session.ExpiresAt.Before(before.Add(sessionDuration)) || session.ExpiresAt.After(time.Now().Add(sessionDuration)) {
+				t.Errorf("ExpiresAt = %v, want %v from now", session.ExpiresAt, sessionDuration)
+			}
+			other, err := ss.Start(1, "test", "192.0.2.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if other.Token == session.Token || other.ID == session.ID {
+				t.Error("two logins share a session")
+			}
+			if _, err := ss.Start(0, "test", "192.0.2.1"); err != ErrUserIDRequired {
+				t.Errorf("Start() without a user error = %v, want %v", err, ErrUserIDRequired)
+			}
+			if err := ss.Create(&Session{UserID: 1, Token: "c2hvcnQ="}); err != ErrSessionTokenTooShort {
+				t.Errorf("Create() with a short token error = %v, want %v", err, ErrSessionTokenTooShort)
+			}
+		})
+	}
+}
+
+func TestSessionLookup(t *testing.T) {
+	for name, backend := range testBackends(t) {
+		ss := backend.Session
+		t.Run(name, func(t *testing.T) {
+			session, err := ss.Start(1, "test", "192.0.2.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ss.Lookup(session.Token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != session.ID || got.UserID != 1 {
+				t.Errorf("Lookup() = session %d of user %d, want session %d of user 1", got.ID, got.UserID, session.ID)
+			}
+			for _, token := range []string{"", "not-a-token"} {
+				if _, err := ss.Lookup(token); err != ErrNotFound {
+					t.Errorf("Lookup(%q) error = %v, want %v", token, err, ErrNotFound)
+				}
+			}
+
+			// looking a session up soon after it was last seen doesn't write it again
+			seen := time.Now().Add(-sessionSeenInterval / 2)
+			session.LastSeenAt = seen
+			if err := ss.Update(session); err != nil {
+				t.Fatal(err)
+			}
+			got, err = ss.Lookup(session.Token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.LastSeenAt.Equal(seen) {
+				t.Errorf("Lookup() within the interval moved LastSeenAt from %v to %v", seen, got.LastSeenAt)
+			}
+			session.LastSeenAt = time.Now().Add(-2 * sessionSeenInterval)
+			if err := ss.Update(session); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ss.Lookup(session.Token); err != nil {
+				t.Fatal(err)
+			}
+			stored, err := ss.ByID(session.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if time.Since(stored.LastSeenAt) > time.Minute/2 {
+				t.Errorf("LastSeenAt = %v after a lookup, want it refreshed", stored.LastSeenAt)
+			}
+
+			session.ExpiresAt = time.Now().Add(-time.Second)
+			if err := ss.Update(session); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ss.Lookup(session.Token); err != ErrNotFound {
+				t.Errorf("Lookup() of an expired session error = %v, want %v", err, ErrNotFound)
+			}
+			if _, err := ss.ByID(session.ID); err != ErrNotFound {
+				t.Errorf("ByID() of an expired session error = %v, want it removed", err)
+			}
+		})
+	}
+}
+
+// revokedDuringLookup is a SessionDB whose sessions are revoked right after they are looked up by token,
+// like a user signing a device out while it is loading a page
+type revokedDuringLookup struct {
+	SessionDB
+}
+
+func (r *revokedDuringLookup) ByToken(tokenHash string) (*Session, error) {
+	session, err := r.SessionDB.ByToken(tokenHash)
+	if err != nil {
+		return nil, err
+	}
+	return session, r.SessionDB.Delete(session.ID)
+}
+
+func TestSessionLookupRevoked(t *testing.T) {
+	sdbs := map[string]func(*testing.T) SessionDB{
+		"gorm": func(t *testing.T) SessionDB { return &sessionGorm{db: newTestServices(t).db} },
+		"mem":  func(*testing.T) SessionDB { return &sessionMem{} },
+	}
+	for name, newSDB := range sdbs {
+		t.Run(name, func(t *testing.T) {
+			sdb := newSDB(t)
+			ss := newSessionService(sdb, testHMACKey)
+			session, err := ss.Start(1, "test", "192.0.2.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ss.Delete(session.ID); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ss.Lookup(session.Token); err != ErrNotFound {
+				t.Errorf("Lookup() of a revoked session error = %v, want %v", err, ErrNotFound)
+			}
+
+			// a lookup that finds the session before it is revoked must not bring it back
+			racing := newSessionService(&revokedDuringLookup{sdb}, testHMACKey)
+			session, err = racing.Start(1, "test", "192.0.2.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			session.LastSeenAt = time.Now().Add(-2 * sessionSeenInterval)
+			if err := racing.Update(session); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := racing.Lookup(session.Token); err != ErrNotFound {
+				t.Errorf("Lookup() of a session revoked during the lookup error = %v, want %v", err, ErrNotFound)
+			}
+			if _, err := ss.ByID(session.ID); err != ErrNotFound {
+				t.Errorf("ByID() of a session revoked during a lookup error = %v, want it to stay removed", err)
+			}
+		})
+	}
+}
+
+func TestSessionDevices(t *testing.T) {
+	for name, backend := range testBackends(t) {
+		ss := backend.Session
+		t.Run(name, func(t *testing.T) {
+			var sessions []*Session
+			for i, agent := range []string{"laptop", "phone", "tablet"} {
+				s, err := ss.Start(1, agent, "192.0.2.1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				s.LastSeenAt = time.Now().Add(time.Duration(-i) * time.Hour)
+				if err := ss.Update(s); err != nil {
+					t.Fatal(err)
+				}
+				sessions = append(sessions, s)
+			}
+			other, err := ss.Start(2, "laptop", "192.0.2.2")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			list, err := ss.ByUserID(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var agents []string
+			for _, s := range list {
+				agents = append(agents, s.UserAgent)
+			}
+			if strings.Join(agents, ",") != "laptop,phone,tablet" {
+				t.Errorf("ByUserID() = %v, want the sessions most recently seen first", agents)
+			}
+
+			// signing out one device leaves the others
+			if err := ss.Delete(sessions[1].ID); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ss.Lookup(sessions[1].Token); err != ErrNotFound {
+				t.Errorf("Lookup() of a deleted session error = %v, want %v", err, ErrNotFound)
+			}
+			if _, err := ss.Lookup(sessions[0].Token); err != nil {
+				t.Errorf("Lookup() of another device = %v, want nil", err)
+			}
+			if err := ss.Delete(0); err != ErrIDInvalid {
+				t.Errorf("Delete(0) error = %v, want %v", err, ErrIDInvalid)
+			}
+
+			if err := ss.DeleteByUserID(1); err != nil {
+				t.Fatal(err)
+			}
+			if list, err := ss.ByUserID(1); err != nil || len(list) != 0 {
+				t.Errorf("ByUserID() after signing out everywhere = %d sessions, %v", len(list), err)
+			}
+			if _, err := ss.Lookup(other.Token); err != nil {
+				t.Errorf("Lookup() of another user's session = %v, want nil", err)
+			}
+		})
+	}
+}
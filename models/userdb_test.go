@@ -0,0 +1,263 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestUserDB runs the behaviour every UserDB implementation has to share against each of
+// them, so the in-memory tables can be trusted to stand in for the database
+func TestUserDB(t *testing.T) {
+	udbs := map[string]func(*testing.T) UserDB{
+		"gorm": func(t *testing.T) UserDB { return &userGorm{db: newTestServices(t).db} },
+		"mem":  func(*testing.T) UserDB { return newUserMem() },
+	}
+	checks := []struct {
+		name string
+		fn   func(*testing.T, UserDB)
+	}{
+		{"missing users are not found", checkUserNotFound},
+		{"create assigns an id and timestamps", checkUserCreate},
+		{"users can be found by every lookup", checkUserLookups},
+		{"email is unique", checkUserUnique},
+		{"update saves changes", checkUserUpdate},
+		{"delete is soft", checkUserSoftDelete},
+		{"returned users are copies", checkUserCopies},
+		{"fields that are not columns are not kept", checkUserUnsavedFields},
+		{"due deletions are listed", checkUserDueForDeletion},
+		{"time steps only move forward", checkUserTOTPStep},
+	}
+	for name, newUDB := range udbs {
+		for _, c := range checks {
+			t.Run(name+"/"+c.name, func(t *testing.T) {
+				c.fn(t, newUDB(t))
+			})
+		}
+	}
+}
+
+// checkUser returns the n-th of a set of users that differ in every unique field
+func checkUser(n int) User {
+	return User{
+		Name:            fmt.Sprintf("User %d", n),
+		Email:           fmt.Sprintf("user%d@example.com", n),
+		PasswordHash:    fmt.Sprintf("password-hash-%d", n),
+		VerifyTokenHash: fmt.Sprintf("verify-hash-%d", n),
+		LoginTokenHash:  fmt.Sprintf("login-hash-%d", n),
+	}
+}
+
+func checkUserNotFound(t *testing.T, udb UserDB) {
+	if _, err := udb.ByID(1); err != ErrNotFound {
+		t.Fatalf("ByID returned %v, want ErrNotFound", err)
+	}
+	if _, err := udb.ByEmail("nobody@example.com"); err != ErrNotFound {
+		t.Fatalf("ByEmail returned %v, want ErrNotFound", err)
+	}
+	if _, err := udb.ByVerifyToken("no-such-hash"); err != ErrNotFound {
+		t.Fatalf("ByVerifyToken returned %v, want ErrNotFound", err)
+	}
+	if _, err := udb.ByLoginToken("no-such-hash"); err != ErrNotFound {
+		t.Fatalf("ByLoginToken returned %v, want ErrNotFound", err)
+	}
+}
+
+func checkUserCreate(t *testing.T, udb UserDB) {
+	first, second := checkUser(1), checkUser(2)
+	if err := udb.Create(&first); err != nil {
+		t.Fatal(err)
+	}
+	if err := udb.Create(&second); err != nil {
+		t.Fatal(err)
+	}
+	if first.ID == 0 || second.ID == 0 || first.ID == second.ID {
+		t.Fatalf("got ids %d and %d, want two different non zero ids", first.ID, second.ID)
+	}
+	if first.CreatedAt.IsZero() || first.UpdatedAt.IsZero() {
+		t.Fatal("CreatedAt and UpdatedAt were not set")
+	}
+}
+
+func checkUserLookups(t *testing.T, udb UserDB) {
+	user := checkUser(1)
+	if err := udb.Create(&user); err != nil {
+		t.Fatal(err)
+	}
+	lookups := map[string]func() (*User, error){
+		"ByID":          func() (*User, error) { return udb.ByID(user.ID) },
+		"ByEmail":       func() (*User, error) { return udb.ByEmail(user.Email) },
+		"ByVerifyToken": func() (*User, error) { return udb.ByVerifyToken(user.VerifyTokenHash) },
+		"ByLoginToken":  func() (*User, error) { return udb.ByLoginToken(user.LoginTokenHash) },
+	}
+	for name, lookup := range lookups {
+		found, err := lookup()
+		if err != nil {
+			t.Fatalf("%s returned %v", name, err)
+		}
+		if found.ID != user.ID || found.Email != user.Email || found.Name != user.Name || found.PasswordHash != user.PasswordHash {
+			t.Fatalf("%s returned %+v, want %+v", name, found, user)
+		}
+	}
+}
+
+func checkUserUnique(t *testing.T, udb UserDB) {
+	user := checkUser(1)
+	if err := udb.Create(&user); err != nil {
+		t.Fatal(err)
+	}
+	sameEmail := checkUser(2)
+	sameEmail.Email = user.Email
+	if err := udb.Create(&sameEmail); err == nil {
+		t.Fatalf("created a second user with email %s", user.Email)
+	}
+	other := checkUser(4)
+	if err := udb.Create(&other); err != nil {
+		t.Fatal(err)
+	}
+	other.Email = user.Email
+	if err := udb.Update(&other); err == nil {
+		t.Fatalf("updated a second user to email %s", user.Email)
+	}
+}
+
+func checkUserUpdate(t *testing.T, udb UserDB) {
+	user := checkUser(1)
+	if err := udb.Create(&user); err != nil {
+		t.Fatal(err)
+	}
+	user.Name = "Renamed"
+	user.Email = "renamed@example.com"
+	user.EmailVerified = true
+	if err := udb.Update(&user); err != nil {
+		t.Fatal(err)
+	}
+	found, err := udb.ByEmail("renamed@example.com")
+	if err != nil {
+		t.Fatalf("ByEmail after update returned %v", err)
+	}
+	if found.ID != user.ID || found.Name != "Renamed" || !found.EmailVerified {
+		t.Fatalf("found %+v after update", found)
+	}
+	if _, err := udb.ByEmail(checkUser(1).Email); err != ErrNotFound {
+		t.Fatalf("old email still finds the user, got %v", err)
+	}
+}
+
+func checkUserSoftDelete(t *testing.T, udb UserDB) {
+	user := checkUser(1)
+	if err := udb.Create(&user); err != nil {
+		t.Fatal(err)
+	}
+	if err := udb.Delete(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := udb.ByID(user.ID); err != ErrNotFound {
+		t.Fatalf("ByID after delete returned %v, want ErrNotFound", err)
+	}
+	if _, err := udb.ByEmail(user.Email); err != ErrNotFound {
+		t.Fatalf("ByEmail after delete returned %v, want ErrNotFound", err)
+	}
+	// the deleted row is still there, so it keeps holding on to its unique values
+	again := checkUser(2)
+	again.Email = user.Email
+	if err := udb.Create(&again); err == nil {
+		t.Fatal("reused the email of a deleted user")
+	}
+	if err := udb.Delete(user.ID + 100); err != nil {
+		t.Fatalf("deleting a missing user returned %v", err)
+	}
+}
+
+func checkUserCopies(t *testing.T, udb UserDB) {
+	user := checkUser(1)
+	if err := udb.Create(&user); err != nil {
+		t.Fatal(err)
+	}
+	found, err := udb.ByID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found.Name = "Changed without saving"
+	user.Name = "Also changed without saving"
+	again, err := udb.ByID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Name != checkUser(1).Name {
+		t.Fatalf("name is %q without an update", again.Name)
+	}
+}
+
+func checkUserUnsavedFields(t *testing.T, udb UserDB) {
+	user := checkUser(1)
+	user.Password = "password"
+	user.VerifyToken = "verify-token"
+	user.LoginToken = "login-token"
+	if err := udb.Create(&user); err != nil {
+		t.Fatal(err)
+	}
+	if err := udb.Update(&user); err != nil {
+		t.Fatal(err)
+	}
+	found, err := udb.ByID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Password != "" || found.VerifyToken != "" || found.LoginToken != "" {
+		t.Fatalf("found user has Password %q, VerifyToken %q and LoginToken %q, want them left out",
+			found.Password, found.VerifyToken, found.LoginToken)
+	}
+	if user.Password != "password" {
+		t.Fatal("saving the user cleared the fields it was given")
+	}
+}
+
+func checkUserDueForDeletion(t *testing.T, udb UserDB) {
+	now := time.Now()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	due, later, kept, deleted := checkUser(1), checkUser(2), checkUser(3), checkUser(4)
+	due.DeletionDueAt = &past
+	later.DeletionDueAt = &future
+	deleted.DeletionDueAt = &past
+	for _, u := range []*User{&due, &later, &kept, &deleted} {
+		if err := udb.Create(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := udb.Delete(deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+	users, err := udb.DueForDeletion(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].ID != due.ID {
+		t.Fatalf("got %d users, want only user %d", len(users), due.ID)
+	}
+}
+
+func checkUserTOTPStep(t *testing.T, udb UserDB) {
+	user := checkUser(1)
+	if err := udb.Create(&user); err != nil {
+		t.Fatal(err)
+	}
+	if err := udb.UseTOTPStep(user.ID, 10); err != nil {
+		t.Fatalf("UseTOTPStep(10) returned %v, want nil", err)
+	}
+	for _, step := range []int64{10, 9} {
+		if err := udb.UseTOTPStep(user.ID, step); err != ErrTwoFactorCodeInvalid {
+			t.Fatalf("UseTOTPStep(%d) after step 10 returned %v, want ErrTwoFactorCodeInvalid", step, err)
+		}
+	}
+	stored, err := udb.ByID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.TOTPLastStep != 10 {
+		t.Fatalf("TOTPLastStep = %d, want 10", stored.TOTPLastStep)
+	}
+	if err := udb.UseTOTPStep(user.ID+1, 11); err != ErrTwoFactorCodeInvalid {
+		t.Fatalf("UseTOTPStep() of a missing user returned %v, want ErrTwoFactorCodeInvalid", err)
+	}
+}
@@ -4,53 +4,83 @@ import (
 	"errors"
 	"regexp"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"gophr.com/hash"
 	"gophr.com/rand"
+	"gophr.com/totp"
 
 	"github.com/jinzhu/gorm"
 
 	"golang.org/x/crypto/bcrypt"
-
-	// imported for the effects
-	_ "github.com/jinzhu/gorm/dialects/postgres"
 )
 
 var (
 	// ErrNotFound is a custom error we return when a resource we are looking for is not present in the db
-	ErrNotFound = errors.New("models: resource not found")
+	ErrNotFound error = modelError("models: resource not found")
 
 	// ErrIDInvalid is a custom error we return when the id of user we want to delete is invalid
 	ErrIDInvalid = errors.New("models: ID provided was invalid")
 
 	// ErrPasswordIncorrect is a custom error we return when the user enters an invalid password in login page
-	ErrPasswordIncorrect = errors.New("models: incorrect password provided")
+	ErrPasswordIncorrect error = modelError("models: incorrect password provided")
 
 	// ErrEmailRequired is a custom error we return when the email address is not provided when creating a user
-	ErrEmailRequired = errors.New("models: email address is required")
+	ErrEmailRequired error = invalidError("models: email address is required")
 
 	// ErrEmailInvalid is a custom error we return when the email address provided doesn't match requirements
-	ErrEmailInvalid = errors.New("models: email address is not valid")
+	ErrEmailInvalid error = invalidError("models: email address is not valid")
 
 	// ErrEmailTaken is a custom error we return when create or update is called with an email address that is already in use
-	ErrEmailTaken = errors.New("models: email address is already taken")
+	ErrEmailTaken error = invalidError("models: email address is already taken")
 
 	// ErrPasswordTooShort is a custom error we return when the password set at account creation is too short
-	ErrPasswordTooShort = errors.New("models: password must be atleast 8 characters long")
+	ErrPasswordTooShort error = invalidError("models: password must be at least 8 characters long")
 
 	// ErrPasswordRequired is a custom error we return when user tries to create an account without setting a password
-	ErrPasswordRequired = errors.New("models: password is required")
+	ErrPasswordRequired error = invalidError("models: password is required")
+
+	// ErrEmailNotVerified is a custom error we return when an action needs a verified email address and the user has not verified theirs
+	ErrEmailNotVerified error = modelError("models: email address has not been verified")
+
+	// ErrEmailAlreadyVerified is a custom error we return when a verification email is asked for by a user who is already verified
+	ErrEmailAlreadyVerified error = modelError("models: email address is already verified")
+
+	// ErrVerifyThrottled is a custom error we return when verification emails are asked for too often
+	ErrVerifyThrottled error = modelError("models: a verification email was sent recently, please check your inbox or try again in a few minutes")
 
-	// ErrRememberRequired is a custom error we return when create or update is attempted without a user remember token hash
-	ErrRememberRequired = errors.New("models: remember token is required")
+	// ErrNameTooLong is a custom error we return when the name does not fit in its column
+	ErrNameTooLong error = invalidError("models: name must be at most 255 characters long")
 
-	// ErrRememberTooShort is a custom error we return when the remember token is not 32 bytes long
-	ErrRememberTooShort = errors.New("models: remember token must be atleast 32 bytes")
+	// ErrTwoFactorCodeInvalid is a custom error we return when a code from an authenticator app or a recovery code does not match
+	ErrTwoFactorCodeInvalid error = modelError("models: the code provided is not valid")
+
+	// ErrTwoFactorEnabled is a custom error we return when two-factor authentication is set up for a user who already has it on
+	ErrTwoFactorEnabled error = modelError("models: two-factor authentication is already turned on")
+
+	// ErrTwoFactorNotStarted is a custom error we return when two-factor authentication is confirmed before a secret was made
+	ErrTwoFactorNotStarted error = modelError("models: two-factor authentication has not been set up yet")
+
+	// ErrDeletionScheduled is a custom error we return when deletion is asked for by a user whose account is already going to be deleted
+	ErrDeletionScheduled error = modelError("models: this account is already scheduled for deletion")
 )
 
 const (
-	hmacSecretKey = "secret-hmac-key"
-	userPwPepper  = "secret-random-string"
+	// verifyResendInterval is how long a user has to wait before another verification email is sent
+	verifyResendInterval = 5 * time.Minute
+
+	// verifyTokenDuration is how long a verification link stays usable after it is sent
+	verifyTokenDuration = 7 * 24 * time.Hour
+
+	// nameMaxLength is the size of the name column
+	nameMaxLength = 255
+
+	// twoFactorLoginDuration is how long a user has to enter their code once their password was accepted
+	twoFactorLoginDuration = 5 * time.Minute
+
+	// accountDeletionGrace is how long a deleted account is kept, logging in before it runs out cancels the deletion
+	accountDeletionGrace = 14 * 24 * time.Hour
 )
 
 // User is the database model for our customer
@@ -60,8 +90,36 @@ type User struct {
 	Email        string `gorm:"not null;unique_index"`
 	Password     string `gorm:"-"`
 	PasswordHash string `gorm:"not null"`
-	Remember     string `gorm:"-"`
-	RememberHash string `gorm:"not null;unique_index"`
+
+	// KeepPhotoLocation leaves GPS coordinates in the publicly served copies of the user's photos
+	KeepPhotoLocation bool `gorm:"not null;default:false"`
+
+	// EmailVerified is set once the user has followed the link sent to their email address
+	EmailVerified   bool   `gorm:"not null;default:false"`
+	VerifyToken     string `gorm:"-"`
+	VerifyTokenHash string `gorm:"index"`
+	VerifySentAt    *time.Time
+
+	// TOTPSecret is shared with the user's authenticator app. It is made when setting up
+	// two-factor authentication, which is only turned on once the app proves it has it.
+	TOTPSecret       string
+	TwoFactorEnabled bool `gorm:"not null;default:false"`
+	// TOTPLastStep is the time step of the last code used, so no code works twice
+	TOTPLastStep int64 `gorm:"not null;default:0"`
+
+	// LoginToken identifies a login whose password was right and that waits for the second factor
+	LoginToken     string `gorm:"-"`
+	LoginTokenHash string `gorm:"index"`
+	LoginStartedAt *time.Time
+
+	// DeletionDueAt is set when the user deletes their account, which is purged along
+	// with everything they own once that time has passed
+	DeletionDueAt *time.Time `gorm:"index"`
+}
+
+// DeletionScheduled reports whether the user has asked for their account to be deleted
+func (u *User) DeletionScheduled() bool {
+	return u.DeletionDueAt != nil
 }
 
 // UserDB is used to interact with the users database
@@ -69,29 +127,90 @@ type UserDB interface {
 	// Methods for querying for single users
 	ByID(id uint) (*User, error)
 	ByEmail(email string) (*User, error)
-	ByRemember(token string) (*User, error)
+	ByVerifyToken(token string) (*User, error)
+	ByLoginToken(token string) (*User, error)
+
+	// DueForDeletion returns the users whose account deletion was due at or before t
+	DueForDeletion(t time.Time) ([]User, error)
 
 	// Methods for altering users
 	Create(user *User) error
 	Update(user *User) error
 	Delete(id uint) error
 
+	// UseTOTPStep records that a user logged in with the code of the given time step. It returns
+	// ErrTwoFactorCodeInvalid unless the step is later than the last one used, so of two logins
+	// racing with the same code only one gets through.
+	UseTOTPStep(id uint, step int64) error
+
 	// Used to close a DB connection
 	Close() error
-
-	// Migration helpers
-	AutoMigrate() error
-	DestructiveReset() error
 }
 
 // UserService is a set of methods used to manipulate and work with the user model
 type UserService interface {
 	Authenticate(email, password string) (*User, error)
+
+	// InitiateReset starts a password reset for the user with the given email and
+	// returns the token that has to be sent to them
+	InitiateReset(email string) (string, error)
+
+	// CompleteReset sets a new password for the user the token was issued to, and
+	// uses up the token
+	CompleteReset(token, newPw string) (*User, error)
+
+	// StartVerification issues a new email verification token for the user and returns it
+	// so it can be sent to them. Tokens are handed out at most once every few minutes.
+	StartVerification(user *User) (string, error)
+
+	// Verify marks the email address of the user the token was issued to as verified
+	Verify(token string) (*User, error)
+
+	// ChangeEmail gives the user a new email address, which has to be verified again
+	ChangeEmail(user *User, email string) error
+
+	// ChangePassword sets a new password for the user once their current one is confirmed
+	ChangePassword(user *User, current, newPw string) error
+
+	// StartTwoFactor makes a new secret for the user's authenticator app and returns it.
+	// Two-factor authentication stays off until EnableTwoFactor gets a code made with it.
+	StartTwoFactor(user *User) (string, error)
+
+	// EnableTwoFactor turns two-factor authentication on when the code matches the secret
+	// made by StartTwoFactor, and returns the recovery codes to show the user once
+	EnableTwoFactor(user *User, code string) ([]string, error)
+
+	// DisableTwoFactor turns two-factor authentication off after checking the user's password
+	DisableTwoFactor(user *User, password string) error
+
+	// StartTwoFactorLogin is called once the password of a user with two-factor authentication
+	// is accepted. It returns the token identifying the login until the second factor is given.
+	StartTwoFactorLogin(user *User) (string, error)
+
+	// TwoFactorLogin looks up the user of a login waiting for its second factor
+	TwoFactorLogin(token string) (*User, error)
+
+	// CompleteTwoFactorLogin checks a code from the authenticator app, or uses up a
+	// recovery code, and ends the login started with StartTwoFactorLogin
+	CompleteTwoFactorLogin(user *User, code string) error
+
+	// ScheduleDeletion checks the user's password and marks their account to be deleted
+	// after a two week grace period
+	ScheduleDeletion(user *User, password string) error
+
+	// CancelDeletion keeps the account of a user who changed their mind
+	CancelDeletion(user *User) error
+
 	UserDB
 }
 
 type userService struct {
 	UserDB
+	// uv is the UserDB above, kept for checks that have to pass before anything is changed
+	uv             *userValidator
+	pwResetDB      pwResetDB
+	recoveryCodeDB recoveryCodeDB
+	pepper         string
 }
 
 type userGorm struct {
@@ -101,41 +220,38 @@ type userGorm struct {
 type userValidator struct {
 	UserDB
 	hmac       hash.HMAC
+	pepper     string
 	emailRegex *regexp.Regexp
 }
 
 type userValFn func(*User) error
 
-func newUserGorm(connectionInfo string) (*userGorm, error) {
-	db, err := gorm.Open("postgres", connectionInfo)
-	if err != nil {
-		return nil, err
-	}
-	db.LogMode(true)
-	return &userGorm{
-		db: db,
-	}, nil
-}
-
-func newUserValidator(udb UserDB, hmac hash.HMAC) *userValidator {
+func newUserValidator(udb UserDB, hmac hash.HMAC, pepper string) *userValidator {
 	return &userValidator{
 		UserDB:     udb,
 		hmac:       hmac,
+		pepper:     pepper,
 		emailRegex: regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
 	}
 }
 
-// NewUserService is an abstraction layer providing us a connection with the db
-func NewUserService(connectionInfo string) (UserService, error) {
-	ug, err := newUserGorm(connectionInfo)
-	if err != nil {
-		return nil, err
-	}
-	hmac := hash.NewHMAC(hmacSecretKey)
-	uv := newUserValidator(ug, hmac)
+// NewUserService is an abstraction layer providing us access to the users table through db.
+// The pepper is added to passwords before hashing them and hmacKey is used to hash tokens.
+func NewUserService(db *gorm.DB, pepper, hmacKey string) UserService {
+	return newUserService(&userGorm{db: db}, &pwResetGorm{db: db}, &recoveryCodeGorm{db: db}, pepper, hmacKey)
+}
+
+// newUserService puts the validation layers on top of the given storage of users, password resets and recovery codes
+func newUserService(udb UserDB, pwrdb pwResetDB, rcdb recoveryCodeDB, pepper, hmacKey string) *userService {
+	hmac := hash.NewHMAC(hmacKey)
+	uv := newUserValidator(udb, hmac, pepper)
 	return &userService{
-		UserDB: uv,
-	}, nil
+		UserDB:         uv,
+		uv:             uv,
+		pwResetDB:      newPwResetValidator(pwrdb, hmac),
+		recoveryCodeDB: newRecoveryCodeValidator(rcdb, hmac),
+		pepper:         pepper,
+	}
 }
 
 // Authenticate is used to vet users
@@ -144,16 +260,309 @@ func (us *userService) Authenticate(email, password string) (*User, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := us.checkPassword(foundUser, password); err != nil {
+		return nil, err
+	}
+	return foundUser, nil
+}
 
-	err = bcrypt.CompareHashAndPassword([]byte(foundUser.PasswordHash), []byte(password+userPwPepper))
+// checkPassword returns ErrPasswordIncorrect unless password is the user's password
+func (us *userService) checkPassword(user *User, password string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password+us.pepper))
 	switch err {
 	case nil:
-		return foundUser, nil
+		return nil
 	case bcrypt.ErrMismatchedHashAndPassword:
-		return nil, ErrPasswordIncorrect
+		return ErrPasswordIncorrect
 	default:
+		return err
+	}
+}
+
+// InitiateReset creates a password reset for the user with the given email address
+func (us *userService) InitiateReset(email string) (string, error) {
+	user, err := us.ByEmail(email)
+	if err != nil {
+		return "", err
+	}
+	// links are only sent to addresses we know belong to the account
+	if !user.EmailVerified {
+		return "", ErrEmailNotVerified
+	}
+	pwr := pwReset{
+		UserID: user.ID,
+	}
+	if err := us.pwResetDB.Create(&pwr); err != nil {
+		return "", err
+	}
+	return pwr.Token, nil
+}
+
+// CompleteReset updates the password of the user the token belongs to. A rejected password can
+// be retried with the same link, but once it is accepted the token is used up before the
+// password is written, so only one of several requests racing with the same link gets through.
+func (us *userService) CompleteReset(token, newPw string) (*User, error) {
+	pwr, err := us.pwResetDB.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+	if pwr.expired() {
+		return nil, ErrTokenInvalid
+	}
+	user, err := us.ByID(pwr.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if err := us.checkNewPassword(newPw); err != nil {
+		return nil, err
+	}
+	// Delete fails with ErrTokenInvalid when another request used the token first
+	if err := us.pwResetDB.Delete(pwr.ID); err != nil {
+		return nil, err
+	}
+	user.Password = newPw
+	if err := us.Update(user); err != nil {
 		return nil, err
 	}
+	if err := us.pwResetDB.DeleteByUserID(user.ID); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// StartVerification creates a verification token for the user unless one was sent very recently
+func (us *userService) StartVerification(user *User) (string, error) {
+	if user.EmailVerified {
+		return "", ErrEmailAlreadyVerified
+	}
+	if user.VerifySentAt != nil && time.Since(*user.VerifySentAt) < verifyResendInterval {
+		return "", ErrVerifyThrottled
+	}
+	token, err := rand.String(rand.RememberTokenBytes)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	user.VerifyToken = token
+	user.VerifySentAt = &now
+	if err := us.Update(user); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Verify looks up the user a verification token was sent to and marks their email as verified.
+// Only the most recently sent link works, and it cannot be used twice.
+func (us *userService) Verify(token string) (*User, error) {
+	user, err := us.ByVerifyToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+	if user.VerifySentAt == nil || time.Since(*user.VerifySentAt) > verifyTokenDuration {
+		return nil, ErrTokenInvalid
+	}
+	user.EmailVerified = true
+	user.VerifyTokenHash = ""
+	if err := us.Update(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// ChangeEmail leaves the user alone when the address did not change. A new address is
+// unverified until its owner follows the link from StartVerification, which is not throttled
+// by links sent to the old address.
+func (us *userService) ChangeEmail(user *User, email string) error {
+	if strings.EqualFold(strings.TrimSpace(email), user.Email) {
+		return nil
+	}
+	user.Email = email
+	user.EmailVerified = false
+	user.VerifyTokenHash = ""
+	user.VerifySentAt = nil
+	return us.Update(user)
+}
+
+// ChangePassword goes through the same validation as any other password update
+func (us *userService) ChangePassword(user *User, current, newPw string) error {
+	if _, err := us.Authenticate(user.Email, current); err != nil {
+		return err
+	}
+	if err := us.checkNewPassword(newPw); err != nil {
+		return err
+	}
+	user.Password = newPw
+	return us.Update(user)
+}
+
+// checkNewPassword validates a password the user is setting. Update can't require one since
+// it takes an empty password to mean the current one is kept.
+func (us *userService) checkNewPassword(newPw string) error {
+	return runUserFieldChecks(&User{Password: newPw},
+		userFieldChecks{"password", []userValFn{
+			us.uv.passwordRequired,
+			us.uv.passwordMinLength}})
+}
+
+// StartTwoFactor replaces any secret left over from an earlier attempt that was never confirmed
+func (us *userService) StartTwoFactor(user *User) (string, error) {
+	if user.TwoFactorEnabled {
+		return "", ErrTwoFactorEnabled
+	}
+	secret, err := rand.TOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	user.TOTPSecret = secret
+	user.TOTPLastStep = 0
+	if err := us.Update(user); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// EnableTwoFactor also replaces any recovery codes the user had before. The codes are made
+// first, so two-factor authentication is never on without a way back into the account.
+func (us *userService) EnableTwoFactor(user *User, code string) ([]string, error) {
+	if user.TwoFactorEnabled {
+		return nil, ErrTwoFactorEnabled
+	}
+	if user.TOTPSecret == "" {
+		return nil, ErrTwoFactorNotStarted
+	}
+	step, err := totp.Validate(user.TOTPSecret, code, time.Now())
+	if err != nil {
+		return nil, ErrTwoFactorCodeInvalid
+	}
+	codes, err := us.newRecoveryCodes(user)
+	if err != nil {
+		return nil, err
+	}
+	user.TwoFactorEnabled = true
+	user.TOTPLastStep = step
+	if err := us.Update(user); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// newRecoveryCodes replaces the recovery codes of the user with a new set and returns them
+func (us *userService) newRecoveryCodes(user *User) ([]string, error) {
+	if err := us.recoveryCodeDB.DeleteByUserID(user.ID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		if err := us.recoveryCodeDB.Create(&recoveryCode{UserID: user.ID, Code: code}); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// DisableTwoFactor forgets the secret and the recovery codes, so turning it on again starts from scratch
+func (us *userService) DisableTwoFactor(user *User, password string) error {
+	if err := us.checkPassword(user, password); err != nil {
+		return err
+	}
+	user.TwoFactorEnabled = false
+	user.TOTPSecret = ""
+	user.TOTPLastStep = 0
+	user.LoginTokenHash = ""
+	user.LoginStartedAt = nil
+	if err := us.Update(user); err != nil {
+		return err
+	}
+	return us.recoveryCodeDB.DeleteByUserID(user.ID)
+}
+
+// StartTwoFactorLogin issues a new login token, any earlier one stops working
+func (us *userService) StartTwoFactorLogin(user *User) (string, error) {
+	token, err := rand.String(rand.RememberTokenBytes)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	user.LoginToken = token
+	user.LoginStartedAt = &now
+	if err := us.Update(user); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// TwoFactorLogin returns ErrTokenInvalid for unknown and expired login tokens
+func (us *userService) TwoFactorLogin(token string) (*User, error) {
+	user, err := us.ByLoginToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+	if !user.TwoFactorEnabled || user.LoginStartedAt == nil || time.Since(*user.LoginStartedAt) > twoFactorLoginDuration {
+		return nil, ErrTokenInvalid
+	}
+	return user, nil
+}
+
+// CompleteTwoFactorLogin refuses codes from the authenticator app that were already used
+func (us *userService) CompleteTwoFactorLogin(user *User, code string) error {
+	step, err := totp.Validate(user.TOTPSecret, code, time.Now())
+	switch {
+	case err == nil:
+		if err := us.UseTOTPStep(user.ID, step); err != nil {
+			return err
+		}
+		user.TOTPLastStep = step
+	default:
+		rc, err := us.recoveryCodeDB.ByCode(user.ID, code)
+		if err == ErrNotFound {
+			return ErrTwoFactorCodeInvalid
+		}
+		if err != nil {
+			return err
+		}
+		if err := us.recoveryCodeDB.Delete(rc.ID); err != nil {
+			return err
+		}
+	}
+	user.LoginTokenHash = ""
+	user.LoginStartedAt = nil
+	return us.Update(user)
+}
+
+// ScheduleDeletion leaves the account working until it is purged, so logging in can still cancel it
+func (us *userService) ScheduleDeletion(user *User, password string) error {
+	if user.DeletionScheduled() {
+		return ErrDeletionScheduled
+	}
+	if err := us.checkPassword(user, password); err != nil {
+		return err
+	}
+	due := time.Now().Add(accountDeletionGrace)
+	user.DeletionDueAt = &due
+	return us.Update(user)
+}
+
+// CancelDeletion does nothing for users whose account is not scheduled for deletion
+func (us *userService) CancelDeletion(user *User) error {
+	if !user.DeletionScheduled() {
+		return nil
+	}
+	user.DeletionDueAt = nil
+	return us.Update(user)
 }
 
 /*
@@ -175,14 +584,6 @@ func (ug *userGorm) ByID(id uint) (*User, error) {
 	return &user, nil
 }
 
-// DestructiveReset drops the user table and rebuilds it
-func (ug *userGorm) DestructiveReset() error {
-	if err := ug.db.DropTableIfExists(&User{}).Error; err != nil {
-		return err
-	}
-	return ug.AutoMigrate()
-}
-
 // Close is a function that is used to close the connection with the db
 func (ug *userGorm) Close() error {
 	return ug.db.Close()
@@ -193,12 +594,13 @@ func (ug *userGorm) Create(user *User) error {
 	return ug.db.Create(user).Error
 }
 
+// first loads the first record matching db into dst, ErrNotFound is returned when there is none
 func first(db *gorm.DB, dst interface{}) error {
 	err := db.First(dst).Error
 	if err == gorm.ErrRecordNotFound {
 		return ErrNotFound
 	}
-	return nil
+	return err
 }
 
 // ByEmail is used to search a user by email from the db
@@ -217,30 +619,54 @@ func (ug *userGorm) Update(user *User) error {
 	return ug.db.Save(user).Error
 }
 
+// UseTOTPStep is used to move the last used time step of a user forward
+func (ug *userGorm) UseTOTPStep(id uint, step int64) error {
+	db := ug.db.Model(&User{}).Where("id = ? AND totp_last_step < ?", id, step).UpdateColumn("totp_last_step", step)
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrTwoFactorCodeInvalid
+	}
+	return nil
+}
+
 // Delete is used to delete a user from the db
 func (ug *userGorm) Delete(id uint) error {
 	user := User{Model: gorm.Model{ID: id}}
 	return ug.db.Delete(&user).Error
 }
 
-// AutoMigrate is used to automatically migrate the relations in the db
-func (ug *userGorm) AutoMigrate() error {
-	if err := ug.db.AutoMigrate(&User{}).Error; err != nil {
-		return err
+// ByVerifyToken is used to search a user by the hash of their email verification token
+func (ug *userGorm) ByVerifyToken(tokenHash string) (*User, error) {
+	var user User
+	err := first(ug.db.Where("verify_token_hash = ?", tokenHash), &user)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return &user, nil
 }
 
-// ByRemember is used to search a user by remember token from the db
-func (ug *userGorm) ByRemember(rememberHash string) (*User, error) {
+// ByLoginToken is used to search a user by the hash of the token of a login waiting for its second factor
+func (ug *userGorm) ByLoginToken(tokenHash string) (*User, error) {
 	var user User
-	err := first(ug.db.Where("remember_hash = ?", rememberHash), &user)
+	err := first(ug.db.Where("login_token_hash = ?", tokenHash), &user)
 	if err != nil {
 		return nil, err
 	}
 	return &user, nil
 }
 
+// DueForDeletion is used to find the accounts to purge
+func (ug *userGorm) DueForDeletion(t time.Time) ([]User, error) {
+	var users []User
+	err := ug.db.Where("deletion_due_at <= ?", t).Order("id").Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
 /*
 	***********************************************
 	***********************************************
@@ -249,32 +675,54 @@ func (ug *userGorm) ByRemember(rememberHash string) (*User, error) {
 	***********************************************
 */
 
-// Validation code for ByRemember
-func (uv *userValidator) ByRemember(token string) (*User, error) {
+// Validation code for ByVerifyToken
+func (uv *userValidator) ByVerifyToken(token string) (*User, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
 	user := User{
-		Remember: token,
+		VerifyToken: token,
 	}
-	if err := runUserValFns(&user, uv.hmacRemember); err != nil {
+	if err := runUserValFns(&user, uv.hmacVerifyToken); err != nil {
 		return nil, err
 	}
-	return uv.UserDB.ByRemember(user.RememberHash)
+	return uv.UserDB.ByVerifyToken(user.VerifyTokenHash)
+}
+
+// Validation code for ByLoginToken
+func (uv *userValidator) ByLoginToken(token string) (*User, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	user := User{
+		LoginToken: token,
+	}
+	if err := runUserValFns(&user, uv.hmacLoginToken); err != nil {
+		return nil, err
+	}
+	return uv.UserDB.ByLoginToken(user.LoginTokenHash)
 }
 
 // Validation code for Create
 func (uv *userValidator) Create(user *User) error {
-	err := runUserValFns(user,
-		uv.passwordRequired,
-		uv.passwordMinLength,
+	err := runUserFieldChecks(user,
+		userFieldChecks{"name", []userValFn{
+			uv.normalizeName,
+			uv.nameMaxLength}},
+		userFieldChecks{"email", []userValFn{
+			uv.requireEmail,
+			uv.normalizeEmail,
+			uv.emailFormat,
+			uv.emailIsAvail}},
+		userFieldChecks{"password", []userValFn{
+			uv.passwordRequired,
+			uv.passwordMinLength}})
+	if err != nil {
+		return err
+	}
+	err = runUserValFns(user,
 		uv.bcryptPassword,
-		uv.passwordHashRequired,
-		uv.setRememberIfUnset,
-		uv.rememberMinBytes,
-		uv.hmacRemember,
-		uv.rememberHashRequired,
-		uv.requireEmail,
-		uv.normalizeEmail,
-		uv.emailFormat,
-		uv.emailIsAvail)
+		uv.passwordHashRequired)
 	if err != nil {
 		return err
 	}
@@ -283,17 +731,25 @@ func (uv *userValidator) Create(user *User) error {
 
 // Validation code for Update
 func (uv *userValidator) Update(user *User) error {
-	err := runUserValFns(user,
-		uv.passwordMinLength,
+	err := runUserFieldChecks(user,
+		userFieldChecks{"name", []userValFn{
+			uv.normalizeName,
+			uv.nameMaxLength}},
+		userFieldChecks{"email", []userValFn{
+			uv.requireEmail,
+			uv.normalizeEmail,
+			uv.emailFormat,
+			uv.emailIsAvail}},
+		userFieldChecks{"password", []userValFn{
+			uv.passwordMinLength}})
+	if err != nil {
+		return err
+	}
+	err = runUserValFns(user,
 		uv.bcryptPassword,
 		uv.passwordHashRequired,
-		uv.rememberMinBytes,
-		uv.hmacRemember,
-		uv.rememberHashRequired,
-		uv.requireEmail,
-		uv.normalizeEmail,
-		uv.emailFormat,
-		uv.emailIsAvail)
+		uv.hmacVerifyToken,
+		uv.hmacLoginToken)
 	if err != nil {
 		return err
 	}
@@ -322,6 +778,19 @@ func (uv *userValidator) ByEmail(email string) (*User, error) {
 	return uv.UserDB.ByEmail(user.Email)
 }
 
+// Normalization code for names
+func (uv *userValidator) normalizeName(user *User) error {
+	user.Name = strings.TrimSpace(user.Name)
+	return nil
+}
+
+func (uv *userValidator) nameMaxLength(user *User) error {
+	if utf8.RuneCountInString(user.Name) > nameMaxLength {
+		return ErrNameTooLong
+	}
+	return nil
+}
+
 // Normalization code for emails
 func (uv *userValidator) normalizeEmail(user *User) error {
 	user.Email = strings.ToLower(user.Email)
@@ -384,27 +853,6 @@ func (uv *userValidator) passwordHashRequired(user *User) error {
 	return nil
 }
 
-func (uv *userValidator) rememberHashRequired(user *User) error {
-	if user.RememberHash == "" {
-		return ErrRememberRequired
-	}
-	return nil
-}
-
-func (uv *userValidator) rememberMinBytes(user *User) error {
-	if user.Remember == "" {
-		return nil
-	}
-	n, err := rand.NBytes(user.Remember)
-	if err != nil {
-		return err
-	}
-	if n < 32 {
-		return ErrRememberTooShort
-	}
-	return nil
-}
-
 /*
 	******************************
 	******************************
@@ -417,7 +865,7 @@ func (uv *userValidator) bcryptPassword(user *User) error {
 	if user.Password == "" { // to check whether the password has been updated
 		return nil
 	}
-	pwBytes := []byte(user.Password + userPwPepper)
+	pwBytes := []byte(user.Password + uv.pepper)
 	hashedBytes, err := bcrypt.GenerateFromPassword(pwBytes, bcrypt.DefaultCost)
 	if err != nil {
 		return err
@@ -427,23 +875,19 @@ func (uv *userValidator) bcryptPassword(user *User) error {
 	return nil
 }
 
-func (uv *userValidator) hmacRemember(user *User) error {
-	if user.Remember == "" {
+func (uv *userValidator) hmacVerifyToken(user *User) error {
+	if user.VerifyToken == "" {
 		return nil
 	}
-	user.RememberHash = uv.hmac.Hash(user.Remember)
+	user.VerifyTokenHash = uv.hmac.Hash(user.VerifyToken)
 	return nil
 }
 
-func (uv *userValidator) setRememberIfUnset(user *User) error {
-	if user.Remember != "" {
+func (uv *userValidator) hmacLoginToken(user *User) error {
+	if user.LoginToken == "" {
 		return nil
 	}
-	token, err := rand.RememberToken()
-	if err != nil {
-		return err
-	}
-	user.Remember = token
+	user.LoginTokenHash = uv.hmac.Hash(user.LoginToken)
 	return nil
 }
 
@@ -465,6 +909,34 @@ func runUserValFns(user *User, fns ...userValFn) error {
 	return nil
 }
 
+// userFieldChecks are the validation functions of one field of a user. They run in order
+// and stop at the first problem, since later ones rely on the earlier ones passing.
+type userFieldChecks struct {
+	field string
+	fns   []userValFn
+}
+
+// runUserFieldChecks runs the checks of every field and returns a *ValidationError with
+// the problem of each field that failed. Errors that are not about the values, like a
+// failing database, are returned as they are straight away.
+func runUserFieldChecks(user *User, fields ...userFieldChecks) error {
+	verr := ValidationError{Fields: make(map[string]error)}
+	for _, f := range fields {
+		err := runUserValFns(user, f.fns...)
+		if err == nil {
+			continue
+		}
+		if _, ok := err.(invalidError); !ok {
+			return err
+		}
+		verr.Fields[f.field] = err
+	}
+	if len(verr.Fields) > 0 {
+		return &verr
+	}
+	return nil
+}
+
 // simple statements to check whether the interface is implemented properly
 // will give error in compile time, if not implemented properly
 var _ UserDB = &userGorm{}
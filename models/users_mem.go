@@ -0,0 +1,318 @@
+package models
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// errUniqueViolation is what the in-memory tables return where the database would refuse a duplicate in a unique index
+var errUniqueViolation = errors.New("models: duplicate key value violates unique constraint")
+
+// NewMemUserService returns a UserService that keeps users, password resets and recovery codes in memory
+// instead of the database, for tests and demos. Nothing it stores outlives the process.
+func NewMemUserService(pepper, hmacKey string) UserService {
+	return newUserService(newUserMem(), &pwResetMem{}, &recoveryCodeMem{}, pepper, hmacKey)
+}
+
+// userMem is a UserDB kept in memory that behaves like userGorm: lookups of missing users
+// return ErrNotFound, deletes are soft, and email is unique across
+// every row including deleted ones, just like the unique indexes in postgres.
+type userMem struct {
+	mu     sync.Mutex
+	nextID uint
+	users  []User
+}
+
+func newUserMem() *userMem {
+	return &userMem{
+		nextID: 1,
+	}
+}
+
+// find returns a copy of the live user with the lowest id that matches, like gorm's First
+func (um *userMem) find(match func(*User) bool) (*User, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	for i := range um.users {
+		u := um.users[i]
+		if u.DeletedAt == nil && match(&u) {
+			return &u, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// index returns the position of the row with the given id, deleted or not, or -1
+func (um *userMem) index(id uint) int {
+	for i := range um.users {
+		if um.users[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// unique checks the unique indexes of the users table for every row but the one with the given id
+func (um *userMem) unique(user *User) error {
+	for i := range um.users {
+		u := &um.users[i]
+		if u.ID == user.ID {
+			continue
+		}
+		if u.Email == user.Email {
+			return errUniqueViolation
+		}
+	}
+	return nil
+}
+
+// ByID is used to search a user by ID
+func (um *userMem) ByID(id uint) (*User, error) {
+	return um.find(func(u *User) bool { return u.ID == id })
+}
+
+// ByEmail is used to search a user by email
+func (um *userMem) ByEmail(email string) (*User, error) {
+	return um.find(func(u *User) bool { return u.Email == email })
+}
+
+// ByVerifyToken is used to search a user by the hash of their email verification token
+func (um *userMem) ByVerifyToken(tokenHash string) (*User, error) {
+	return um.find(func(u *User) bool { return u.VerifyTokenHash == tokenHash })
+}
+
+// ByLoginToken is used to search a user by the hash of the token of a login waiting for its second factor
+func (um *userMem) ByLoginToken(tokenHash string) (*User, error) {
+	return um.find(func(u *User) bool { return u.LoginTokenHash == tokenHash })
+}
+
+// DueForDeletion is used to find the accounts to purge, in the order of their ids
+func (um *userMem) DueForDeletion(t time.Time) ([]User, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	var users []User
+	for _, u := range um.users {
+		if u.DeletedAt == nil && u.DeletionDueAt != nil && !u.DeletionDueAt.After(t) {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+// Create is used to add a new user, it fills in the id and timestamps like the database does
+func (um *userMem) Create(user *User) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	return um.create(user)
+}
+
+func (um *userMem) create(user *User) error {
+	if user.ID != 0 && um.index(user.ID) >= 0 {
+		return errUniqueViolation
+	}
+	if err := um.unique(user); err != nil {
+		return err
+	}
+	if user.ID == 0 {
+		user.ID = um.nextID
+	}
+	if user.ID >= um.nextID {
+		um.nextID = user.ID + 1
+	}
+	now := time.Now()
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = now
+	}
+	user.UpdatedAt = now
+	um.users = append(um.users, stored(user))
+	return nil
+}
+
+// stored returns the row the database would keep for a user, without the fields that are
+// never saved. Keeping them would let a token come back from a lookup and be saved again.
+func stored(user *User) User {
+	u := *user
+	u.Password = ""
+	u.VerifyToken = ""
+	u.LoginToken = ""
+	return u
+}
+
+// Update saves every field of the user, creating it when it does not exist yet like gorm's Save
+func (um *userMem) Update(user *User) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	i := um.index(user.ID)
+	if user.ID == 0 || i < 0 {
+		return um.create(user)
+	}
+	if um.users[i].DeletedAt != nil {
+		// the update matches no live row and re-creating it collides with the deleted one
+		return errUniqueViolation
+	}
+	if err := um.unique(user); err != nil {
+		return err
+	}
+	user.UpdatedAt = time.Now()
+	um.users[i] = stored(user)
+	return nil
+}
+
+// Delete marks the user as deleted, deleting a missing user is not an error
+func (um *userMem) Delete(id uint) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	if i := um.index(id); i >= 0 && um.users[i].DeletedAt == nil {
+		now := time.Now()
+		um.users[i].DeletedAt = &now
+	}
+	return nil
+}
+
+// UseTOTPStep is used to move the last used time step of a user forward
+func (um *userMem) UseTOTPStep(id uint, step int64) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	i := um.index(id)
+	if i < 0 || um.users[i].DeletedAt != nil || um.users[i].TOTPLastStep >= step {
+		return ErrTwoFactorCodeInvalid
+	}
+	um.users[i].TOTPLastStep = step
+	return nil
+}
+
+// Close does nothing, there is no connection to close
+func (um *userMem) Close() error {
+	return nil
+}
+
+// pwResetMem is a pwResetDB kept in memory that behaves like pwResetGorm
+type pwResetMem struct {
+	mu     sync.Mutex
+	nextID uint
+	resets []pwReset
+}
+
+// ByToken is used to look up a password reset by the hash of its token
+func (pwrm *pwResetMem) ByToken(tokenHash string) (*pwReset, error) {
+	pwrm.mu.Lock()
+	defer pwrm.mu.Unlock()
+	for _, pwr := range pwrm.resets {
+		if pwr.TokenHash == tokenHash {
+			return &pwr, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Create is used to add a new password reset
+func (pwrm *pwResetMem) Create(pwr *pwReset) error {
+	pwrm.mu.Lock()
+	defer pwrm.mu.Unlock()
+	for _, existing := range pwrm.resets {
+		if existing.TokenHash == pwr.TokenHash {
+			return errUniqueViolation
+		}
+	}
+	pwrm.nextID++
+	pwr.ID = pwrm.nextID
+	pwr.CreatedAt = time.Now()
+	pwrm.resets = append(pwrm.resets, *pwr)
+	return nil
+}
+
+// Delete removes a password reset, returning ErrTokenInvalid if it was already removed
+func (pwrm *pwResetMem) Delete(id uint) error {
+	pwrm.mu.Lock()
+	defer pwrm.mu.Unlock()
+	for i, pwr := range pwrm.resets {
+		if pwr.ID == id {
+			pwrm.resets = append(pwrm.resets[:i], pwrm.resets[i+1:]...)
+			return nil
+		}
+	}
+	return ErrTokenInvalid
+}
+
+// DeleteByUserID removes every outstanding password reset of a user
+func (pwrm *pwResetMem) DeleteByUserID(userID uint) error {
+	pwrm.mu.Lock()
+	defer pwrm.mu.Unlock()
+	kept := pwrm.resets[:0]
+	for _, pwr := range pwrm.resets {
+		if pwr.UserID != userID {
+			kept = append(kept, pwr)
+		}
+	}
+	pwrm.resets = kept
+	return nil
+}
+
+// recoveryCodeMem is a recoveryCodeDB kept in memory that behaves like recoveryCodeGorm
+type recoveryCodeMem struct {
+	mu     sync.Mutex
+	nextID uint
+	codes  []recoveryCode
+}
+
+// ByCode is used to look up an unused recovery code of a user by its hash
+func (rcm *recoveryCodeMem) ByCode(userID uint, codeHash string) (*recoveryCode, error) {
+	rcm.mu.Lock()
+	defer rcm.mu.Unlock()
+	for _, rc := range rcm.codes {
+		if rc.UserID == userID && rc.CodeHash == codeHash {
+			return &rc, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Create is used to add a new recovery code
+func (rcm *recoveryCodeMem) Create(rc *recoveryCode) error {
+	rcm.mu.Lock()
+	defer rcm.mu.Unlock()
+	for _, existing := range rcm.codes {
+		if existing.CodeHash == rc.CodeHash {
+			return errUniqueViolation
+		}
+	}
+	rcm.nextID++
+	rc.ID = rcm.nextID
+	rc.CreatedAt = time.Now()
+	rcm.codes = append(rcm.codes, *rc)
+	return nil
+}
+
+// Delete removes a recovery code, returning ErrTwoFactorCodeInvalid if it was already removed
+func (rcm *recoveryCodeMem) Delete(id uint) error {
+	rcm.mu.Lock()
+	defer rcm.mu.Unlock()
+	for i, rc := range rcm.codes {
+		if rc.ID == id {
+			rcm.codes = append(rcm.codes[:i], rcm.codes[i+1:]...)
+			return nil
+		}
+	}
+	return ErrTwoFactorCodeInvalid
+}
+
+// DeleteByUserID removes every recovery code of a user
+func (rcm *recoveryCodeMem) DeleteByUserID(userID uint) error {
+	rcm.mu.Lock()
+	defer rcm.mu.Unlock()
+	kept := rcm.codes[:0]
+	for _, rc := range rcm.codes {
+		if rc.UserID != userID {
+			kept = append(kept, rc)
+		}
+	}
+	rcm.codes = kept
+	return nil
+}
+
+var _ UserDB = &userMem{}
+var _ pwResetDB = &pwResetMem{}
+var _ recoveryCodeDB = &recoveryCodeMem{}
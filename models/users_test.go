@@ -0,0 +1,455 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"gophr.com/totp"
+)
+
+const testPassword = "correct horse battery"
+
+// createVerifiedUser adds a user whose email address is verified
+func createVerifiedUser(t *testing.T, us UserService, email string) *User {
+	t.Helper()
+	user := User{
+		Name:          "Gopher",
+		Email:         email,
+		Password:      testPassword,
+		EmailVerified: true,
+	}
+	if err := us.Create(&user); err != nil {
+		t.Fatal(err)
+	}
+	return &user
+}
+
+// failingRecoveryCodes is a recoveryCodeDB that can't store new codes
+type failingRecoveryCodes struct {
+	recoveryCodeDB
+}
+
+func (failingRecoveryCodes) Create(rc *recoveryCode) error {
+	return errors.New("models: the disk is full")
+}
+
+// currentCode returns the code the authenticator app of a user shows right now
+func currentCode(t *testing.T, user *User) string {
+	t.Helper()
+	code, err := totp.Code(user.TOTPSecret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+// enableTwoFactor turns two-factor authentication on for a user and returns their recovery codes
+func enableTwoFactor(t *testing.T, us *userService, user *User) []string {
+	t.Helper()
+	if _, err := us.StartTwoFactor(user); err != nil {
+		t.Fatal(err)
+	}
+	codes, err := us.EnableTwoFactor(user, currentCode(t, user))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return codes
+}
+
+func TestEnableTwoFactor(t *testing.T) {
+	for name, backend := range testBackends(t) {
+		us := backend.User.(*userService)
+		t.Run(name, func(t *testing.T) {
+			user := createVerifiedUser(t, us, "jon@example.com")
+			if _, err := us.EnableTwoFactor(user, "123456"); err != ErrTwoFactorNotStarted {
+				t.Errorf("EnableTwoFactor() before StartTwoFactor() = %v, want %v", err, ErrTwoFactorNotStarted)
+			}
+			if _, err := us.StartTwoFactor(user); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := us.EnableTwoFactor(user, "not a code"); err != ErrTwoFactorCodeInvalid {
+				t.Errorf("EnableTwoFactor() with a wrong code = %v, want %v", err, ErrTwoFactorCodeInvalid)
+			}
+
+			codes, err := us.EnableTwoFactor(user, currentCode(t, user))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(codes) != recoveryCodeCount {
+				t.Errorf("EnableTwoFactor() returned %d recovery codes, want %d", len(codes), recoveryCodeCount)
+			}
+			seen := map[string]bool{}
+			for _, code := range codes {
+				if seen[code] {
+					t.Errorf("recovery code %q returned twice", code)
+				}
+				seen[code] = true
+			}
+			stored, err := us.ByID(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !stored.TwoFactorEnabled || stored.TOTPLastStep == 0 {
+				t.Errorf("stored TwoFactorEnabled = %v, TOTPLastStep = %d, want it on with the step used", stored.TwoFactorEnabled, stored.TOTPLastStep)
+			}
+			if _, err := us.StartTwoFactor(user); err != ErrTwoFactorEnabled {
+				t.Errorf("StartTwoFactor() while on = %v, want %v", err, ErrTwoFactorEnabled)
+			}
+			if _, err := us.EnableTwoFactor(user, currentCode(t, user)); err != ErrTwoFactorEnabled {
+				t.Errorf("EnableTwoFactor() while on = %v, want %v", err, ErrTwoFactorEnabled)
+			}
+		})
+	}
+}
+
+func TestEnableTwoFactorWithoutRecoveryCodes(t *testing.T) {
+	for name, backend := range testBackends(t) {
+		us := backend.User.(*userService)
+		t.Run(name, func(t *testing.T) {
+			user := createVerifiedUser(t, us, "jon@example.com")
+			if _, err := us.StartTwoFactor(user); err != nil {
+				t.Fatal(err)
+			}
+			us.recoveryCodeDB = failingRecoveryCodes{us.recoveryCodeDB}
+			if _, err := us.EnableTwoFactor(user, currentCode(t, user)); err == nil {
+				t.Fatal("EnableTwoFactor() succeeded without storing the recovery codes")
+			}
+			stored, err := us.ByID(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.TwoFactorEnabled {
+				t.Error("two-factor authentication was left on without recovery codes")
+			}
+		})
+	}
+}
+
+func TestCompleteTwoFactorLogin(t *testing.T) {
+	for name, backend := range testBackends(t) {
+		us := backend.User.(*userService)
+		t.Run(name, func(t *testing.T) {
+			user := createVerifiedUser(t, us, "jon@example.com")
+			codes := enableTwoFactor(t, us, user)
+
+			// the code that turned two-factor authentication on can't log in as well
+			if err := us.CompleteTwoFactorLogin(user, currentCode(t, user)); err != ErrTwoFactorCodeInvalid {
+				t.Errorf("CompleteTwoFactorLogin() with a used code = %v, want %v", err, ErrTwoFactorCodeInvalid)
+			}
+			// as if the code was used a period ago, so the current one is new
+			user.TOTPLastStep--
+			if err := us.Update(user); err != nil {
+				t.Fatal(err)
+			}
+			// a second login loaded at the same time, racing to use the same code
+			racing, err := us.ByID(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := us.CompleteTwoFactorLogin(user, currentCode(t, user)); err != nil {
+				t.Errorf("CompleteTwoFactorLogin() with a new code = %v, want nil", err)
+			}
+			if err := us.CompleteTwoFactorLogin(racing, currentCode(t, racing)); err != ErrTwoFactorCodeInvalid {
+				t.Errorf("CompleteTwoFactorLogin() racing with the same code = %v, want %v", err, ErrTwoFactorCodeInvalid)
+			}
+			if err := us.CompleteTwoFactorLogin(user, currentCode(t, user)); err != ErrTwoFactorCodeInvalid {
+				t.Errorf("CompleteTwoFactorLogin() replaying a code = %v, want %v", err, ErrTwoFactorCodeInvalid)
+			}
+
+			tests := []struct {
+				name string
+				code string
+				want error
+			}{
+				{"recovery code", codes[0], nil},
+				{"recovery code again", codes[0], ErrTwoFactorCodeInvalid},
+				{"recovery code typed loosely", " " + strings.ToUpper(strings.Replace(codes[1], "-", "", 1)) + " ", nil},
+				{"unknown recovery code", "aaaa-aaaa", ErrTwoFactorCodeInvalid},
+				{"empty", "", ErrTwoFactorCodeInvalid},
+			}
+			for _, tt := range tests {
+				if err := us.CompleteTwoFactorLogin(user, tt.code); err != tt.want {
+					t.Errorf("%s: CompleteTwoFactorLogin() = %v, want %v", tt.name, err, tt.want)
+				}
+			}
+
+			// another user's recovery codes don't work
+			other := createVerifiedUser(t, us, "jane@example.com")
+			enableTwoFactor(t, us, other)
+			if err := us.CompleteTwoFactorLogin(other, codes[2]); err != ErrTwoFactorCodeInvalid {
+				t.Errorf("CompleteTwoFactorLogin() with someone else's code = %v, want %v", err, ErrTwoFactorCodeInvalid)
+			}
+		})
+	}
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	for name, backend := range testBackends(t) {
+		us := backend.User.(*userService)
+		t.Run(name, func(t *testing.T) {
+			user := createVerifiedUser(t, us, "jon@example.com")
+			enableTwoFactor(t, us, user)
+			token, err := us.StartTwoFactorLogin(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := us.TwoFactorLogin(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != user.ID {
+				t.Errorf("TwoFactorLogin() = user %d, want %d", got.ID, user.ID)
+			}
+			if _, err := us.TwoFactorLogin("not-the-token"); err != ErrTokenInvalid {
+				t.Errorf("TwoFactorLogin() with a wrong token = %v, want %v", err, ErrTokenInvalid)
+			}
+
+			// a new login replaces the one waiting
+			if _, err := us.StartTwoFactorLogin(user); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := us.TwoFactorLogin(token); err != ErrTokenInvalid {
+				t.Errorf("TwoFactorLogin() with a replaced token = %v, want %v", err, ErrTokenInvalid)
+			}
+
+			token, err = us.StartTwoFactorLogin(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			started := time.Now().Add(-twoFactorLoginDuration - time.Second)
+			user.LoginStartedAt = &started
+			if err := us.Update(user); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := us.TwoFactorLogin(token); err != ErrTokenInvalid {
+				t.Errorf("TwoFactorLogin() after it expired = %v, want %v", err, ErrTokenInvalid)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	for name, backend := range testBackends(t) {
+		us := backend.User.(*userService)
+		t.Run(name, func(t *testing.T) {
+			user := User{Name: "Jon", Email: "jon@example.com", Password: testPassword}
+			if err := us.Create(&user); err != nil {
+				t.Fatal(err)
+			}
+			token, err := us.StartVerification(&user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := us.StartVerification(&user); err != ErrVerifyThrottled {
+				t.Errorf("StartVerification() right after another = %v, want %v", err, ErrVerifyThrottled)
+			}
+			if _, err := us.Verify("not-the-token"); err != ErrTokenInvalid {
+				t.Errorf("Verify() with a wrong token = %v, want %v", err, ErrTokenInvalid)
+			}
+			verified, err := us.Verify(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if verified.ID != user.ID || !verified.EmailVerified {
+				t.Errorf("Verify() = user %d verified %v, want user %d verified", verified.ID, verified.EmailVerified, user.ID)
+			}
+			if _, err := us.Verify(token); err != ErrTokenInvalid {
+				t.Errorf("Verify() twice = %v, want %v", err, ErrTokenInvalid)
+			}
+			if _, err := us.StartVerification(verified); err != ErrEmailAlreadyVerified {
+				t.Errorf("StartVerification() once verified = %v, want %v", err, ErrEmailAlreadyVerified)
+			}
+		})
+	}
+}
+
+func TestVerifyLinks(t *testing.T) {
+	tests := []struct {
+		name string
+		// sentAgo is how long ago the link that is followed was sent
+		sentAgo time.Duration
+		// resent sends another link after the one that is followed
+		resent  bool
+		wantErr error
+	}{
+		{name: "fresh", wantErr: nil},
+		{name: "about to expire", sentAgo: verifyTokenDuration - time.Minute, wantErr: nil},
+		{name: "expired", sentAgo: verifyTokenDuration + time.Minute, wantErr: ErrTokenInvalid},
+		{name: "replaced by a newer link", sentAgo: verifyResendInterval + time.Minute, resent: true, wantErr: ErrTokenInvalid},
+	}
+	for _, tt := range tests {
+		for name, backend := range testBackends(t) {
+			us := backend.User.(*userService)
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				user := User{Name: "Jon", Email: "jon@example.com", Password: testPassword}
+				if err := us.Create(&user); err != nil {
+					t.Fatal(err)
+				}
+				token, err := us.StartVerification(&user)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sentAt := time.Now().Add(-tt.sentAgo)
+				user.VerifySentAt = &sentAt
+				if err := us.Update(&user); err != nil {
+					t.Fatal(err)
+				}
+				if tt.resent {
+					if _, err := us.StartVerification(&user); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if _, err := us.Verify(token); err != tt.wantErr {
+					t.Errorf("Verify() = %v, want %v", err, tt.wantErr)
+				}
+			})
+		}
+	}
+}
+
+// fieldError returns the problem a *ValidationError has with a field, or err itself for any other error
+func fieldError(err error, field string) error {
+	if ve, ok := err.(*ValidationError); ok {
+		return ve.Field(field)
+	}
+	return err
+}
+
+func TestChangeEmail(t *testing.T) {
+	tests := []struct {
+		name         string
+		email        string
+		wantErr      error
+		wantEmail    string
+		wantVerified bool
+	}{
+		{name: "same address", email: " Jon@Example.com ", wantEmail: "jon@example.com", wantVerified: true},
+		{name: "new address", email: " Jonathan@Example.com", wantEmail: "jonathan@example.com"},
+		{name: "taken", email: "jane@example.com", wantErr: ErrEmailTaken},
+		{name: "not an address", email: "jon", wantErr: ErrEmailInvalid},
+		{name: "empty", email: "", wantErr: ErrEmailRequired},
+	}
+	for _, tt := range tests {
+		for name, backend := range testBackends(t) {
+			us := backend.User.(*userService)
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				user := createVerifiedUser(t, us, "jon@example.com")
+				createVerifiedUser(t, us, "jane@example.com")
+				err := us.ChangeEmail(user, tt.email)
+				if got := fieldError(err, "email"); got != tt.wantErr {
+					t.Fatalf("ChangeEmail() error = %v, want %v", err, tt.wantErr)
+				}
+				stored, err := us.ByID(user.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.wantErr != nil {
+					if stored.Email != "jon@example.com" || !stored.EmailVerified {
+						t.Errorf("a rejected change left %q verified %v", stored.Email, stored.EmailVerified)
+					}
+					return
+				}
+				if stored.Email != tt.wantEmail || stored.EmailVerified != tt.wantVerified {
+					t.Errorf("stored %q verified %v, want %q verified %v", stored.Email, stored.EmailVerified, tt.wantEmail, tt.wantVerified)
+				}
+			})
+		}
+	}
+}
+
+func TestChangeEmailResetsVerification(t *testing.T) {
+	for name, backend := range testBackends(t) {
+		us := backend.User.(*userService)
+		t.Run(name, func(t *testing.T) {
+			user := User{Name: "Jon", Email: "jon@example.com", Password: testPassword}
+			if err := us.Create(&user); err != nil {
+				t.Fatal(err)
+			}
+			oldToken, err := us.StartVerification(&user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := us.ChangeEmail(&user, "jonathan@example.com"); err != nil {
+				t.Fatal(err)
+			}
+			// the link sent to the old address can't verify the new one
+			if _, err := us.Verify(oldToken); err != ErrTokenInvalid {
+				t.Errorf("Verify() with the link sent to the old address = %v, want %v", err, ErrTokenInvalid)
+			}
+			// and the new address gets a link straight away
+			if _, err := us.StartVerification(&user); err != nil {
+				t.Errorf("StartVerification() for the new address = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	const newPassword = "a brand new password"
+	tests := []struct {
+		name      string
+		current   string
+		newPw     string
+		wantErr   error
+		wantLogin string
+	}{
+		{name: "changed", current: testPassword, newPw: newPassword, wantLogin: newPassword},
+		{name: "wrong current password", current: "not my password", newPw: newPassword, wantErr: ErrPasswordIncorrect, wantLogin: testPassword},
+		{name: "too short", current: testPassword, newPw: "short", wantErr: ErrPasswordTooShort, wantLogin: testPassword},
+		{name: "empty", current: testPassword, newPw: "", wantErr: ErrPasswordRequired, wantLogin: testPassword},
+	}
+	for _, tt := range tests {
+		for name, backend := range testBackends(t) {
+			us := backend.User.(*userService)
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				user := createVerifiedUser(t, us, "jon@example.com")
+				err := us.ChangePassword(user, tt.current, tt.newPw)
+				if got := fieldError(err, "password"); got != tt.wantErr {
+					t.Fatalf("ChangePassword() error = %v, want %v", err, tt.wantErr)
+				}
+				if _, err := us.Authenticate("jon@example.com", tt.wantLogin); err != nil {
+					t.Errorf("Authenticate() with %q = %v, want it to work", tt.wantLogin, err)
+				}
+			})
+		}
+	}
+}
+
+func TestUpdateName(t *testing.T) {
+	tests := []struct {
+		name     string
+		newName  string
+		wantErr  error
+		wantName string
+	}{
+		{name: "trimmed", newName: "  Jon Snow ", wantName: "Jon Snow"},
+		{name: "empty", newName: "", wantName: ""},
+		{name: "longest", newName: strings.Repeat("é", nameMaxLength), wantName: strings.Repeat("é", nameMaxLength)},
+		{name: "too long", newName: strings.Repeat("a", nameMaxLength+1), wantErr: ErrNameTooLong},
+	}
+	for _, tt := range tests {
+		for name, backend := range testBackends(t) {
+			us := backend.User.(*userService)
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				user := createVerifiedUser(t, us, "jon@example.com")
+				user.Name = tt.newName
+				err := us.Update(user)
+				if got := fieldError(err, "name"); got != tt.wantErr {
+					t.Fatalf("Update() error = %v, want %v", err, tt.wantErr)
+				}
+				if tt.wantErr != nil {
+					return
+				}
+				stored, err := us.ByID(user.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if stored.Name != tt.wantName {
+					t.Errorf("stored name %q, want %q", stored.Name, tt.wantName)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"sort"
+	"strings"
+)
+
+// invalidError is the type of the errors validators return for values that are not allowed,
+// which sets them apart from errors like a failing database
+type invalidError string
+
+func (e invalidError) Error() string {
+	return string(e)
+}
+
+// Public returns the message without the package prefix, written as a sentence
+func (e invalidError) Public() string {
+	return publicMessage(string(e))
+}
+
+// ValidationError is returned when a model is created or updated with values that are not
+// allowed. Rather than stopping at the first problem it holds the problem with every field
+// that failed, keyed by the name the field has in forms.
+type ValidationError struct {
+	Fields map[string]error
+}
+
+// Error lists the problems in the order of the field names, so the message does not change from run to run
+func (ve *ValidationError) Error() string {
+	fields := ve.sortedFields()
+	msgs := make([]string, len(fields))
+	for i, field := range fields {
+		msgs[i] = ve.Fields[field].Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Public lists the public messages of the problems, in the same order as Error
+func (ve *ValidationError) Public() string {
+	fields := ve.sortedFields()
+	msgs := make([]string, len(fields))
+	for i, field := range fields {
+		msgs[i] = publicMessage(ve.Fields[field].Error())
+	}
+	return strings.Join(msgs, " ")
+}
+
+// Field returns the problem with the named field, or nil when it passed validation
+func (ve *ValidationError) Field(name string) error {
+	return ve.Fields[name]
+}
+
+// sortedFields returns the names of the fields that failed in alphabetical order
+func (ve *ValidationError) sortedFields() []string {
+	fields := make([]string, 0, len(ve.Fields))
+	for field := range ve.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
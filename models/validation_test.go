@@ -0,0 +1,136 @@
+package models
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidationError(t *testing.T) {
+	ve := &ValidationError{Fields: map[string]error{
+		"password": ErrPasswordTooShort,
+		"email":    ErrEmailTaken,
+		"name":     ErrNameTooLong,
+	}}
+	// the fields are listed alphabetically, whatever order the map gives them in
+	wantError := "models: email address is already taken; " + ErrNameTooLong.Error() + "; models: password must be at least 8 characters long"
+	wantPublic := "Email address is already taken. " + publicMessage(ErrNameTooLong.Error()) + " Password must be at least 8 characters long."
+	for i := 0; i < 10; i++ {
+		if got := ve.Error(); got != wantError {
+			t.Fatalf("Error() = %q, want %q", got, wantError)
+		}
+		if got := ve.Public(); got != wantPublic {
+			t.Fatalf("Public() = %q, want %q", got, wantPublic)
+		}
+	}
+	if got := ve.Field("email"); got != ErrEmailTaken {
+		t.Errorf("Field(email) = %v, want %v", got, ErrEmailTaken)
+	}
+	if got := ve.Field("remember_token"); got != nil {
+		t.Errorf("Field() of a field that passed = %v, want nil", got)
+	}
+}
+
+func TestRunUserFieldChecks(t *testing.T) {
+	errDB := errors.New("database is down")
+	pass := func(*User) error { return nil }
+	tooShort := func(*User) error { return ErrPasswordTooShort }
+	taken := func(*User) error { return ErrEmailTaken }
+	failDB := func(*User) error { return errDB }
+	var ran []string
+	record := func(name string) userValFn {
+		return func(*User) error {
+			ran = append(ran, name)
+			return nil
+		}
+	}
+
+	tests := []struct {
+		name       string
+		fields     []userFieldChecks
+		wantErr    error
+		wantFields map[string]error
+		wantRan    []string
+	}{
+		{
+			name: "all pass",
+			fields: []userFieldChecks{
+				{"email", []userValFn{pass, record("email")}},
+				{"password", []userValFn{pass, record("password")}},
+			},
+			wantRan: []string{"email", "password"},
+		},
+		{
+			name: "every failing field",
+			fields: []userFieldChecks{
+				{"email", []userValFn{taken, record("email")}},
+				{"name", []userValFn{pass, record("name")}},
+				{"password", []userValFn{tooShort}},
+			},
+			wantFields: map[string]error{"email": ErrEmailTaken, "password": ErrPasswordTooShort},
+			// a field stops at its first problem, the others still run
+			wantRan: []string{"name"},
+		},
+		{
+			name: "database failure",
+			fields: []userFieldChecks{
+				{"email", []userValFn{failDB}},
+				{"password", []userValFn{record("password")}},
+			},
+			wantErr: errDB,
+		},
+		{
+			name: "database failure after an invalid field",
+			fields: []userFieldChecks{
+				{"password", []userValFn{tooShort}},
+				{"email", []userValFn{failDB}},
+			},
+			wantErr: errDB,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ran = nil
+			err := runUserFieldChecks(&User{}, tt.fields...)
+			if tt.wantFields == nil {
+				if err != tt.wantErr {
+					t.Fatalf("runUserFieldChecks() error = %v, want %v", err, tt.wantErr)
+				}
+			} else {
+				ve, ok := err.(*ValidationError)
+				if !ok {
+					t.Fatalf("runUserFieldChecks() error = %v, want a *ValidationError", err)
+				}
+				if !reflect.DeepEqual(ve.Fields, tt.wantFields) {
+					t.Errorf("Fields = %v, want %v", ve.Fields, tt.wantFields)
+				}
+			}
+			if tt.wantRan != nil && !reflect.DeepEqual(ran, tt.wantRan) {
+				t.Errorf("checks ran for %v, want %v", ran, tt.wantRan)
+			}
+		})
+	}
+}
+
+func TestCreateReportsEveryField(t *testing.T) {
+	for name, backend := range testBackends(t) {
+		us := backend.User.(*userService)
+		t.Run(name, func(t *testing.T) {
+			createVerifiedUser(t, us, "jane@example.com")
+			user := User{Name: strings.Repeat("a", nameMaxLength+1), Email: "Jane@Example.com", Password: "short"}
+			err := us.Create(&user)
+			ve, ok := err.(*ValidationError)
+			if !ok {
+				t.Fatalf("Create() error = %v, want a *ValidationError", err)
+			}
+			want := map[string]error{"name": ErrNameTooLong, "email": ErrEmailTaken, "password": ErrPasswordTooShort}
+			if !reflect.DeepEqual(ve.Fields, want) {
+				t.Errorf("Fields = %v, want %v", ve.Fields, want)
+			}
+			if user.ID != 0 {
+				t.Error("Create() saved a user that failed validation")
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"gophr.com/imaging"
+	"gophr.com/logging"
+)
+
+// ErrVariantInvalid is a custom error we return when an image variant that is not one of the presets is asked for
+var ErrVariantInvalid = errors.New("models: image variant does not exist")
+
+// ImageVariant is a preset size that uploaded images are scaled down to
+type ImageVariant struct {
+	Name      string
+	MaxWidth  int
+	MaxHeight int
+}
+
+// ImageVariants holds the sizes generated for every uploaded image, from smallest to largest.
+// Run the server with -regen-variants after changing them so existing images catch up.
+var ImageVariants = []ImageVariant{
+	{Name: "thumbnail", MaxWidth: 200, MaxHeight: 200},
+	{Name: "medium", MaxWidth: 800, MaxHeight: 800},
+	{Name: "large", MaxWidth: 1600, MaxHeight: 1600},
+}
+
+func imageVariant(name string) (ImageVariant, bool) {
+	for _, v := range ImageVariants {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return ImageVariant{}, false
+}
+
+// VariantPath returns the URL path a resized variant of the image is served from
+func (i Image) VariantPath(variant string) string {
+	return i.Path() + "?size=" + variant
+}
+
+// SrcSet returns the value of an img srcset attribute listing every variant of the image by width
+func (i Image) SrcSet() string {
+	if i.Width == 0 || i.Height == 0 {
+		return ""
+	}
+	var candidates []string
+	seen := make(map[int]bool)
+	for _, v := range ImageVariants {
+		w, _ := imaging.FitSize(i.Width, i.Height, v.MaxWidth, v.MaxHeight)
+		if seen[w] {
+			continue
+		}
+		seen[w] = true
+		candidates = append(candidates, fmt.Sprintf("%s %dw", i.VariantPath(v.Name), w))
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// VariantContentType returns the content type the resized variants of the image are encoded with.
+// JPEGs stay JPEGs, everything else becomes a PNG so transparency survives.
+func (i Image) VariantContentType() string {
+	if i.ContentType == "image/jpeg" {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
+
+func (i Image) variantFormat() string {
+	if i.ContentType == "image/jpeg" {
+		return "jpeg"
+	}
+	return "png"
+}
+
+// variantKey returns the storage key a resized variant of the image is kept under
+func (i *Image) variantKey(variant string) string {
+	return path.Join(galleryImageKey(i.GalleryID), variant, i.Filename)
+}
+
+// OpenVariant is used to read a resized variant of an image
+func (is *imageService) OpenVariant(image *Image, variant string) (io.ReadCloser, error) {
+	if _, ok := imageVariant(variant); !ok {
+		return nil, ErrVariantInvalid
+	}
+	return is.store.Get(image.variantKey(variant))
+}
+
+// RegenerateVariants is used to rebuild the variants of every image after the presets change
+func (is *imageService) RegenerateVariants() error {
+	images, err := is.ImageDB.All()
+	if err != nil {
+		return err
+	}
+	for i := range images {
+		image := &images[i]
+		if err := is.generateVariants(image); err != nil {
+			logging.Default().Error(err, "image_id", image.ID)
+			continue
+		}
+		if err := is.ImageDB.Update(image); err != nil {
+			return err
+		}
+		if err := is.removeVariants(image, currentVariants(image)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// currentVariants names the directories an image is kept in besides the original
+func currentVariants(image *Image) map[string]bool {
+	current := map[string]bool{publicDir: true}
+	if image.HasLocation {
+		current[publicLocatedDir] = true
+	}
+	for _, v := range ImageVariants {
+		current[v.Name] = true
+	}
+	return current
+}
+
+// generateVariants decodes the stored original of an image, records its dimensions
+// and EXIF metadata, stores a resized copy for every preset and the copies shown to
+// visitors with the metadata stripped
+func (is *imageService) generateVariants(image *Image) error {
+	rc, err := is.store.Get(image.key())
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	pic, err := imaging.Decode(data)
+	if err == imaging.ErrTooManyPixels {
+		return ErrImageTooManyPixels
+	}
+	if err != nil {
+		return ErrImageTypeInvalid
+	}
+	image.Width, image.Height = pic.Size()
+	image.setMetadata(imaging.ReadMetadata(data))
+
+	for _, v := range ImageVariants {
+		var buf bytes.Buffer
+		if err := imaging.Encode(&buf, pic.Fit(v.MaxWidth, v.MaxHeight), image.variantFormat()); err != nil {
+			return err
+		}
+		if err := is.store.Put(image.variantKey(v.Name), &buf); err != nil {
+			return err
+		}
+	}
+	if err := is.store.Put(image.publicKey(false), bytes.NewReader(imaging.StripMetadata(data, false))); err != nil {
+		return err
+	}
+	if image.HasLocation {
+		return is.store.Put(image.publicKey(true), bytes.NewReader(imaging.StripMetadata(data, true)))
+	}
+	return nil
+}
+
+// removeVariants deletes the stored variants of an image except the ones named in keep
+func (is *imageService) removeVariants(image *Image, keep map[string]bool) error {
+	objects, err := is.store.List(galleryImageKey(image.GalleryID) + "/")
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		// variants live one directory below the original: galleries/<id>/<variant>/<filename>
+		rest := strings.TrimPrefix(o.Key, galleryImageKey(image.GalleryID)+"/")
+		parts := strings.Split(rest, "/")
+		if len(parts) != 2 || parts[1] != image.Filename || keep[parts[0]] {
+			continue
+		}
+		if err := is.store.Delete(o.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package models
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+
+	"gophr.com/storage"
+)
+
+func TestImageSrcSet(t *testing.T) {
+	tests := []struct {
+		name   string
+		width  int
+		height int
+		want   string
+	}{
+		{"landscape", 4000, 3000, "/galleries/1/images/a.png?size=thumbnail 200w, /galleries/1/images/a.png?size=medium 800w, /galleries/1/images/a.png?size=large 1600w"},
+		{"portrait", 3000, 4000, "/galleries/1/images/a.png?size=thumbnail 150w, /galleries/1/images/a.png?size=medium 600w, /galleries/1/images/a.png?size=large 1200w"},
+		// variants are never scaled up, so the ones as big as the original are listed once
+		{"smaller than medium", 500, 250, "/galleries/1/images/a.png?size=thumbnail 200w, /galleries/1/images/a.png?size=medium 500w"},
+		{"smaller than a thumbnail", 100, 50, "/galleries/1/images/a.png?size=thumbnail 100w"},
+		{"size unknown", 0, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := Image{GalleryID: 1, Filename: "a.png", Width: tt.width, Height: tt.height}
+			if got := i.SrcSet(); got != tt.want {
+				t.Errorf("SrcSet() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImageVariantContentType(t *testing.T) {
+	tests := map[string]string{
+		"image/jpeg": "image/jpeg",
+		"image/png":  "image/png",
+		"image/gif":  "image/png",
+		"image/webp": "image/png",
+	}
+	for contentType, want := range tests {
+		if got := (Image{ContentType: contentType}).VariantContentType(); got != want {
+			t.Errorf("VariantContentType() of %s = %s, want %s", contentType, got, want)
+		}
+	}
+}
+
+// variantSize returns the dimensions of a stored variant of an image
+func variantSize(t *testing.T, is ImageService, image *Image, variant string) (int, int) {
+	t.Helper()
+	rc, err := is.OpenVariant(image, variant)
+	if err != nil {
+		t.Fatalf("OpenVariant(%s) error = %v", variant, err)
+	}
+	defer rc.Close()
+	cfg, err := png.DecodeConfig(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg.Width, cfg.Height
+}
+
+func TestImageUploadVariants(t *testing.T) {
+	s := newTestServices(t)
+	img, err := s.Image.Upload(1, "wide.png", bytes.NewReader(testPNG(t, 1000, 500, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Width != 1000 || img.Height != 500 {
+		t.Errorf("Upload() recorded %dx%d, want 1000x500", img.Width, img.Height)
+	}
+	tests := []struct {
+		variant               string
+		wantWidth, wantHeight int
+	}{
+		{"thumbnail", 200, 100},
+		{"medium", 800, 400},
+		{"large", 1000, 500},
+	}
+	for _, tt := range tests {
+		if w, h := variantSize(t, s.Image, img, tt.variant); w != tt.wantWidth || h != tt.wantHeight {
+			t.Errorf("%s is %dx%d, want %dx%d", tt.variant, w, h, tt.wantWidth, tt.wantHeight)
+		}
+	}
+	if _, err := s.Image.OpenVariant(img, "huge"); err != ErrVariantInvalid {
+		t.Errorf("OpenVariant() of an unknown preset error = %v, want %v", err, ErrVariantInvalid)
+	}
+}
+
+func TestRegenerateVariants(t *testing.T) {
+	store, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServices(t, WithImage(store, 1<<20))
+	img, err := s.Image.Upload(1, "wide.png", bytes.NewReader(testPNG(t, 1000, 500, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a preset that was dropped, for this image and for a file that is not one of ours
+	for _, key := range []string{"galleries/1/old/wide.png", "galleries/1/old/other.png"} {
+		if err := store.Put(key, strings.NewReader("stale")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func(old []ImageVariant) { ImageVariants = old }(ImageVariants)
+	ImageVariants = []ImageVariant{
+		{Name: "thumbnail", MaxWidth: 100, MaxHeight: 100},
+		{Name: "medium", MaxWidth: 800, MaxHeight: 800},
+	}
+	if err := s.Image.RegenerateVariants(); err != nil {
+		t.Fatal(err)
+	}
+	if w, h := variantSize(t, s.Image, img, "thumbnail"); w != 100 || h != 50 {
+		t.Errorf("thumbnail is %dx%d after regenerating, want 100x50", w, h)
+	}
+	for _, key := range []string{"galleries/1/old/wide.png", "galleries/1/large/wide.png"} {
+		if _, err := store.Stat(key); err != storage.ErrNotExist {
+			t.Errorf("Stat(%s) = %v, want the variant of a dropped preset removed", key, err)
+		}
+	}
+	for _, key := range []string{"galleries/1/old/other.png", "galleries/1/wide.png", "galleries/1/public/wide.png"} {
+		if _, err := store.Stat(key); err != nil {
+			t.Errorf("Stat(%s) = %v, want it kept", key, err)
+		}
+	}
+}
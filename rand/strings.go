@@ -2,11 +2,20 @@ package rand
 
 import (
 	"crypto/rand"
+	"encoding/base32"
 	"encoding/base64"
 )
 
-// RememberTokenBytes stores the size (the number of bytes) of the remember tokens
-const RememberTokenBytes = 32
+const (
+	// RememberTokenBytes stores the size (the number of bytes) of the remember tokens
+	RememberTokenBytes = 32
+
+	// TOTPSecretBytes is the size of the secrets shared with authenticator apps, 160 bits as RFC 4226 recommends
+	TOTPSecretBytes = 20
+
+	// RequestIDBytes is the size of the ids that tell requests apart in the logs
+	RequestIDBytes = 12
+)
 
 // Bytes will generate n random bytes or return an error if it fails to do so.
 func Bytes(n int) ([]byte, error) {
@@ -40,3 +49,18 @@ func NBytes(base64String string) (int, error) {
 func RememberToken() (string, error) {
 	return String(RememberTokenBytes)
 }
+
+// TOTPSecret returns a random secret for an authenticator app, base32 encoded without
+// padding as authenticator apps expect it
+func TOTPSecret() (string, error) {
+	b, err := Bytes(TOTPSecretBytes)
+	if err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b), nil
+}
+
+// RequestID returns a random id for a request, short enough to be read out to support
+func RequestID() (string, error) {
+	return String(RequestIDBytes)
+}
@@ -0,0 +1,399 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// unsignedPayload tells the server the request body is not part of the signature,
+	// which lets us stream objects without hashing them up front
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+
+	// s3Timeout bounds a whole request, reading the body of the response included
+	s3Timeout = 2 * time.Minute
+
+	// s3HeaderTimeout bounds the wait for the server to start answering once the request is sent
+	s3HeaderTimeout = 30 * time.Second
+)
+
+// S3Config holds the settings of the S3 compatible backend
+type S3Config struct {
+	// Endpoint is the base URL of the server, e.g. https://s3.us-east-1.amazonaws.com or http://localhost:9000
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+}
+
+// S3 is a Store that keeps objects in a bucket of an S3 compatible server.
+// Requests use path style addressing and AWS signature version 4.
+type S3 struct {
+	endpoint *url.URL
+	region   string
+	bucket   string
+	access   string
+	secret   string
+	client   *http.Client
+	now      func() time.Time
+}
+
+// NewS3 creates a Store backed by the bucket described in the config
+func NewS3(c S3Config) (*S3, error) {
+	if c.Endpoint == "" || c.Bucket == "" {
+		return nil, errors.New("storage: s3 endpoint and bucket are required")
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	region := c.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3{
+		endpoint: u,
+		region:   region,
+		bucket:   c.Bucket,
+		access:   c.AccessKey,
+		secret:   c.SecretKey,
+		client:   newS3Client(),
+		now:      time.Now,
+	}, nil
+}
+
+// newS3Client returns the client requests are sent with. A server that stalls would
+// otherwise hold up the handlers uploading or serving images for good.
+func newS3Client() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = s3HeaderTimeout
+	return &http.Client{
+		Transport: transport,
+		Timeout:   s3Timeout,
+	}
+}
+
+// Put uploads an object. S3 needs the length of the body up front, so the
+// reader is spooled to a temporary file unless its size is already known.
+func (s *S3) Put(key string, r io.Reader) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+	body, size, cleanup, err := sizedBody(r)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if size == 0 {
+		body = http.NoBody
+	}
+	req, err := s.newRequest("PUT", key, nil, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	res, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Get downloads an object, the body is streamed from the server
+func (s *S3) Get(key string) (io.ReadCloser, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := s.newRequest("GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// Delete removes an object from the bucket
+func (s *S3) Delete(key string) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+	req, err := s.newRequest("DELETE", key, nil, nil)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(req)
+	if err == ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Stat looks up the size and modification time of an object
+func (s *S3) Stat(key string) (*ObjectInfo, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := s.newRequest("HEAD", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	info := ObjectInfo{
+		Key:  key,
+		Size: res.ContentLength,
+	}
+	if lm := res.Header.Get("Last-Modified"); lm != "" {
+		info.ModTime, _ = http.ParseTime(lm)
+	}
+	return &info, nil
+}
+
+// listBucketResult is the part of a ListObjectsV2 response we care about
+type listBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+}
+
+// List pages through ListObjectsV2 and returns every object starting with prefix
+func (s *S3) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := s.newRequest("GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err := s.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:     c.Key,
+				Size:    c.Size,
+				ModTime: c.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+// newRequest builds a signed request for an object key, or for the bucket itself when key is empty
+func (s *S3) newRequest(method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3CanonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, query)
+	return req, nil
+}
+
+// do sends a request and turns error responses into Go errors
+func (s *S3) do(req *http.Request) (*http.Response, error) {
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrNotExist
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return nil, fmt.Errorf("storage: s3 %s %s: %s: %s", req.Method, req.URL.Path, res.Status, strings.TrimSpace(string(msg)))
+}
+
+// sign adds the headers of an AWS signature version 4 to the request
+func (s *S3) sign(req *http.Request, query url.Values) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", unsignedPayload)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": unsignedPayload,
+		"x-amz-date":           amzDate,
+	}
+	signature, signedHeaders := signV4(s.secret, s.region, now, req.Method, req.URL.Path, query, headers, unsignedPayload)
+	scope := now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.access, scope, signedHeaders, signature))
+}
+
+// signV4 returns the AWS signature version 4 of an S3 request made at t, along with the
+// list of the headers it signs. headers holds the headers to sign keyed by lower case name.
+func signV4(secret, region string, t time.Time, method, path string, query url.Values, headers map[string]string, payloadHash string) (string, string) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	day := t.Format("20060102")
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		method,
+		s3EscapePath(path),
+		s3CanonicalQuery(query),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+secret), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign)), signedHeaders
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape percent encodes everything but the unreserved characters of RFC 3986, as AWS expects
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3EscapePath(p string) string {
+	return s3Escape(p, true)
+}
+
+// s3CanonicalQuery encodes query parameters sorted by name
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// sizedBody returns a reader whose length is known, spooling r to a temporary file when needed
+func sizedBody(r io.Reader) (io.Reader, int64, func(), error) {
+	// bytes.Buffer, bytes.Reader and strings.Reader all know how much is left to read
+	if v, ok := r.(interface {
+		io.Reader
+		Len() int
+	}); ok {
+		return v, int64(v.Len()), func() {}, nil
+	}
+	tmp, err := ioutil.TempFile("", "gophr-s3-")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		cleanup()
+		return nil, 0, nil, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, 0, nil, err
+	}
+	return tmp, size, cleanup, nil
+}
+
+var _ Store = &S3{}
@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSignV4 checks the signer against the examples in the AWS documentation on signing S3 requests
+func TestSignV4(t *testing.T) {
+	const (
+		secret    = "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY"
+		host      = "examplebucket.s3.amazonaws.com"
+		amzDate   = "20130524T000000Z"
+		emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	)
+	at := time.Date(2013, 5, 24, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name              string
+		method            string
+		path              string
+		query             url.Values
+		headers           map[string]string
+		payloadHash       string
+		wantSignature     string
+		wantSignedHeaders string
+	}{
+		{
+			name:   "GET object",
+			method: "GET",
+			path:   "/test.txt",
+			headers: map[string]string{
+				"host":                 host,
+				"range":                "bytes=0-9",
+				"x-amz-content-sha256": emptyHash,
+				"x-amz-date":           amzDate,
+			},
+			payloadHash:       emptyHash,
+			wantSignature:     "f0e8bdb87c964420e857bd35b5d6ed310bd44f0170aba48dd91039c6036bdb41",
+			wantSignedHeaders: "host;range;x-amz-content-sha256;x-amz-date",
+		},
+		{
+			name:   "PUT object",
+			method: "PUT",
+			path:   "/test$file.text",
+			headers: map[string]string{
+				"date":                 "Fri, 24 May 2013 00:00:00 GMT",
+				"host":                 host,
+				"x-amz-content-sha256": "44ce7dd67c959e0d3524ffac1771dfbba87d2b6b4b4e99e42034a8b803f8b072",
+				"x-amz-date":           amzDate,
+				"x-amz-storage-class":  "REDUCED_REDUNDANCY",
+			},
+			payloadHash:       "44ce7dd67c959e0d3524ffac1771dfbba87d2b6b4b4e99e42034a8b803f8b072",
+			wantSignature:     "98ad721746da40c64f1a55b78f14c238d841ea1380cd77a1b5971af0ece108bd",
+			wantSignedHeaders: "date;host;x-amz-content-sha256;x-amz-date;x-amz-storage-class",
+		},
+		{
+			name:   "GET bucket lifecycle",
+			method: "GET",
+			path:   "/",
+			query:  url.Values{"lifecycle": {""}},
+			headers: map[string]string{
+				"host":                 host,
+				"x-amz-content-sha256": emptyHash,
+				"x-amz-date":           amzDate,
+			},
+			payloadHash:       emptyHash,
+			wantSignature:     "fea454ca298b7da1c68078a5d1bdbfbbe0d65c699e0f91ac7a200a0136783543",
+			wantSignedHeaders: "host;x-amz-content-sha256;x-amz-date",
+		},
+		{
+			name:   "list objects",
+			method: "GET",
+			path:   "/",
+			query:  url.Values{"max-keys": {"2"}, "prefix": {"J"}},
+			headers: map[string]string{
+				"host":                 host,
+				"x-amz-content-sha256": emptyHash,
+				"x-amz-date":           amzDate,
+			},
+			payloadHash:       emptyHash,
+			wantSignature:     "34b48302e7b5fa45bde8084f4b7868a86f0a534bc59db6670ed5711ef69dc6f7",
+			wantSignedHeaders: "host;x-amz-content-sha256;x-amz-date",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signature, signedHeaders := signV4(secret, "us-east-1", at, tt.method, tt.path, tt.query, tt.headers, tt.payloadHash)
+			if signature != tt.wantSignature {
+				t.Errorf("signature = %s, want %s", signature, tt.wantSignature)
+			}
+			if signedHeaders != tt.wantSignedHeaders {
+				t.Errorf("signed headers = %s, want %s", signedHeaders, tt.wantSignedHeaders)
+			}
+		})
+	}
+}
+
+func TestS3(t *testing.T) {
+	fake := newFakeS3(t)
+	store, err := NewS3(S3Config{
+		Endpoint:  fake.URL,
+		Region:    "eu-west-1",
+		Bucket:    "photos",
+		AccessKey: "access",
+		SecretKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, store)
+}
+
+func TestS3StalledServer(t *testing.T) {
+	stop := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stop
+	}))
+	defer srv.Close()
+	defer close(stop)
+
+	store, err := NewS3(S3Config{Endpoint: srv.URL, Bucket: "photos"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.client.Transport.(*http.Transport).ResponseHeaderTimeout = 50 * time.Millisecond
+	done := make(chan error, 1)
+	go func() {
+		_, err := store.Get("galleries/1/cat.jpg")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Get from a server that never answers succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get from a server that never answers did not give up")
+	}
+}
+
+// fakeS3 is enough of an S3 server to run testStore against, it checks every request is signed
+type fakeS3 struct {
+	*httptest.Server
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	f := &fakeS3{objects: map[string][]byte{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !f.signed(r) {
+			t.Errorf("%s %s has a bad signature", r.Method, r.URL)
+			http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+			return
+		}
+		f.serve(w, r)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeS3) signed(r *http.Request) bool {
+	at, err := time.Parse("20060102T150405Z", r.Header.Get("x-amz-date"))
+	if err != nil {
+		return false
+	}
+	headers := map[string]string{
+		"host":                 r.Host,
+		"x-amz-content-sha256": r.Header.Get("x-amz-content-sha256"),
+		"x-amz-date":           r.Header.Get("x-amz-date"),
+	}
+	signature, _ := signV4("secret", "eu-west-1", at, r.Method, r.URL.Path, r.URL.Query(), headers, unsignedPayload)
+	return strings.HasSuffix(r.Header.Get("Authorization"), "Signature="+signature)
+}
+
+func (f *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/photos/")
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/photos":
+		f.list(w, r.URL.Query().Get("prefix"))
+	case r.Method == "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = body
+	case r.Method == "GET" || r.Method == "HEAD":
+		body, ok := f.objects[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body)
+	case r.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	var result listBucketResult
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		result.Contents = append(result.Contents, struct {
+			Key          string    `xml:"Key"`
+			Size         int64     `xml:"Size"`
+			LastModified time.Time `xml:"LastModified"`
+		}{key, int64(len(f.objects[key])), time.Now()})
+	}
+	xml.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotExist is returned when the object asked for is not present in the store
+	ErrNotExist = errors.New("storage: object does not exist")
+
+	// ErrKeyInvalid is returned when a key is empty or tries to escape the store
+	ErrKeyInvalid = errors.New("storage: key is not valid")
+)
+
+const (
+	// BackendLocal keeps objects in a directory on the local filesystem
+	BackendLocal = "local"
+
+	// BackendS3 keeps objects in a bucket of an S3 compatible server
+	BackendS3 = "s3"
+)
+
+// ObjectInfo describes an object kept in a Store
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Store is a place where blobs such as uploaded images are kept.
+// Keys are slash separated paths like "galleries/1/cat.jpg".
+type Store interface {
+	// Put stores everything read from r under key, replacing any existing object
+	Put(key string, r io.Reader) error
+	// Get opens the object stored under key, the caller must close it
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes the object stored under key, deleting a missing object is not an error
+	Delete(key string) error
+	// List returns every object whose key starts with prefix
+	List(prefix string) ([]ObjectInfo, error)
+	// Stat returns information about the object stored under key
+	Stat(key string) (*ObjectInfo, error)
+}
+
+// Config holds the settings used to pick and set up a Store
+type Config struct {
+	Backend string      `json:"backend"`
+	Local   LocalConfig `json:"local"`
+	S3      S3Config    `json:"s3"`
+}
+
+// LocalConfig holds the settings of the local filesystem backend
+type LocalConfig struct {
+	Dir string `json:"dir"`
+}
+
+// DefaultConfig returns a config storing objects under images/ on the local disk
+func DefaultConfig() Config {
+	return Config{
+		Backend: BackendLocal,
+		Local: LocalConfig{
+			Dir: "images/",
+		},
+	}
+}
+
+// LoadEnv overrides the settings in c with any GOPHR_STORAGE_* and GOPHR_S3_* environment variables that are set
+func (c *Config) LoadEnv() {
+	setFromEnv(&c.Backend, "GOPHR_STORAGE_BACKEND")
+	setFromEnv(&c.Local.Dir, "GOPHR_STORAGE_DIR")
+	setFromEnv(&c.S3.Endpoint, "GOPHR_S3_ENDPOINT")
+	setFromEnv(&c.S3.Region, "GOPHR_S3_REGION")
+	setFromEnv(&c.S3.Bucket, "GOPHR_S3_BUCKET")
+	setFromEnv(&c.S3.AccessKey, "GOPHR_S3_ACCESS_KEY")
+	setFromEnv(&c.S3.SecretKey, "GOPHR_S3_SECRET_KEY")
+}
+
+func setFromEnv(dst *string, name string) {
+	if v, ok := os.LookupEnv(name); ok {
+		*dst = v
+	}
+}
+
+// New creates the Store selected by the config
+func New(c Config) (Store, error) {
+	switch c.Backend {
+	case BackendLocal, "":
+		return NewLocal(c.Local.Dir)
+	case BackendS3:
+		return NewS3(c.S3)
+	default:
+		return nil, fmt.Errorf("storage: unknown backend %q", c.Backend)
+	}
+}
+
+// cleanKey makes sure a key is a relative slash separated path that stays inside the store
+func cleanKey(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return "", ErrKeyInvalid
+	}
+	cleaned := path.Clean(key)
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", ErrKeyInvalid
+	}
+	return cleaned, nil
+}
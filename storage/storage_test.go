@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestCleanKey(t *testing.T) {
+	tests := []struct {
+		key     string
+		want    string
+		wantErr error
+	}{
+		{"galleries/1/cat.jpg", "galleries/1/cat.jpg", nil},
+		{"galleries//1/./cat.jpg", "galleries/1/cat.jpg", nil},
+		{"galleries/1/../2/cat.jpg", "galleries/2/cat.jpg", nil},
+		{"", "", ErrKeyInvalid},
+		{".", "", ErrKeyInvalid},
+		{"..", "", ErrKeyInvalid},
+		{"../secrets", "", ErrKeyInvalid},
+		{"galleries/../../secrets", "", ErrKeyInvalid},
+		{"/etc/passwd", "", ErrKeyInvalid},
+		{`galleries\1\cat.jpg`, "", ErrKeyInvalid},
+	}
+	for _, tt := range tests {
+		got, err := cleanKey(tt.key)
+		if got != tt.want || err != tt.wantErr {
+			t.Errorf("cleanKey(%q) = %q, %v, want %q, %v", tt.key, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestLocal(t *testing.T) {
+	store, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, store)
+}
+
+// testStore runs the checks every Store has to pass
+func testStore(t *testing.T, store Store) {
+	objects := map[string]string{
+		"galleries/1/cat.jpg":       "meow",
+		"galleries/1/dog photo.jpg": "woof",
+		"galleries/12/cow.jpg":      "moo",
+		"galleries/2/empty.jpg":     "",
+	}
+	for key, body := range objects {
+		if err := store.Put(key, strings.NewReader(body)); err != nil {
+			t.Fatalf("Put(%q): %v", key, err)
+		}
+	}
+	// a reader that does not know its length has to work too
+	if err := store.Put("galleries/2/bird.jpg", ioutil.NopCloser(strings.NewReader("tweet"))); err != nil {
+		t.Fatalf("Put with a reader of unknown length: %v", err)
+	}
+	objects["galleries/2/bird.jpg"] = "tweet"
+
+	for key, body := range objects {
+		rc, err := store.Get(key)
+		if err != nil {
+			t.Fatalf("Get(%q): %v", key, err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil || string(got) != body {
+			t.Errorf("Get(%q) = %q, %v, want %q", key, got, err, body)
+		}
+		info, err := store.Stat(key)
+		if err != nil || info.Key != key || info.Size != int64(len(body)) {
+			t.Errorf("Stat(%q) = %+v, %v, want a size of %d", key, info, err, len(body))
+		}
+	}
+
+	listTests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"galleries/1/", []string{"galleries/1/cat.jpg", "galleries/1/dog photo.jpg"}},
+		{"galleries/1", []string{"galleries/1/cat.jpg", "galleries/1/dog photo.jpg", "galleries/12/cow.jpg"}},
+		{"galleries/3/", nil},
+	}
+	for _, tt := range listTests {
+		infos, err := store.List(tt.prefix)
+		if err != nil {
+			t.Fatalf("List(%q): %v", tt.prefix, err)
+		}
+		var got []string
+		for _, info := range infos {
+			got = append(got, info.Key)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("List(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+
+	if err := store.Delete("galleries/1/cat.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("galleries/1/cat.jpg"); err != ErrNotExist {
+		t.Errorf("Get of a deleted object = %v, want ErrNotExist", err)
+	}
+	if _, err := store.Stat("galleries/1/cat.jpg"); err != ErrNotExist {
+		t.Errorf("Stat of a deleted object = %v, want ErrNotExist", err)
+	}
+	if err := store.Delete("galleries/1/cat.jpg"); err != nil {
+		t.Errorf("deleting a missing object = %v, want nil", err)
+	}
+	if err := store.Put("../outside.jpg", strings.NewReader("x")); err != ErrKeyInvalid {
+		t.Errorf("Put outside the store = %v, want ErrKeyInvalid", err)
+	}
+}
@@ -0,0 +1,99 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	// Period is how long each code is valid for, the default of every authenticator app
+	Period = 30 * time.Second
+
+	// Digits is the length of the codes
+	Digits = 6
+
+	// skew is the number of periods before and after the current one whose codes are
+	// still accepted, to allow for clocks that are a little off and slow typing
+	skew = 1
+)
+
+var (
+	// ErrCodeInvalid is returned when a code does not match the secret at the time given
+	ErrCodeInvalid = errors.New("totp: code is not valid")
+
+	// ErrSecretInvalid is returned when a secret is not valid base32
+	ErrSecretInvalid = errors.New("totp: secret is not valid base32")
+
+	encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// Step returns the number of the period t falls in, codes are derived from it
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code returns the code for the secret in the given step, as described in RFC 6238
+func Code(secret string, step int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", ErrSecretInvalid
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	h := hmac.New(sha1.New, key)
+	h.Write(msg[:])
+	sum := h.Sum(nil)
+	// dynamic truncation from RFC 4226
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", Digits, value%uint32(math.Pow10(Digits))), nil
+}
+
+// Validate checks the code against the secret at time t and returns the step it
+// belongs to, which callers can store to refuse the same code a second time
+func Validate(secret, code string, t time.Time) (int64, error) {
+	code = strings.Replace(strings.TrimSpace(code), " ", "", -1)
+	if len(code) != Digits {
+		return 0, ErrCodeInvalid
+	}
+	now := Step(t)
+	for step := now - skew; step <= now+skew; step++ {
+		want, err := Code(secret, step)
+		if err != nil {
+			return 0, err
+		}
+		if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return step, nil
+		}
+	}
+	return 0, ErrCodeInvalid
+}
+
+// URI returns the otpauth:// link that sets up an authenticator app with the secret,
+// labelled with the issuer and the account name
+func URI(secret, issuer, account string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(Digits))
+	v.Set("period", fmt.Sprint(int(Period/time.Second)))
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// QRCode returns a PNG image of the QR code for the URI, size pixels wide
+func QRCode(uri string, size int) ([]byte, error) {
+	return qrcode.Encode(uri, qrcode.Medium, size)
+}
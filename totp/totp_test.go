@@ -0,0 +1,107 @@
+package totp
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 key of the test vectors in RFC 6238, "12345678901234567890" in base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// the test vectors of RFC 6238 appendix B, cut to our 6 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Code() at %d = %q, want %q", tt.unix, got, tt.want)
+		}
+	}
+
+	lower, err := Code(strings.ToLower(rfcSecret), Step(time.Unix(59, 0)))
+	if err != nil || lower != "287082" {
+		t.Errorf("Code() with a lower case secret = %q, %v, want %q", lower, err, "287082")
+	}
+	if _, err := Code("not base32!", 1); err != ErrSecretInvalid {
+		t.Errorf("Code() with a bad secret error = %v, want %v", err, ErrSecretInvalid)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+	code := func(step int64) string {
+		c, err := Code(rfcSecret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		wantStep int64
+		wantErr  error
+	}{
+		{name: "current", secret: rfcSecret, code: code(step), wantStep: step},
+		{name: "previous period", secret: rfcSecret, code: code(step - 1), wantStep: step - 1},
+		{name: "next period", secret: rfcSecret, code: code(step + 1), wantStep: step + 1},
+		{name: "typed with spaces", secret: rfcSecret, code: " " + code(step)[:3] + " " + code(step)[3:] + " ", wantStep: step},
+		{name: "two periods old", secret: rfcSecret, code: code(step - 2), wantErr: ErrCodeInvalid},
+		{name: "two periods ahead", secret: rfcSecret, code: code(step + 2), wantErr: ErrCodeInvalid},
+		{name: "wrong", secret: rfcSecret, code: "000000", wantErr: ErrCodeInvalid},
+		{name: "too short", secret: rfcSecret, code: code(step)[:5], wantErr: ErrCodeInvalid},
+		{name: "empty", secret: rfcSecret, code: "", wantErr: ErrCodeInvalid},
+		{name: "bad secret", secret: "not base32!", code: "123456", wantErr: ErrSecretInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Validate(tt.secret, tt.code, now)
+			if err != tt.wantErr {
+				t.Fatalf("Validate() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.wantStep {
+				t.Errorf("Validate() step = %d, want %d", got, tt.wantStep)
+			}
+		})
+	}
+}
+
+func TestURI(t *testing.T) {
+	u, err := url.Parse(URI(rfcSecret, "Gophr", "jon@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Gophr:jon@example.com" {
+		t.Errorf("URI() = %s, want a totp link labelled Gophr:jon@example.com", u)
+	}
+	want := map[string]string{
+		"secret":    rfcSecret,
+		"issuer":    "Gophr",
+		"algorithm": "SHA1",
+		"digits":    "6",
+		"period":    "30",
+	}
+	q := u.Query()
+	for k, v := range want {
+		if q.Get(k) != v {
+			t.Errorf("%s = %q, want %q", k, q.Get(k), v)
+		}
+	}
+}
@@ -1,9 +1,16 @@
 package views
 
 import (
+	"errors"
 	"html/template"
 	"net/http"
 	"path/filepath"
+
+	"gophr.com/context"
+	"gophr.com/logging"
+	"gophr.com/models"
+
+	"github.com/gorilla/csrf"
 )
 
 var (
@@ -39,7 +46,42 @@ type Alert struct {
 
 type Data struct {
 	Alert *Alert
+	User  *models.User
 	Yield interface{}
+
+	// err is the error behind a generic alert, Render logs it along with where it was set
+	err       error
+	errCaller string
+}
+
+// SetAlert shows err to the user in an error alert. Only the errors from the models that
+// are meant for users say what went wrong, anything else is logged when the page is rendered
+// and AlertMsgGeneric is shown instead so no details of the server end up in the page.
+func (d *Data) SetAlert(err error) {
+	d.setAlert(AlertLvlError, err)
+}
+
+// SetWarning is SetAlert for errors users can deal with themselves, like having to wait a little
+func (d *Data) SetWarning(err error) {
+	d.setAlert(AlertLvlWarning, err)
+}
+
+func (d *Data) setAlert(level string, err error) {
+	d.err = nil
+	if pErr, ok := err.(models.PublicError); ok {
+		d.Alert = &Alert{
+			Level:   level,
+			Message: pErr.Public(),
+		}
+		return
+	}
+	// logged as coming from the handler that called SetAlert or SetWarning
+	d.err = err
+	d.errCaller = logging.Caller(2)
+	d.Alert = &Alert{
+		Level:   AlertLvlError,
+		Message: AlertMsgGeneric,
+	}
 }
 
 func layoutFiles() []string {
@@ -67,7 +109,15 @@ func NewView(layout string, files ...string) *View {
 	addTemplatePath(files)
 	addTemplateExt(files)
 	files = append(files, layoutFiles()...)
-	t, err := template.ParseFiles(files...)
+	// the csrf functions are placeholders so the templates parse, Render swaps in ones bound to the request
+	t, err := template.New("").Funcs(template.FuncMap{
+		"csrfField": func() (template.HTML, error) {
+			return "", errors.New("views: csrfField is not implemented")
+		},
+		"csrfToken": func() (string, error) {
+			return "", errors.New("views: csrfToken is not implemented")
+		},
+	}).ParseFiles(files...)
 	if err != nil {
 		panic(err)
 	}
@@ -77,22 +127,40 @@ func NewView(layout string, files ...string) *View {
 	}
 }
 
-// Render executes the parsed template that is passed to it
-func (v *View) Render(w http.ResponseWriter, data interface{}) error {
+// Render executes the parsed template that is passed to it along with the logged in user of the request.
+// Forms in the templates get the CSRF token of the request through the csrfField function.
+func (v *View) Render(w http.ResponseWriter, r *http.Request, data interface{}) error {
 	w.Header().Set("Content-Type", "text/html")
-	switch data.(type) {
+	tpl, err := v.Template.Clone()
+	if err != nil {
+		return err
+	}
+	tpl = tpl.Funcs(template.FuncMap{
+		"csrfField": func() template.HTML {
+			return csrf.TemplateField(r)
+		},
+		"csrfToken": func() string {
+			return csrf.Token(r)
+		},
+	})
+	var vd Data
+	switch d := data.(type) {
 	case Data:
-
+		vd = d
 	default:
-		data = Data{
+		vd = Data{
 			Yield: data,
 		}
 	}
-	return v.Template.ExecuteTemplate(w, v.Layout, data)
+	vd.User = context.User(r.Context())
+	if vd.err != nil {
+		logging.FromContext(r.Context()).With("caller", vd.errCaller).Error(vd.err)
+	}
+	return tpl.ExecuteTemplate(w, v.Layout, vd)
 }
 
 func (v *View) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if err := v.Render(w, nil); err != nil {
+	if err := v.Render(w, r, nil); err != nil {
 		panic(err)
 	}
 }